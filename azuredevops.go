@@ -9,7 +9,10 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
@@ -29,73 +32,93 @@ const (
 )
 
 func (ad *AzureDevOpsHost) Backup() ProviderBackupResult {
-	if ad.BackupDir == "" {
-		logger.Printf("backup skipped as backup directory not specified")
+	return ad.BackupWithContext(context.Background())
+}
 
-		return ProviderBackupResult{
-			BackupResults: nil,
-			Error:         errors.New("backup directory not specified"),
-		}
+func (ad *AzureDevOpsHost) getAPIURL() string {
+	if ad.APIURL == "" {
+		return azureDevOpsAPIURL
 	}
 
-	maxConcurrent := 10
+	return ad.APIURL
+}
 
-	repoDesc, err := ad.describeRepos()
-	if err != nil {
-		return ProviderBackupResult{
-			BackupResults: nil,
-			Error:         err,
-		}
+// domain returns the domain repositories are stored under, defaulting to dev.azure.com.
+func (ad *AzureDevOpsHost) domain() string {
+	if ad.Domain == "" {
+		return azureDevOpsDomain
 	}
 
-	jobs := make(chan repository, len(repoDesc.Repos))
-	results := make(chan RepoBackupResults, maxConcurrent)
-
-	for w := 1; w <= maxConcurrent; w++ {
-		go azureDevOpsWorker(ad.LogLevel, ad.BackupDir, ad.DiffRemoteMethod, ad.BackupsToRetain, jobs, results)
-	}
+	return ad.Domain
+}
 
-	for x := range repoDesc.Repos {
-		repo := repoDesc.Repos[x]
-		jobs <- repo
-	}
+// GetAPIURL returns the URL of the Azure DevOps API.
+func (ad *AzureDevOpsHost) GetAPIURL() string {
+	return ad.getAPIURL()
+}
 
-	close(jobs)
+// Name returns the name of the provider.
+func (ad *AzureDevOpsHost) Name() string {
+	return AzureDevOpsProviderName
+}
 
-	var providerBackupResults ProviderBackupResult
+// ListRepositories returns the repositories available to back up.
+func (ad *AzureDevOpsHost) ListRepositories(ctx context.Context) ([]Repository, errors.E) {
+	return listRepositories(ctx, ad, ad.Filter, ad.Observer)
+}
 
-	for a := 1; a <= len(repoDesc.Repos); a++ {
-		res := <-results
-		if res.Error != nil {
-			logger.Printf("backup failed: %+v\n", res.Error)
-		}
+// return normalised method.
+func (ad *AzureDevOpsHost) diffRemoteMethod() string {
+	switch strings.ToLower(ad.DiffRemoteMethod) {
+	case refsMethod:
+		return refsMethod
+	case cloneMethod:
+		return cloneMethod
+	default:
+		logger.Printf("unexpected diff remote method: %s", ad.DiffRemoteMethod)
 
-		providerBackupResults.BackupResults = append(providerBackupResults.BackupResults, res)
+		// default to bundle as safest
+		return cloneMethod
 	}
-
-	return providerBackupResults
 }
 
-func azureDevOpsWorker(logLevel int, backupDIR, diffRemoteMethod string, backupsToKeep int,
-	jobs <-chan repository, results chan<- RepoBackupResults,
-) {
-	for repo := range jobs {
-		err := processBackup(logLevel, repo, backupDIR, backupsToKeep, diffRemoteMethod)
+// BackupWithContext backs up the host's repositories. Cancelling the context stops
+// pending jobs and kills any in-flight git commands, with the results of repositories
+// not backed up marked as cancelled.
+func (ad *AzureDevOpsHost) BackupWithContext(ctx context.Context) ProviderBackupResult {
+	if ad.BackupDir == "" {
+		logger.Printf("backup skipped as backup directory not specified")
 
-		backupResult := RepoBackupResults{
-			Repo: repo.PathWithNameSpace,
+		return ProviderBackupResult{
+			BackupResults: nil,
+			Error:         errors.New("backup directory not specified"),
 		}
+	}
 
-		status := statusOk
-		if err != nil {
-			status = statusFailed
-			backupResult.Error = err
-		}
+	maxConcurrent := workerCount(ad.Concurrency, azureDevOpsDefaultConcurrency)
 
-		backupResult.Status = status
+	repoDesc, err := describeProviderRepos(ctx, ad, ad.Observer)
+	if err != nil {
+		return ProviderBackupResult{
+			BackupResults: nil,
+			Error:         err,
+		}
+	}
 
-		results <- backupResult
+	result := backupRepos(ctx, repoDesc.Repos, maxConcurrent, ad.backupInput(processBackupInput{
+		logLevel:         ad.LogLevel,
+		backupDir:        ad.BackupDir,
+		backupsToKeep:    ad.BackupsToRetain,
+		diffRemoteMethod: ad.diffRemoteMethod(),
+		provider:         ad.Name(),
+	}))
+
+	// report organizations that couldn't be listed alongside the others' results
+	if repoDesc.Err != nil {
+		result.Error = errors.Join(result.Error, repoDesc.Err)
 	}
+
+	return result
 }
 
 func NewAzureDevOpsHost(input NewAzureDevOpsHostInput) (*AzureDevOpsHost, error) {
@@ -110,6 +133,23 @@ func NewAzureDevOpsHost(input NewAzureDevOpsHostInput) (*AzureDevOpsHost, error)
 		return nil, errors.New("personal access token not specified")
 	case len(input.Orgs) == 0:
 		return nil, errors.New("no organizations specified")
+	case input.Server && input.APIURL == "":
+		return nil, errors.New("API URL of Azure DevOps Server not specified")
+	}
+
+	apiURL := azureDevOpsAPIURL
+	if input.APIURL != "" {
+		apiURL = strings.TrimSuffix(input.APIURL, "/")
+	}
+
+	domain := input.Domain
+	if domain == "" {
+		u, uErr := url.Parse(apiURL)
+		if uErr != nil || u.Hostname() == "" {
+			return nil, errors.Errorf("invalid Azure DevOps API URL: %s", apiURL)
+		}
+
+		domain = strings.ToLower(u.Hostname())
 	}
 
 	diffRemoteMethod, err := getDiffRemoteMethod(input.DiffRemoteMethod)
@@ -124,6 +164,14 @@ func NewAzureDevOpsHost(input NewAzureDevOpsHostInput) (*AzureDevOpsHost, error)
 		logger.Printf("%s: %s", sUsingDiffRemoteMethod, diffRemoteMethod)
 	}
 
+	if err = input.validate(input.BackupsToRetain); err != nil {
+		return nil, err
+	}
+
+	if err = input.Projects.Validate(); err != nil {
+		return nil, err
+	}
+
 	httpClient := input.HTTPClient
 	if httpClient == nil {
 		httpClient = getHTTPClient()
@@ -140,46 +188,215 @@ func NewAzureDevOpsHost(input NewAzureDevOpsHostInput) (*AzureDevOpsHost, error)
 		BackupDir:        input.BackupDir,
 		BackupsToRetain:  input.BackupsToRetain,
 		LogLevel:         input.LogLevel,
+		BackupOptions:    input.BackupOptions,
+		OrgConcurrency:   input.OrgConcurrency,
+		APIURL:           apiURL,
+		Server:           input.Server,
+		Domain:           domain,
+		Projects:         input.Projects,
 	}, nil
 }
 
-func (ad *AzureDevOpsHost) describeRepos() (describeReposOutput, errors.E) {
+// describeRepos returns the repositories of the host's organizations, listing up to
+// OrgConcurrency organizations at once. Organizations that fail to be listed don't stop
+// the others, but are reported in the output's error.
+func (ad *AzureDevOpsHost) describeRepos(ctx context.Context) (describeReposOutput, errors.E) {
+	orgs, err := ad.organizations(ctx)
+	if err != nil {
+		return describeReposOutput{}, err
+	}
+
+	orgRepos := make([][]repository, len(orgs))
+	orgErrs := make([]error, len(orgs))
+
+	sem := make(chan struct{}, workerCount(ad.OrgConcurrency, 1))
+
+	var wg sync.WaitGroup
+
+	for x, org := range orgs {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			logger.Printf("listing Azure DevOps organization %s's repositories", org)
+
+			repos, orgErr := ad.describeAzureDevOpsOrgsRepos(ctx, org)
+			if orgErr != nil {
+				logger.Printf("failed to get Azure DevOps organization %s repos", org)
+
+				orgErrs[x] = errors.Wrapf(orgErr, "failed to get Azure DevOps organization %s repos", org)
+
+				return
+			}
+
+			if len(repos) == 0 {
+				logger.Printf("no repos found for organization: %s", org)
+			}
+
+			orgRepos[x] = repos
+		}()
+	}
+
+	wg.Wait()
+
 	var repos []repository
 
-	var org string
+	for _, r := range orgRepos {
+		repos = append(repos, r...)
+	}
 
-	switch len(ad.Orgs) {
-	case 0:
-		return describeReposOutput{}, errors.New("no organizations specified")
-	case 1:
-		org = ad.Orgs[0]
-	default:
-		log.Printf("multiple organizations not currently supported. using first: %s", ad.Orgs[0])
+	out := describeReposOutput{
+		Repos: removeDuplicates(repos),
+	}
+
+	if joined := errors.Join(orgErrs...); joined != nil {
+		// fail if no organization could be listed
+		if !slices.Contains(orgErrs, nil) {
+			return describeReposOutput{}, joined
+		}
+
+		out.Err = joined
+	}
+
+	return out, nil
+}
+
+// organizations returns the host's organizations without duplicates, replacing the
+// wildcard with every organization the PAT can access, or a server's collections.
+func (ad *AzureDevOpsHost) organizations(ctx context.Context) ([]string, errors.E) {
+	if len(ad.Orgs) == 0 {
+		return nil, errors.New("no organizations specified")
+	}
+
+	orgs := ad.Orgs
+
+	if slices.Contains(ad.Orgs, "*") {
+		var (
+			accessible []string
+			err        errors.E
+		)
+
+		if ad.Server {
+			accessible, err = ad.projectCollections(ctx)
+		} else {
+			accessible, err = ad.accessibleOrganizations(ctx)
+		}
 
-		org = ad.Orgs[0]
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get Azure DevOps organizations")
+		}
+
+		orgs = append(remove(slices.Clone(ad.Orgs), "*"), accessible...)
 	}
 
-	// append repos belonging to any orgs specified
-	logger.Printf("listing Azure DevOps organization %s's repositories", org)
+	var unique []string
+
+	seen := make(map[string]bool)
+
+	for _, org := range orgs {
+		// organization names aren't case sensitive
+		key := strings.ToLower(org)
+		if org == "" || seen[key] {
+			continue
+		}
+
+		seen[key] = true
+
+		unique = append(unique, org)
+	}
+
+	return unique, nil
+}
+
+type azureDevOpsProjectCollections struct {
+	Value []struct {
+		Name string `json:"name"`
+	} `json:"value"`
+}
+
+// projectCollections returns the collections of an Azure DevOps Server.
+func (ad *AzureDevOpsHost) projectCollections(ctx context.Context) ([]string, errors.E) {
+	var collections azureDevOpsProjectCollections
+
+	if err := ad.getJSON(ctx, ad.getAPIURL()+"/_apis/projectCollections?api-version=6.0", &collections); err != nil {
+		return nil, errors.Wrap(err, "failed to get project collections")
+	}
+
+	names := make([]string, 0, len(collections.Value))
+	for _, collection := range collections.Value {
+		names = append(names, collection.Name)
+	}
+
+	return names, nil
+}
 
-	orgRepos, err := ad.describeAzureDevOpsOrgsRepos(org)
+type azureDevOpsProfile struct {
+	ID string `json:"id"`
+}
+
+type azureDevOpsAccounts struct {
+	Value []struct {
+		AccountName string `json:"accountName"`
+	} `json:"value"`
+}
+
+// accessibleOrganizations returns the organizations the authenticated user is a member of.
+func (ad *AzureDevOpsHost) accessibleOrganizations(ctx context.Context) ([]string, errors.E) {
+	var profile azureDevOpsProfile
+
+	vsspsURL := ad.vsspsURL
+	if vsspsURL == "" {
+		vsspsURL = azureDevOpsVSSPSURL
+	}
+
+	if err := ad.getJSON(ctx, vsspsURL+"/_apis/profile/profiles/me?api-version=7.1", &profile); err != nil {
+		return nil, errors.Wrap(err, "failed to get profile")
+	}
+
+	var accounts azureDevOpsAccounts
+
+	if err := ad.getJSON(ctx, vsspsURL+"/_apis/accounts?api-version=7.1&memberId="+url.QueryEscape(profile.ID), &accounts); err != nil {
+		return nil, errors.Wrap(err, "failed to get accounts")
+	}
+
+	orgs := make([]string, 0, len(accounts.Value))
+	for _, account := range accounts.Value {
+		orgs = append(orgs, account.AccountName)
+	}
+
+	return orgs, nil
+}
+
+// getJSON decodes the response to an authenticated request for the URL.
+func (ad *AzureDevOpsHost) getJSON(ctx context.Context, reqURL string, v any) errors.E {
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
 	if err != nil {
-		logger.Printf("failed to get Azure DevOps organization %s repos", org)
+		return errors.Wrap(err, "failed to create request")
+	}
 
-		return describeReposOutput{}, errors.Wrapf(err, "failed to get Azure DevOps organization %s repos", org)
+	req.Header.Set("Accept", contentTypeApplicationJSON)
+	req.Header.Set("Authorization", "Basic "+generateBasicAuth(ad.UserName, ad.PAT))
+
+	resp, err := ad.HttpClient.Do(req)
+	if err != nil {
+		return errors.Errorf("request failed: %s", maskSecrets(err.Error(), []string{ad.PAT}))
 	}
 
-	if len(orgRepos) == 0 {
-		logger.Printf("no repos found for organization: %s", org)
+	defer resp.Body.Close()
 
-		return describeReposOutput{}, nil
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected response: %d (%s)", resp.StatusCode, resp.Status)
 	}
 
-	repos = append(repos, orgRepos...)
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.Wrap(err, "failed to decode response")
+	}
 
-	return describeReposOutput{
-		Repos: repos,
-	}, nil
+	return nil
 }
 
 type NewAzureDevOpsHostInput struct {
@@ -192,6 +409,22 @@ type NewAzureDevOpsHostInput struct {
 	Orgs             []string
 	BackupsToRetain  int
 	LogLevel         int
+	BackupOptions
+	// OrgConcurrency is the number of organizations to list repositories from at once, defaulting to 1.
+	// Orgs may contain "*" to back up every organization the PAT can access.
+	OrgConcurrency int
+	// APIURL is the URL the organizations are found under, defaulting to https://dev.azure.com.
+	// For Azure DevOps Server, it's the server's URL, e.g. https://devops.example.com/tfs.
+	APIURL string
+	// Server is set when APIURL is an Azure DevOps Server, with Orgs being its collections,
+	// e.g. DefaultCollection, and "*" selecting every collection.
+	Server bool
+	// Domain is the domain repositories are stored under, defaulting to the host of APIURL.
+	Domain string
+	// Projects selects the projects to back up repositories from, by matching its patterns
+	// against each project's path, e.g. my-org/my-project. Patterns without a slash match
+	// the project name.
+	Projects RepositoryFilter
 }
 
 type AzureDevOpsHost struct {
@@ -205,8 +438,20 @@ type AzureDevOpsHost struct {
 	BackupDir        string
 	BackupsToRetain  int
 	LogLevel         int
+	BackupOptions
+	OrgConcurrency int
+	APIURL         string
+	Server         bool
+	Domain         string
+	Projects       RepositoryFilter
+	// vsspsURL overrides the URL of the profile service, used to find organizations
+	vsspsURL string
 }
 
+// AddBasicAuthToURL returns the URL with the username and password added.
+//
+// Deprecated: credentials are no longer added to clone URLs, so they aren't exposed in
+// process arguments and errors.
 func AddBasicAuthToURL(originalURL, username, password string) (string, error) {
 	parsedURL, err := url.Parse(originalURL)
 	if err != nil {
@@ -218,19 +463,17 @@ func AddBasicAuthToURL(originalURL, username, password string) (string, error) {
 	return parsedURL.String(), nil
 }
 
-func (ad *AzureDevOpsHost) describeAzureDevOpsOrgsRepos(org string) ([]repository, errors.E) {
+func (ad *AzureDevOpsHost) describeAzureDevOpsOrgsRepos(ctx context.Context, org string) ([]repository, errors.E) {
 	if org == "" {
 		return nil, errors.New("organization not specified")
 	}
 
-	organizationUrl := fmt.Sprintf("https://%s/%s", azureDevOpsDomain, org)
+	organizationUrl := ad.getAPIURL() + "/" + org
 
 	basicAuth := generateBasicAuth(ad.UserName, ad.PAT)
 
 	connection := azuredevops.NewPatConnection(organizationUrl, ad.PAT)
 
-	ctx := context.Background()
-
 	coreClient, err := azdevopscore.NewClient(ctx, connection)
 	if err != nil {
 		return nil, errors.Errorf("failed to create Azure DevOps core client: %s", err)
@@ -241,14 +484,25 @@ func (ad *AzureDevOpsHost) describeAzureDevOpsOrgsRepos(org string) ([]repositor
 		return nil, errors.Errorf("failed to list projects: %s", err)
 	}
 
+	projectFilter, fErr := ad.Projects.compile()
+	if fErr != nil {
+		return nil, fErr
+	}
+
 	var allRepos []AzureDevOpsRepo
 
 	for _, project := range projects {
+		if reason := projectFilter.skipReason(org + "/" + *project.Name); reason != "" {
+			logger.Printf("skipping Azure DevOps organization %s's project %s: %s", org, *project.Name, reason)
+
+			continue
+		}
+
 		logger.Printf("listing Azure DevOps organization %s's project %s repositories", org, *project.Name)
 
 		var projectRepos []AzureDevOpsRepo
 
-		projectRepos, err = ListAllRepositories(ad.HttpClient, basicAuth, *project.Name, org)
+		projectRepos, err = listAllRepositories(ctx, ad.HttpClient, ad.getAPIURL(), basicAuth, *project.Name, org)
 		if err != nil {
 			return nil, errors.Errorf("failed to list repositories for organization: %s project: %s - %s", org, *project.Name, err)
 		}
@@ -265,20 +519,21 @@ func (ad *AzureDevOpsHost) describeAzureDevOpsOrgsRepos(org string) ([]repositor
 	var gRepos []repository
 
 	for _, repo := range allRepos {
-		var cloneURL string
-
-		cloneURL, err = AddBasicAuthToURL(repo.WebUrl, ad.UserName, ad.PAT)
-		if err != nil {
-			return nil, errors.Errorf("failed to add basic auth to URL: %s - %s", repo.WebUrl, err)
-		}
-
 		gRepos = append(gRepos, repository{
 			Name:              repo.Name,
 			Owner:             org,
 			PathWithNameSpace: org + "/" + repo.Project.Name + "/" + repo.Name,
-			Domain:            azureDevOpsDomain,
+			Domain:            ad.domain(),
 			HTTPSUrl:          repo.RemoteUrl,
-			URLWithToken:      cloneURL,
+			SSHUrl:            repo.SshUrl,
+			Private:           repo.Project.Visibility == "private",
+			Fork:              repo.IsFork,
+			Size:              repo.Size,
+			DefaultBranch:     strings.TrimPrefix(repo.DefaultBranch, "refs/heads/"),
+			credentials: gitCredentials{
+				username: ad.UserName,
+				password: ad.PAT,
+			},
 		})
 	}
 
@@ -324,6 +579,7 @@ type AzureDevOpsRepo struct {
 	Project       Project `json:"project"`
 	RemoteUrl     string  `json:"remoteUrl"`
 	DefaultBranch string  `json:"defaultBranch"`
+	IsFork        bool    `json:"isFork"`
 }
 
 type Project struct {
@@ -346,8 +602,12 @@ func generateBasicAuth(userName string, pat string) string {
 }
 
 func ListAllRepositories(httpClient *retryablehttp.Client, basicAuth, projectName, orgName string) ([]AzureDevOpsRepo, error) {
-	req, err := retryablehttp.NewRequest(http.MethodGet,
-		fmt.Sprintf("https://%s/%s/%s/_apis/git/repositories", azureDevOpsDomain, orgName, projectName), nil)
+	return listAllRepositories(context.Background(), httpClient, azureDevOpsAPIURL, basicAuth, projectName, orgName)
+}
+
+func listAllRepositories(ctx context.Context, httpClient *retryablehttp.Client, apiURL, basicAuth, projectName, orgName string) ([]AzureDevOpsRepo, error) {
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("%s/%s/%s/_apis/git/repositories", apiURL, url.PathEscape(orgName), url.PathEscape(projectName)), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,10 @@
 package githosts
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -76,7 +80,7 @@ func TestDescribeAzureDevOpsOrgsReposWithInvalidOrg(t *testing.T) {
 		BackupDir:        t.TempDir(),
 	}
 
-	_, err := azureDevOpsHost.describeAzureDevOpsOrgsRepos("")
+	_, err := azureDevOpsHost.describeAzureDevOpsOrgsRepos(context.Background(), "")
 
 	require.Error(t, err)
 }
@@ -161,3 +165,220 @@ func TestAzureDevOpsOrgBackup(t *testing.T) {
 
 	require.Equal(t, 3, matches)
 }
+
+// newTestAzureDevOpsServer stands in for Azure DevOps, serving the projects and repositories
+// of each organization, with the profile service and project collections listing the
+// accessible organizations. Organizations not in orgs can't be accessed.
+func newTestAzureDevOpsServer(t *testing.T, orgs map[string]map[string][]string, accessible ...string) *httptest.Server {
+	t.Helper()
+
+	var server *httptest.Server
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/_apis/profile/profiles/me":
+			_, _ = w.Write([]byte(`{"id": "soba-id"}`))
+
+			return
+		case "/_apis/accounts":
+			require.Equal(t, "soba-id", r.URL.Query().Get("memberId"))
+
+			accounts := make([]map[string]string, 0, len(accessible))
+			for _, org := range accessible {
+				accounts = append(accounts, map[string]string{"accountName": org})
+			}
+
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]any{"count": len(accounts), "value": accounts}))
+
+			return
+		case "/_apis/projectCollections":
+			collections := make([]map[string]string, 0, len(accessible))
+			for _, org := range accessible {
+				collections = append(collections, map[string]string{"name": org})
+			}
+
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]any{"count": len(collections), "value": collections}))
+
+			return
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+
+		// the client lower cases organization URLs
+		var projects map[string][]string
+
+		for org := range orgs {
+			if strings.EqualFold(org, parts[0]) {
+				projects = orgs[org]
+			}
+		}
+
+		if projects == nil || len(parts) < 2 {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodOptions && parts[1] == "_apis":
+			// the API's resource locations, which the client looks up before requests
+			_, _ = w.Write([]byte(`{"count": 2, "value": [
+  {"id": "e81700f7-3be2-46de-8624-2eb35882fcaa", "area": "Location", "resourceName": "ResourceAreas",
+    "routeTemplate": "_apis/{resource}/{areaId}", "resourceVersion": 1, "minVersion": "1.0", "maxVersion": "7.1", "releasedVersion": "0.0"},
+  {"id": "603fe2ac-9723-48b9-88ad-09305aa6c6e1", "area": "core", "resourceName": "projects",
+    "routeTemplate": "_apis/{resource}/{*projectId}", "resourceVersion": 4, "minVersion": "1.0", "maxVersion": "7.1", "releasedVersion": "7.0"}
+]}`))
+		case parts[1] == "_apis/ResourceAreas":
+			// none are returned by servers, so requests are made to the organization's URL
+			_, _ = w.Write([]byte(`{"count": 0, "value": []}`))
+		case parts[1] == "_apis/projects":
+			values := make([]map[string]string, 0, len(projects))
+			for project := range projects {
+				values = append(values, map[string]string{"name": project})
+			}
+
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]any{"count": len(values), "value": values}))
+		case strings.HasSuffix(parts[1], "/_apis/git/repositories"):
+			project := strings.TrimSuffix(parts[1], "/_apis/git/repositories")
+
+			values := make([]map[string]any, 0, len(projects[project]))
+			for _, repo := range projects[project] {
+				values = append(values, map[string]any{
+					"name":      repo,
+					"remoteUrl": server.URL + "/" + parts[0] + "/" + project + "/_git/" + repo,
+					"project":   map[string]string{"name": project},
+				})
+			}
+
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]any{"count": len(values), "value": values}))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestDescribeAzureDevOpsMultipleOrgs(t *testing.T) {
+	t.Parallel()
+
+	server := newTestAzureDevOpsServer(t, map[string]map[string][]string{
+		"soba": {"noodles": {"one", "two"}},
+		"udon": {"noodles": {"three"}, "broth": {"four"}},
+	}, "soba", "udon", "ramen")
+
+	ad, err := NewAzureDevOpsHost(NewAzureDevOpsHostInput{
+		BackupDir:      t.TempDir(),
+		UserName:       "soba",
+		PAT:            "testpat",
+		Orgs:           []string{"SOBA", "*"},
+		OrgConcurrency: 2,
+	})
+	require.NoError(t, err)
+
+	// organizations of a stand-in for Azure DevOps Services are found using the profile
+	// service, rather than as collections
+	ad.vsspsURL = server.URL
+	ad.APIURL = server.URL
+
+	orgs, orgsErr := ad.organizations(context.Background())
+	require.NoError(t, orgsErr)
+	require.Equal(t, []string{"SOBA", "udon", "ramen"}, orgs)
+
+	// the other organizations are listed when one can't be
+	ad.Orgs = []string{"soba", "*"}
+
+	desc, descErr := ad.describeRepos(context.Background())
+	require.NoError(t, descErr)
+	require.ErrorContains(t, desc.Err, "failed to get Azure DevOps organization ramen repos")
+
+	var paths []string
+	for _, repo := range desc.Repos {
+		paths = append(paths, repo.PathWithNameSpace)
+	}
+
+	require.ElementsMatch(t, []string{"soba/noodles/one", "soba/noodles/two", "udon/noodles/three", "udon/broth/four"}, paths)
+
+	// the listing is incomplete
+	_, descErr = ad.ListRepositories(context.Background())
+	require.ErrorContains(t, descErr, "ramen")
+
+	// it fails if no organization can be listed
+	ad.Orgs = []string{"ramen", "miso"}
+
+	_, descErr = ad.describeRepos(context.Background())
+	require.ErrorContains(t, descErr, "ramen")
+	require.ErrorContains(t, descErr, "miso")
+}
+
+func TestAzureDevOpsServer(t *testing.T) {
+	t.Parallel()
+
+	server := newTestAzureDevOpsServer(t, map[string]map[string][]string{
+		"DefaultCollection": {"noodles": {"one"}, "Bowl Noodles": {"two"}, "archive": {"three"}},
+		"OtherCollection":   {"noodles": {"four"}},
+	}, "DefaultCollection", "OtherCollection")
+
+	ad, err := NewAzureDevOpsHost(NewAzureDevOpsHostInput{
+		APIURL:    server.URL + "/",
+		Server:    true,
+		BackupDir: t.TempDir(),
+		UserName:  "soba",
+		PAT:       "testpat",
+		Orgs:      []string{"*"},
+		Projects: RepositoryFilter{
+			Include: []string{"*noodles*", "re:(?i)^defaultcollection/"},
+			Exclude: []string{"OtherCollection/*"},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, server.URL, ad.GetAPIURL())
+	require.Equal(t, "127.0.0.1", ad.Domain)
+
+	repos, listErr := ad.ListRepositories(context.Background())
+	require.NoError(t, listErr)
+
+	var paths []string
+
+	for _, repo := range repos {
+		require.Equal(t, "127.0.0.1", repo.Domain)
+
+		paths = append(paths, repo.PathWithNameSpace)
+	}
+
+	require.ElementsMatch(t, []string{
+		"DefaultCollection/noodles/one",
+		"DefaultCollection/Bowl Noodles/two",
+		"DefaultCollection/archive/three",
+	}, paths)
+
+	// projects are filtered before their repositories are listed
+	ad.Projects = RepositoryFilter{Exclude: []string{"archive", "Bowl*"}}
+	ad.Orgs = []string{"DefaultCollection"}
+
+	repos, listErr = ad.ListRepositories(context.Background())
+	require.NoError(t, listErr)
+	require.Len(t, repos, 1)
+	require.Equal(t, "DefaultCollection/noodles/one", repos[0].PathWithNameSpace)
+
+	_, err = NewAzureDevOpsHost(NewAzureDevOpsHostInput{
+		APIURL:    "devops.example.com/tfs",
+		BackupDir: t.TempDir(),
+		UserName:  "soba",
+		PAT:       "testpat",
+		Orgs:      []string{"DefaultCollection"},
+	})
+	require.ErrorContains(t, err, "invalid Azure DevOps API URL")
+
+	_, err = NewAzureDevOpsHost(NewAzureDevOpsHostInput{
+		Server:    true,
+		BackupDir: t.TempDir(),
+		UserName:  "soba",
+		PAT:       "testpat",
+		Orgs:      []string{"DefaultCollection"},
+	})
+	require.ErrorContains(t, err, "API URL of Azure DevOps Server not specified")
+}
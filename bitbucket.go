@@ -4,10 +4,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"net/url"
+	"slices"
 	"strings"
 
 	"gitlab.com/tozd/go/errors"
@@ -21,6 +21,15 @@ const (
 	bitbucketEnvVarSecret = "BITBUCKET_SECRET"
 	bitbucketEnvVarUser   = "BITBUCKET_USER"
 	bitbucketDomain       = "bitbucket.com"
+	bitbucketOAuthURL     = "https://bitbucket.org/site/oauth2/access_token"
+	// bitbucketAPITokenGitUser is the git username used with API tokens, as the account's
+	// email address can't be used.
+	bitbucketAPITokenGitUser = "x-bitbucket-api-token-auth"
+
+	// ways of authenticating with Bitbucket Cloud
+	BitbucketAuthOAuth       = "oauth"
+	BitbucketAuthAppPassword = "app_password"
+	BitbucketAuthAPIToken    = "api_token"
 )
 
 type NewBitBucketHostInput struct {
@@ -29,11 +38,24 @@ type NewBitBucketHostInput struct {
 	APIURL           string
 	DiffRemoteMethod string
 	BackupDir        string
-	User             string
-	Key              string
-	Secret           string
-	BackupsToRetain  int
-	LogLevel         int
+	// AuthType is how to authenticate: BitbucketAuthOAuth, the default, with an OAuth consumer's
+	// Key and Secret; BitbucketAuthAppPassword with User and an app password as Secret; or
+	// BitbucketAuthAPIToken with the account's email address as User and an API token as Secret.
+	AuthType        string
+	User            string
+	Key             string
+	Secret          string
+	BackupsToRetain int
+	LogLevel        int
+	BackupOptions
+	// Workspaces are the workspaces to back up, by slug, with "*" selecting every workspace
+	// the user has access to. All repositories the user is a member of are backed up if none
+	// are given.
+	Workspaces []string
+	// Projects selects the projects to back up repositories from, by matching its patterns
+	// against each project's path, e.g. my-workspace/PROJ. Patterns without a slash match
+	// the project key.
+	Projects RepositoryFilter
 }
 
 func NewBitBucketHost(input NewBitBucketHostInput) (*BitbucketHost, error) {
@@ -56,6 +78,23 @@ func NewBitBucketHost(input NewBitBucketHostInput) (*BitbucketHost, error) {
 		logger.Print("using diff remote method: " + diffRemoteMethod)
 	}
 
+	authType := input.AuthType
+	if authType == "" {
+		authType = BitbucketAuthOAuth
+	}
+
+	if !slices.Contains([]string{BitbucketAuthOAuth, BitbucketAuthAppPassword, BitbucketAuthAPIToken}, authType) {
+		return nil, errors.Errorf("unexpected Bitbucket auth type: %s", authType)
+	}
+
+	if err = input.validate(input.BackupsToRetain); err != nil {
+		return nil, err
+	}
+
+	if err = input.Projects.Validate(); err != nil {
+		return nil, err
+	}
+
 	httpClient := input.HTTPClient
 	if httpClient == nil {
 		httpClient = getHTTPClient()
@@ -68,16 +107,90 @@ func NewBitBucketHost(input NewBitBucketHostInput) (*BitbucketHost, error) {
 		DiffRemoteMethod: diffRemoteMethod,
 		BackupDir:        input.BackupDir,
 		BackupsToRetain:  input.BackupsToRetain,
+		AuthType:         authType,
 		User:             input.User,
 		Key:              input.Key,
 		Secret:           input.Secret,
+		BackupOptions:    input.BackupOptions,
+		Workspaces:       input.Workspaces,
+		Projects:         input.Projects,
+		oauthURL:         bitbucketOAuthURL,
 	}, nil
 }
 
-func (bb BitbucketHost) auth(key, secret string) (string, error) {
-	b, _, _, err := httpRequest(httpRequestInput{
+// validateCredentials checks the credentials needed by the host's auth type are set.
+func (bb BitbucketHost) validateCredentials() errors.E {
+	switch bb.AuthType {
+	case BitbucketAuthOAuth:
+		if bb.Key == "" || bb.Secret == "" {
+			return errors.New("Bitbucket OAuth consumer key and secret required")
+		}
+	case BitbucketAuthAppPassword:
+		if bb.User == "" || bb.Secret == "" {
+			return errors.New("Bitbucket user and app password required")
+		}
+	case BitbucketAuthAPIToken:
+		if bb.User == "" || bb.Secret == "" {
+			return errors.New("Bitbucket email address and API token required")
+		}
+	default:
+		return errors.Errorf("unexpected Bitbucket auth type: %s", bb.AuthType)
+	}
+
+	return nil
+}
+
+// bitbucketCredentials authenticate API requests and git.
+type bitbucketCredentials struct {
+	// authorization is the Authorization header of API requests
+	authorization string
+	git           gitCredentials
+}
+
+// credentials returns the credentials for the host's auth type, exchanging OAuth
+// consumer credentials for an access token.
+func (bb BitbucketHost) credentials(ctx context.Context) (bitbucketCredentials, errors.E) {
+	if bb.resolved != nil {
+		return *bb.resolved, nil
+	}
+
+	if err := bb.validateCredentials(); err != nil {
+		return bitbucketCredentials{}, err
+	}
+
+	switch bb.AuthType {
+	case BitbucketAuthAppPassword:
+		return bitbucketCredentials{
+			authorization: "Basic " + generateBasicAuth(bb.User, bb.Secret),
+			git:           gitCredentials{username: bb.User, password: bb.Secret},
+		}, nil
+	case BitbucketAuthAPIToken:
+		return bitbucketCredentials{
+			authorization: "Basic " + generateBasicAuth(bb.User, bb.Secret),
+			git:           gitCredentials{username: bitbucketAPITokenGitUser, password: bb.Secret},
+		}, nil
+	default:
+		token, err := bb.auth(ctx, bb.Key, bb.Secret)
+		if err != nil {
+			return bitbucketCredentials{}, errors.Errorf("failed to get bitbucket auth token: %s", err)
+		}
+
+		return bitbucketCredentials{
+			authorization: "Bearer " + token,
+			git:           gitCredentials{username: bb.User, password: token},
+		}, nil
+	}
+}
+
+func (bb BitbucketHost) auth(ctx context.Context, key, secret string) (string, error) {
+	oauthURL := bb.oauthURL
+	if oauthURL == "" {
+		oauthURL = bitbucketOAuthURL
+	}
+
+	b, _, _, err := httpRequest(ctx, httpRequestInput{
 		client: bb.HttpClient,
-		url:    fmt.Sprintf("https://%s:%s@bitbucket.org/site/oauth2/access_token", key, secret),
+		url:    oauthURL,
 		method: http.MethodPost,
 		headers: http.Header{
 			"Host":         []string{"bitbucket.org"},
@@ -129,173 +242,240 @@ type bitbucketAuthErrorResponse struct {
 	ErrorDescription string `json:"error_description"`
 }
 
-func (bb BitbucketHost) describeRepos() (describeReposOutput, errors.E) {
+func (bb BitbucketHost) describeRepos(ctx context.Context) (describeReposOutput, errors.E) {
 	logger.Println("listing BitBucket repositories")
 
-	var err error
+	creds, err := bb.credentials(ctx)
+	if err != nil {
+		return describeReposOutput{}, err
+	}
 
-	key := os.Getenv(bitbucketEnvVarKey)
-	secret := os.Getenv(bitbucketEnvVarSecret)
+	reqURLs := []string{bb.APIURL + "/repositories?role=member"}
 
-	var token string
+	if len(bb.Workspaces) > 0 {
+		workspaces, wErr := bb.workspaces(ctx, creds)
+		if wErr != nil {
+			return describeReposOutput{}, wErr
+		}
+
+		reqURLs = nil
 
-	token, err = bb.auth(key, secret)
+		for _, workspace := range workspaces {
+			reqURLs = append(reqURLs, bb.APIURL+"/repositories/"+url.PathEscape(workspace))
+		}
+	}
+
+	projectFilter, err := bb.Projects.compile()
 	if err != nil {
-		return describeReposOutput{}, errors.Wrap(err, "failed to get bitbucket auth token")
+		return describeReposOutput{}, err
 	}
 
 	var repos []repository
 
-	rawRequestURL := bb.APIURL + "/repositories?role=member"
+	for _, reqURL := range reqURLs {
+		if pErr := bb.getPages(ctx, creds, reqURL, func(body []byte) errors.E {
+			var respObj bitbucketGetProjectsResponse
+			if uErr := json.Unmarshal(body, &respObj); uErr != nil {
+				return errors.Wrap(uErr, "failed to unmarshall bitbucket json response")
+			}
 
-	ctx, cancel := context.WithTimeout(context.Background(), defaultHttpRequestTimeout)
-	defer cancel()
+			for _, r := range respObj.Values {
+				if r.Scm != "git" {
+					continue
+				}
 
-	for {
-		req, errNewReq := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, rawRequestURL, nil)
-		if errNewReq != nil {
-			logger.Println(errNewReq)
+				if reason := projectFilter.skipReason(r.projectPath()); reason != "" {
+					logger.Printf("skipping Bitbucket repository %s in project %s: %s", r.FullName, r.projectPath(), reason)
 
-			return describeReposOutput{}, errors.Wrap(errNewReq, "failed to create new request")
+					continue
+				}
+
+				repos = append(repos, repository{
+					Name:              r.Name,
+					HTTPSUrl:          "https://bitbucket.org/" + r.FullName + ".git",
+					SSHUrl:            r.Links.cloneURL("ssh"),
+					PathWithNameSpace: r.FullName,
+					Domain:            bitbucketDomain,
+					Private:           r.IsPrivate,
+					Fork:              r.Parent != nil,
+					Size:              r.Size,
+					DefaultBranch:     r.MainBranch.Name,
+				})
+			}
+
+			return nil
+		}); pErr != nil {
+			return describeReposOutput{}, pErr
 		}
+	}
 
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-		req.Header.Set("Content-Type", contentTypeApplicationJSON)
-		req.Header.Set("Accept", contentTypeApplicationJSON)
+	return describeReposOutput{
+		Repos: removeDuplicates(repos),
+	}, nil
+}
 
-		var resp *http.Response
+// workspaces returns the slugs of the host's workspaces, expanding "*" to every
+// workspace the user has access to.
+func (bb BitbucketHost) workspaces(ctx context.Context, creds bitbucketCredentials) ([]string, errors.E) {
+	if !slices.Contains(bb.Workspaces, "*") {
+		return bb.Workspaces, nil
+	}
 
-		resp, err = bb.HttpClient.Do(req)
-		if err != nil {
-			logger.Println(err)
+	workspaces := remove(slices.Clone(bb.Workspaces), "*")
 
-			return describeReposOutput{}, errors.Wrap(err, "failed to make request")
+	if err := bb.getPages(ctx, creds, bb.APIURL+"/user/permissions/workspaces", func(body []byte) errors.E {
+		var respObj bitbucketGetWorkspacePermissionsResponse
+		if uErr := json.Unmarshal(body, &respObj); uErr != nil {
+			return errors.Wrap(uErr, "failed to unmarshall bitbucket json response")
 		}
 
-		var bodyB []byte
-
-		bodyB, err = io.ReadAll(resp.Body)
-		if err != nil {
-			return describeReposOutput{}, errors.Errorf("failed to read response body: %s", err)
+		for _, v := range respObj.Values {
+			if !slices.Contains(workspaces, v.Workspace.Slug) {
+				workspaces = append(workspaces, v.Workspace.Slug)
+			}
 		}
 
-		bodyStr := string(bytes.ReplaceAll(bodyB, []byte("\r"), []byte("\r\n")))
+		return nil
+	}); err != nil {
+		return nil, errors.Errorf("failed to list workspaces: %s", err)
+	}
 
-		_ = resp.Body.Close()
+	return workspaces, nil
+}
 
-		var respObj bitbucketGetProjectsResponse
-		if err = json.Unmarshal([]byte(bodyStr), &respObj); err != nil {
-			logger.Println(err)
+// getPages requests reqURL and each following page, passing each page's body to fn.
+func (bb BitbucketHost) getPages(ctx context.Context, creds bitbucketCredentials, reqURL string, fn func(body []byte) errors.E) errors.E {
+	for reqURL != "" {
+		body, err := bb.get(ctx, creds, reqURL)
+		if err != nil {
+			return err
+		}
 
-			return describeReposOutput{}, errors.Wrap(err, "failed to unmarshall bitbucket json response")
+		if fErr := fn(body); fErr != nil {
+			return fErr
 		}
 
-		for _, r := range respObj.Values {
-			if r.Scm == "git" {
-				repo := repository{
-					Name:              r.Name,
-					HTTPSUrl:          "https://bitbucket.org/" + r.FullName + ".git",
-					PathWithNameSpace: r.FullName,
-					Domain:            bitbucketDomain,
-				}
+		var page struct {
+			Next string `json:"next"`
+		}
 
-				repos = append(repos, repo)
-			}
+		if uErr := json.Unmarshal(body, &page); uErr != nil {
+			return errors.Wrap(uErr, "failed to unmarshall bitbucket json response")
 		}
 
-		if respObj.Next != "" {
-			rawRequestURL = respObj.Next
+		reqURL = page.Next
+	}
 
-			continue
-		}
+	return nil
+}
+
+func (bb BitbucketHost) get(ctx context.Context, creds bitbucketCredentials, reqURL string) ([]byte, errors.E) {
+	ctx, cancel := context.WithTimeout(ctx, defaultHttpRequestTimeout)
+	defer cancel()
 
-		break
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new request")
 	}
 
-	return describeReposOutput{
-		Repos: repos,
-	}, nil
+	req.Header.Set("Authorization", creds.authorization)
+	req.Header.Set("Content-Type", contentTypeApplicationJSON)
+	req.Header.Set("Accept", contentTypeApplicationJSON)
+
+	resp, err := bb.HttpClient.Do(req)
+	if err != nil {
+		logger.Println(err)
+
+		return nil, errors.Wrap(err, "failed to make request")
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Errorf("failed to read response body: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to get %s: %s", reqURL, resp.Status)
+	}
+
+	return bytes.ReplaceAll(body, []byte("\r"), []byte("\r\n")), nil
 }
 
 func (bb BitbucketHost) getAPIURL() string {
 	return bb.APIURL
 }
 
-func bitBucketWorker(logLevel int, user, token, backupDIR, diffRemoteMethod string, backupsToKeep int, jobs <-chan repository, results chan<- RepoBackupResults) {
-	for repo := range jobs {
-		parts := strings.Split(repo.HTTPSUrl, "//")
-		repo.URLWithBasicAuth = parts[0] + "//" + user + ":" + token + "@" + parts[1]
-		err := processBackup(logLevel, repo, backupDIR, backupsToKeep, diffRemoteMethod)
-
-		backupResult := RepoBackupResults{
-			Repo: repo.PathWithNameSpace,
-		}
-
-		status := statusOk
-		if err != nil {
-			status = statusFailed
-			backupResult.Error = err
-		}
+// GetAPIURL returns the URL of the Bitbucket API.
+func (bb BitbucketHost) GetAPIURL() string {
+	return bb.getAPIURL()
+}
 
-		backupResult.Status = status
+// Name returns the name of the provider.
+func (bb BitbucketHost) Name() string {
+	return BitbucketProviderName
+}
 
-		results <- backupResult
-	}
+// ListRepositories returns the repositories available to back up.
+func (bb BitbucketHost) ListRepositories(ctx context.Context) ([]Repository, errors.E) {
+	return listRepositories(ctx, bb, bb.Filter, bb.Observer)
 }
 
 func (bb BitbucketHost) Backup() ProviderBackupResult {
+	return bb.BackupWithContext(context.Background())
+}
+
+// BackupWithContext backs up the host's repositories. Cancelling the context stops
+// pending jobs and kills any in-flight git commands, with the results of repositories
+// not backed up marked as cancelled.
+func (bb BitbucketHost) BackupWithContext(ctx context.Context) ProviderBackupResult {
 	if bb.BackupDir == "" {
 		logger.Printf("backup skipped as backup directory not specified")
 
 		return ProviderBackupResult{}
 	}
 
-	maxConcurrent := 5
+	maxConcurrent := workerCount(bb.Concurrency, bitbucketDefaultConcurrency)
 
-	var err error
-
-	var token string
-
-	token, err = bb.auth(bb.Key, bb.Secret)
+	creds, err := bb.credentials(ctx)
 	if err != nil {
 		return ProviderBackupResult{
-			Error: errors.Errorf("failed to get bitbucket auth token: %s", err),
+			Error: err,
 		}
 	}
 
-	drO, err := bb.describeRepos()
-	if err != nil {
-		return ProviderBackupResult{}
-	}
-
-	jobs := make(chan repository, len(drO.Repos))
+	// list the repositories with the same credentials, so OAuth tokens are only requested once
+	bb.resolved = &creds
 
-	results := make(chan RepoBackupResults, maxConcurrent)
-
-	for w := 1; w <= maxConcurrent; w++ {
-		go bitBucketWorker(bb.LogLevel, bb.User, token, bb.BackupDir, bb.diffRemoteMethod(), bb.BackupsToRetain, jobs, results)
+	drO, descErr := describeProviderRepos(ctx, bb, bb.Observer)
+	if descErr != nil {
+		return ProviderBackupResult{
+			Error: descErr,
+		}
 	}
 
 	for x := range drO.Repos {
-		repo := drO.Repos[x]
-		jobs <- repo
+		drO.Repos[x].credentials = creds.git
 	}
 
-	close(jobs)
-
-	var providerBackupResults ProviderBackupResult
-
-	for a := 1; a <= len(drO.Repos); a++ {
-		res := <-results
-		if res.Error != nil {
-			logger.Printf("backup failed: %+v\n", res.Error)
-
-			providerBackupResults.Error = res.Error
-
-			return providerBackupResults
+	providerBackupResults := backupRepos(ctx, drO.Repos, maxConcurrent, bb.backupInput(processBackupInput{
+		logLevel:         bb.LogLevel,
+		backupDir:        bb.BackupDir,
+		backupsToKeep:    bb.BackupsToRetain,
+		diffRemoteMethod: bb.diffRemoteMethod(),
+		provider:         bb.Name(),
+	}))
+
+	// report the first failure as the provider error
+	if providerBackupResults.Error == nil {
+		for _, res := range providerBackupResults.BackupResults {
+			if res.Status == StatusFailed {
+				providerBackupResults.Error = res.Error
+
+				break
+			}
 		}
-
-		providerBackupResults.BackupResults = append(providerBackupResults.BackupResults, res)
 	}
 
 	return providerBackupResults
@@ -309,10 +489,18 @@ type BitbucketHost struct {
 	DiffRemoteMethod string
 	BackupDir        string
 	BackupsToRetain  int
+	AuthType         string
 	User             string
 	Key              string
 	Secret           string
 	LogLevel         int
+	BackupOptions
+	Workspaces []string
+	Projects   RepositoryFilter
+
+	oauthURL string
+	// resolved are the credentials of a backup, so they're only resolved once
+	resolved *bitbucketCredentials
 }
 
 type bitbucketOwner struct {
@@ -320,12 +508,43 @@ type bitbucketOwner struct {
 }
 
 type bitbucketProject struct {
-	Scm       string `json:"scm"`
-	Owner     bitbucketOwner
-	Name      string            `json:"name"`
-	FullName  string            `json:"full_name"`
-	IsPrivate bool              `json:"is_private"`
-	Links     bitbucketRepoLink `json:"links"`
+	Scm        string `json:"scm"`
+	Owner      bitbucketOwner
+	Name       string            `json:"name"`
+	FullName   string            `json:"full_name"`
+	IsPrivate  bool              `json:"is_private"`
+	Size       int64             `json:"size"`
+	Links      bitbucketRepoLink `json:"links"`
+	MainBranch struct {
+		Name string `json:"name"`
+	} `json:"mainbranch"`
+	// Parent is only set for forks
+	Parent *struct {
+		FullName string `json:"full_name"`
+	} `json:"parent"`
+	Project *struct {
+		Key string `json:"key"`
+	} `json:"project"`
+}
+
+// projectPath returns the path of the repository's project, e.g. my-workspace/PROJ.
+func (p bitbucketProject) projectPath() string {
+	workspace, _, _ := strings.Cut(p.FullName, "/")
+
+	if p.Project == nil {
+		return workspace + "/"
+	}
+
+	return workspace + "/" + p.Project.Key
+}
+
+type bitbucketGetWorkspacePermissionsResponse struct {
+	Values []struct {
+		Workspace struct {
+			Slug string `json:"slug"`
+		} `json:"workspace"`
+	} `json:"values"`
+	Next string `json:"next"`
 }
 
 type bitbucketCloneDetail struct {
@@ -337,6 +556,17 @@ type bitbucketRepoLink struct {
 	Clone []bitbucketCloneDetail `json:"clone"`
 }
 
+// cloneURL returns the clone URL with the given name, e.g. https or ssh.
+func (l bitbucketRepoLink) cloneURL(name string) string {
+	for _, c := range l.Clone {
+		if c.Name == name {
+			return c.Href
+		}
+	}
+
+	return ""
+}
+
 type bitbucketGetProjectsResponse struct {
 	Pagelen int                `json:"pagelen"`
 	Values  []bitbucketProject `json:"values"`
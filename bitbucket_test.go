@@ -1,10 +1,15 @@
 package githosts
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -145,3 +150,211 @@ func TestPublicBitbucketRepositoryCloneCompare(t *testing.T) {
 
 	require.Equal(t, 2, matches)
 }
+
+func TestBitbucketProjectCloneURL(t *testing.T) {
+	t.Parallel()
+
+	var project bitbucketProject
+
+	require.NoError(t, json.Unmarshal([]byte(`{
+  "scm": "git",
+  "full_name": "go-soba/repo0",
+  "is_private": true,
+  "size": 4096,
+  "mainbranch": {"name": "master"},
+  "parent": {"full_name": "other/repo0"},
+  "links": {"clone": [
+    {"name": "https", "href": "https://bitbucket.org/go-soba/repo0.git"},
+    {"name": "ssh", "href": "git@bitbucket.org:go-soba/repo0.git"}
+  ]}
+}`), &project))
+
+	require.Equal(t, "git@bitbucket.org:go-soba/repo0.git", project.Links.cloneURL("ssh"))
+	require.Empty(t, project.Links.cloneURL("unknown"))
+	require.NotNil(t, project.Parent)
+	require.Equal(t, "master", project.MainBranch.Name)
+	require.EqualValues(t, 4096, project.Size)
+}
+
+func TestBitbucketCredentialsRequired(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewBitBucketHost(NewBitBucketHostInput{AuthType: "password", User: "soba", Secret: "secret"})
+	require.Error(t, err)
+
+	for _, input := range []NewBitBucketHostInput{
+		{Key: "key"},
+		{AuthType: BitbucketAuthAppPassword, Secret: "app-password"},
+		{AuthType: BitbucketAuthAPIToken, User: "soba@example.com"},
+	} {
+		bb, hostErr := NewBitBucketHost(input)
+		require.NoError(t, hostErr)
+
+		_, listErr := bb.ListRepositories(context.Background())
+		require.ErrorContains(t, listErr, "required")
+	}
+
+	bb, err := NewBitBucketHost(NewBitBucketHostInput{Key: "key", Secret: "secret"})
+	require.NoError(t, err)
+	require.Equal(t, BitbucketAuthOAuth, bb.AuthType)
+	require.NoError(t, bb.validateCredentials())
+}
+
+func bitbucketTestRepo(fullName, projectKey string) string {
+	return `{"scm": "git", "name": "` + strings.Split(fullName, "/")[1] + `", "full_name": "` + fullName +
+		`", "project": {"key": "` + projectKey + `"}}`
+}
+
+// newTestBitbucketServer stands in for the Bitbucket API, serving fixed responses by path,
+// with a query, to requests with the authorization header.
+func newTestBitbucketServer(t *testing.T, authorization string, responses map[string]string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != authorization {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		body, ok := responses[r.URL.RequestURI()]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestBitbucketDescribeReposInWorkspaces(t *testing.T) {
+	t.Parallel()
+
+	responses := map[string]string{
+		"/user/permissions/workspaces": `{"values": [{"workspace": {"slug": "noodles"}}, {"workspace": {"slug": "ramen"}}]}`,
+		"/repositories/noodles?page=2": `{"values": [` + bitbucketTestRepo("noodles/toppings", "KITCHEN") + `]}`,
+		"/repositories/ramen":          `{"values": [` + bitbucketTestRepo("ramen/bowl", "KITCHEN") + `]}`,
+	}
+
+	server := newTestBitbucketServer(t, "Basic "+generateBasicAuth("soba@example.com", "api-token"), responses)
+
+	// the first page links to the next
+	responses["/repositories/noodles"] = `{"values": [` + bitbucketTestRepo("noodles/broth", "KITCHEN") + `,` +
+		bitbucketTestRepo("noodles/menu", "FRONT") + `], "next": "` + server.URL + `/repositories/noodles?page=2"}`
+
+	bb, err := NewBitBucketHost(NewBitBucketHostInput{
+		APIURL:     server.URL,
+		AuthType:   BitbucketAuthAPIToken,
+		User:       "soba@example.com",
+		Secret:     "api-token",
+		Workspaces: []string{"*"},
+		Projects:   RepositoryFilter{Include: []string{"KITCHEN"}, Exclude: []string{"ramen/*"}},
+	})
+	require.NoError(t, err)
+
+	repos, listErr := bb.ListRepositories(context.Background())
+	require.NoError(t, listErr)
+
+	var paths []string
+	for _, repo := range repos {
+		paths = append(paths, repo.PathWithNameSpace)
+	}
+
+	require.Equal(t, []string{"noodles/broth", "noodles/toppings"}, paths)
+
+	creds, credsErr := bb.credentials(context.Background())
+	require.NoError(t, credsErr)
+	require.Equal(t, gitCredentials{username: bitbucketAPITokenGitUser, password: "api-token"}, creds.git)
+}
+
+func TestBitbucketHostsWithDifferentCredentials(t *testing.T) {
+	t.Parallel()
+
+	// exchanges each consumer's credentials for its own access token
+	oauth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, secret, _ := r.BasicAuth()
+		if secret != "secret-"+key {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error": "unauthorized_client", "error_description": "Invalid OAuth client credentials"}`))
+
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"access_token": "token-` + key + `"}`))
+	}))
+	t.Cleanup(oauth.Close)
+
+	for _, key := range []string{"one", "two"} {
+		server := newTestBitbucketServer(t, "Bearer token-"+key, map[string]string{
+			"/repositories?role=member": `{"values": [` + bitbucketTestRepo(key+"/repo", "PROJ") + `]}`,
+		})
+
+		bb, err := NewBitBucketHost(NewBitBucketHostInput{
+			APIURL: server.URL,
+			User:   "soba",
+			Key:    key,
+			Secret: "secret-" + key,
+		})
+		require.NoError(t, err)
+
+		bb.oauthURL = oauth.URL
+
+		repos, listErr := bb.ListRepositories(context.Background())
+		require.NoError(t, listErr)
+		require.Len(t, repos, 1)
+		require.Equal(t, key+"/repo", repos[0].PathWithNameSpace)
+	}
+
+	// app passwords are used as they are
+	server := newTestBitbucketServer(t, "Basic "+generateBasicAuth("soba", "app-password"), map[string]string{
+		"/repositories?role=member": `{"values": [` + bitbucketTestRepo("soba/repo", "PROJ") + `]}`,
+	})
+
+	bb, err := NewBitBucketHost(NewBitBucketHostInput{
+		APIURL:   server.URL,
+		AuthType: BitbucketAuthAppPassword,
+		User:     "soba",
+		Secret:   "app-password",
+	})
+	require.NoError(t, err)
+
+	repos, listErr := bb.ListRepositories(context.Background())
+	require.NoError(t, listErr)
+	require.Len(t, repos, 1)
+}
+
+func TestBitbucketBackupResolvesCredentialsOnce(t *testing.T) {
+	t.Parallel()
+
+	var tokenRequests atomic.Int32
+
+	oauth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		tokenRequests.Add(1)
+
+		_, _ = w.Write([]byte(`{"access_token": "token"}`))
+	}))
+	t.Cleanup(oauth.Close)
+
+	server := newTestBitbucketServer(t, "Bearer token", map[string]string{
+		"/repositories?role=member": `{"values": []}`,
+	})
+
+	bb, err := NewBitBucketHost(NewBitBucketHostInput{
+		APIURL:    server.URL,
+		BackupDir: t.TempDir(),
+		User:      "soba",
+		Key:       "key",
+		Secret:    "secret",
+	})
+	require.NoError(t, err)
+
+	bb.oauthURL = oauth.URL
+
+	res := bb.BackupWithContext(context.Background())
+	require.NoError(t, res.Error)
+	require.EqualValues(t, 1, tokenRequests.Load())
+}
@@ -1,12 +1,13 @@
 package githosts
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"reflect"
 	"sort"
@@ -14,6 +15,7 @@ import (
 	"strings"
 	"time"
 
+	"filippo.io/age"
 	"gitlab.com/tozd/go/errors"
 )
 
@@ -26,8 +28,9 @@ const (
 	minBundleFileNameTokens  = 3
 )
 
-func getLatestBundlePath(backupPath string) (string, error) {
-	bFiles, err := getBundleFiles(backupPath)
+// getLatestBundlePath returns the key of the latest bundle in the backupPath directory of the storage.
+func getLatestBundlePath(ctx context.Context, store Storage, backupPath string) (string, error) {
+	bFiles, err := getBundleFiles(ctx, store, backupPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to get bundle files: %w", err)
 	}
@@ -41,8 +44,8 @@ func getLatestBundlePath(backupPath string) (string, error) {
 
 	for _, f := range bFiles {
 		var ts int
-		if ts, err = getTimeStampPartFromFileName(f.info.Name()); err == nil {
-			fNameTimes[f.info.Name()] = ts
+		if ts, err = getTimeStampPartFromFileName(f.name); err == nil {
+			fNameTimes[f.name] = ts
 
 			continue
 		}
@@ -64,7 +67,7 @@ func getLatestBundlePath(backupPath string) (string, error) {
 		return ss[i].Value > ss[j].Value
 	})
 
-	return filepath.Join(backupPath, ss[0].Key), nil
+	return path.Join(backupPath, ss[0].Key), nil
 }
 
 func getBundleRefs(bundlePath string) (gitRefs, error) {
@@ -83,30 +86,17 @@ func getBundleRefs(bundlePath string) (gitRefs, error) {
 	return refs, nil
 }
 
-func dirHasBundles(dir string) bool {
-	f, err := os.Open(dir)
+func dirHasBundles(ctx context.Context, store Storage, dir string) bool {
+	objects, err := listDir(ctx, store, dir)
 	if err != nil {
-		return false
-	}
-
-	defer func() {
-		if err = f.Close(); err != nil {
-			logger.Print(err.Error())
-		}
-	}()
+		logger.Printf("failed to read bundle directory contents: %s", err.Error())
 
-	// TODO: why limit to 1?
-	names, err := f.Readdirnames(1)
-	if errors.Is(err, io.EOF) {
 		return false
 	}
 
-	if err != nil {
-		logger.Printf("failed to read bundle directory contents: %s", err.Error())
-	}
-
-	for _, name := range names {
-		if strings.HasSuffix(name, bundleExtension) {
+	// bundles may be accompanied by other files, such as manifests
+	for _, o := range objects {
+		if isBundleName(path.Base(o.Key)) {
 			return true
 		}
 	}
@@ -114,28 +104,29 @@ func dirHasBundles(dir string) bool {
 	return false
 }
 
-func getLatestBundleRefs(backupPath string) (gitRefs, error) {
+// getLatestBundleRefs returns the key of the latest bundle and its refs, as read by readBundleRefs.
+func getLatestBundleRefs(ctx context.Context, store Storage, backupPath string) (string, gitRefs, error) {
 	// if we encounter an invalid bundle, then we need to repeat until we find a valid one or run out
 	for {
-		path, err := getLatestBundlePath(backupPath)
+		bundlePath, err := getLatestBundlePath(ctx, store, backupPath)
 		if err != nil {
-			return nil, err
+			return "", nil, err
 		}
 
 		// get refs for bundle
 		var refs gitRefs
 
-		if refs, err = getBundleRefs(path); err != nil {
+		if refs, err = readBundleRefs(ctx, store, bundlePath); err != nil {
 			// failed to get refs
 			if strings.Contains(err.Error(), invalidBundleStringCheck) {
 				// rename the invalid bundle
 				logger.Printf("renaming invalid bundle to %s.invalid",
-					path)
+					bundlePath)
 
-				if err = os.Rename(path,
-					path+".invalid"); err != nil {
+				if err = moveObject(ctx, store, bundlePath,
+					bundlePath+".invalid"); err != nil {
 					// failed to rename, meaning a filesystem or permissions issue
-					return nil, fmt.Errorf("failed to rename invalid bundle %w", err)
+					return "", nil, fmt.Errorf("failed to rename invalid bundle %w", err)
 				}
 
 				// invalid bundle rename, so continue to check for the next latest bundle
@@ -144,158 +135,163 @@ func getLatestBundleRefs(backupPath string) (gitRefs, error) {
 		}
 
 		// otherwise return the refs
-		return refs, nil
+		return bundlePath, refs, nil
 	}
 }
 
-func createBundle(logLevel int, workingPath, backupPath string, repo repository) errors.E {
+// createBundle bundles the clone in workingPath into the backupPath directory of the storage,
+// returning the key of the bundle. If a base is provided, an incremental bundle is written
+// containing only the objects not reachable from the base bundle's refs, falling back to a
+// full bundle if there are none.
+func createBundle(ctx context.Context, in processBackupInput, store Storage, workingPath, backupPath string, base *incrementalBase) (string, errors.E) {
+	repo := in.repo
+
 	objectsPath := filepath.Join(workingPath, "objects")
 
 	dirs, readErr := os.ReadDir(objectsPath)
 	if readErr != nil {
-		return errors.Errorf("failed to read objectsPath: %s: %s", objectsPath, readErr)
+		return "", errors.Errorf("failed to read objectsPath: %s: %s", objectsPath, readErr)
 	}
 
 	emptyClone, err := isEmpty(workingPath)
 	if err != nil {
-		return errors.Errorf("failed to check if clone is empty: %s", err)
+		return "", errors.Errorf("failed to check if clone is empty: %s", err)
 	}
 
 	if len(dirs) == 2 && emptyClone {
-		return errors.Errorf("%s is empty", repo.PathWithNameSpace)
+		return "", errors.Errorf("%s is empty", repo.PathWithNameSpace)
 	}
 
+	var recipients []age.Recipient
+
 	backupFile := repo.Name + "." + getTimestamp() + bundleExtension
-	backupFilePath := filepath.Join(backupPath, backupFile)
 
-	createErr := createDirIfAbsent(backupPath)
-	if createErr != nil {
-		return errors.Errorf("failed to create backup path: %s: %s", backupPath, createErr)
+	if len(in.encryptionRecipients) > 0 {
+		if recipients, err = parseRecipients(in.encryptionRecipients); err != nil {
+			return "", err
+		}
+
+		backupFile += ageExtension
 	}
 
-	logger.Printf("creating bundle for: %s", repo.Name)
+	backupFilePath := path.Join(backupPath, backupFile)
 
-	bundleCmd := exec.Command("git", "bundle", "create", backupFilePath, "--all")
-	bundleCmd.Dir = workingPath
+	revArgs := []string{"--all"}
 
-	var bundleOut bytes.Buffer
+	var parent string
 
-	bundleCmd.Stdout = &bundleOut
-	bundleCmd.Stderr = &bundleOut
+	var prerequisites []string
 
-	startBundle := time.Now()
+	if base != nil {
+		var preErr errors.E
 
-	if bundleErr := bundleCmd.Run(); bundleErr != nil {
-		return errors.Errorf("failed to create bundle: %s: %s", repo.Name, bundleErr)
-	}
+		prerequisites, preErr = base.prerequisites(ctx, workingPath)
+		if preErr != nil {
+			return "", preErr
+		}
 
-	if logLevel > 0 {
-		logger.Printf("git bundle create time for %s %s: %s", repo.Domain, repo.Name, time.Since(startBundle).String())
-	}
+		if len(prerequisites) > 0 {
+			parent = path.Base(base.bundlePath)
 
-	return nil
-}
+			revArgs = append(append(revArgs, "--not"), prerequisites...)
+		}
+	}
 
-func getBundleFiles(backupPath string) (bundleFiles, error) {
-	files, err := os.ReadDir(backupPath)
-	if err != nil {
-		return nil, errors.Wrap(err, "backup path read failed")
+	if parent != "" {
+		logger.Printf("creating incremental bundle for: %s", repo.Name)
+	} else {
+		logger.Printf("creating bundle for: %s", repo.Name)
 	}
 
-	var bfs bundleFiles
+	startBundle := time.Now()
 
-	for _, f := range files {
-		if !strings.HasSuffix(f.Name(), bundleExtension) {
-			continue
+	content, bundleOut, bundleErr := putBundle(ctx, store, backupFilePath, workingPath, revArgs, recipients)
+	if bundleErr != nil {
+		if ctx.Err() != nil {
+			return "", errors.Wrapf(ctx.Err(), "backup cancelled whilst bundling %s", repo.Name)
 		}
 
-		var ts time.Time
+		if parent != "" && strings.Contains(bundleOut, emptyBundleStringCheck) {
+			logger.Printf("no new objects since %s so creating full bundle for: %s", parent, repo.Name)
 
-		ts, err = timeStampFromBundleName(f.Name())
-		if err != nil {
-			return nil, err
+			return createBundle(ctx, in, store, workingPath, backupPath, nil)
 		}
 
-		var info os.FileInfo
+		return "", errors.Errorf("failed to create bundle: %s: %s", repo.Name, bundleErr)
+	}
 
-		info, err = f.Info()
-		if err != nil {
-			return nil, err
-		}
+	manifest := newBundleManifest(ctx, content, repo, in.provider)
+	manifest.Parent = parent
 
-		bfs = append(bfs, bundleFile{
-			info:    info,
-			created: ts,
-		})
+	// record every ref, as incremental bundles leave out those that are unchanged
+	if manifest.Refs, err = localRefs(ctx, workingPath); err != nil {
+		return "", err
 	}
 
-	sort.Sort(bfs)
+	manifest.Prerequisites = prerequisites
 
-	return bfs, err
-}
+	// the refs, clone URL and checksum are only readable with the identities that decrypt the bundle
+	if len(recipients) > 0 {
+		if manifest, err = manifest.seal(recipients); err != nil {
+			return "", err
+		}
+	}
 
-func pruneBackups(backupPath string, keep int) errors.E {
-	files, readErr := os.ReadDir(backupPath)
-	if readErr != nil {
-		return errors.Wrap(readErr, "backup path read failed")
+	if err = writeBundleManifest(ctx, store, backupFilePath, manifest); err != nil {
+		return "", err
 	}
 
-	if len(files) > 0 {
-		logger.Printf("pruning %s to keep %d newest only", backupPath, keep)
+	if in.logLevel > 0 {
+		logger.Printf("git bundle create time for %s %s: %s", repo.Domain, repo.Name, time.Since(startBundle).String())
 	}
 
-	var bfs bundleFiles
+	return backupFilePath, nil
+}
 
-	for _, f := range files {
-		if !strings.HasSuffix(f.Name(), bundleExtension) {
-			logger.Printf("skipping non bundle file '%s'", f.Name())
+// getBundleFiles returns the bundles in the backupPath directory of the storage, oldest first.
+func getBundleFiles(ctx context.Context, store Storage, backupPath string) (bundleFiles, error) {
+	objects, err := listDir(ctx, store, backupPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "backup path read failed")
+	}
 
-			continue
-		}
+	var bfs bundleFiles
 
-		var ts time.Time
+	for _, o := range objects {
+		name := path.Base(o.Key)
 
-		ts, err := timeStampFromBundleName(f.Name())
-		if err != nil {
-			return err
+		if !isBundleName(name) {
+			continue
 		}
 
-		var info os.FileInfo
-
-		info, infoErr := f.Info()
-		if infoErr != nil {
-			return errors.Wrap(infoErr, "failed to get file info")
+		ts, tsErr := timeStampFromBundleName(name)
+		if tsErr != nil {
+			return nil, tsErr
 		}
 
 		bfs = append(bfs, bundleFile{
-			info:    info,
+			name:    name,
+			size:    o.Size,
 			created: ts,
 		})
 	}
 
 	sort.Sort(bfs)
 
-	firstFilesToDelete := len(bfs) - keep
-
-	var err errors.E
-
-	for x, f := range files {
-		if x < firstFilesToDelete {
-			if removeErr := os.Remove(filepath.Join(backupPath, f.Name())); err != nil {
-				return errors.Wrap(removeErr, "failed to remove file")
-			}
-
-			continue
-		}
+	return bfs, nil
+}
 
-		break
-	}
+// pruneBackups removes the oldest bundles so only the newest keep remain, other than
+// older bundles that the remaining incremental bundles build upon.
+func pruneBackups(ctx context.Context, store Storage, backupPath string, keep int) errors.E {
+	_, err := applyRetention(ctx, store, backupPath, RetentionPolicy{Last: keep}, time.Now())
 
-	return nil
+	return err
 }
 
 type bundleFile struct {
-	info    os.FileInfo
+	name    string
+	size    int64
 	created time.Time
 }
 
@@ -314,7 +310,7 @@ func (b bundleFiles) Swap(i, j int) {
 }
 
 func timeStampFromBundleName(i string) (time.Time, errors.E) {
-	tokens := strings.Split(i, ".")
+	tokens := strings.Split(strings.TrimSuffix(i, ageExtension), ".")
 	if len(tokens) < minBundleFileNameTokens {
 		return time.Time{}, errors.New("invalid bundle name")
 	}
@@ -328,8 +324,8 @@ func timeStampFromBundleName(i string) (time.Time, errors.E) {
 }
 
 func getTimeStampPartFromFileName(name string) (int, error) {
-	if strings.Count(name, ".") >= minBundleFileNameTokens-1 {
-		parts := strings.Split(name, ".")
+	if trimmed := strings.TrimSuffix(name, ageExtension); strings.Count(trimmed, ".") >= minBundleFileNameTokens-1 {
+		parts := strings.Split(trimmed, ".")
 
 		strTimestamp := parts[len(parts)-2]
 
@@ -340,26 +336,31 @@ func getTimeStampPartFromFileName(name string) (int, error) {
 		name)
 }
 
-func filesIdentical(path1, path2 string) bool {
+func filesIdentical(ctx context.Context, store Storage, path1, path2 string) bool {
 	// check if file sizes are same
-	latestBundleSize := getFileSize(path1)
+	latestBundle, latestStatErr := store.Stat(ctx, path1)
+	previousBundle, previousStatErr := store.Stat(ctx, path2)
+
+	if latestStatErr != nil || previousStatErr != nil {
+		logger.Printf("failed to stat bundles: %s: %s", path1, path2)
 
-	previousBundleSize := getFileSize(path2)
+		return false
+	}
 
-	if latestBundleSize == previousBundleSize {
+	if latestBundle.Size == previousBundle.Size {
 		// check if hashes match
-		latestBundleHash, latestHashErr := getSHA2Hash(path1)
+		latestBundleHash, latestHashErr := getObjectSHA2Hash(ctx, store, path1)
 		if latestHashErr != nil {
 			logger.Printf("failed to get sha2 hash for: %s", path1)
 		}
 
-		previousBundleHash, previousHashErr := getSHA2Hash(path2)
+		previousBundleHash, previousHashErr := getObjectSHA2Hash(ctx, store, path2)
 
 		if previousHashErr != nil {
 			logger.Printf("failed to get sha2 hash for: %s", path2)
 		}
 
-		if reflect.DeepEqual(latestBundleHash, previousBundleHash) {
+		if latestHashErr == nil && previousHashErr == nil && reflect.DeepEqual(latestBundleHash, previousBundleHash) {
 			return true
 		}
 	}
@@ -367,24 +368,26 @@ func filesIdentical(path1, path2 string) bool {
 	return false
 }
 
-func removeBundleIfDuplicate(dir string) {
-	files, err := getBundleFiles(dir)
+// removeBundleIfDuplicate deletes the latest bundle if identical to the previous one,
+// returning the path of the previous bundle if so.
+func removeBundleIfDuplicate(ctx context.Context, store Storage, dir string) string {
+	files, err := getBundleFiles(ctx, store, dir)
 	if err != nil {
 		logger.Println(err)
 
-		return
+		return ""
 	}
 
-	if len(files) == 1 {
-		return
+	if len(files) < 2 {
+		return ""
 	}
 	// get timestamps in filenames for sorting
 	fNameTimes := map[string]int{}
 
 	for _, f := range files {
 		var ts int
-		if ts, err = getTimeStampPartFromFileName(f.info.Name()); err == nil {
-			fNameTimes[f.info.Name()] = ts
+		if ts, err = getTimeStampPartFromFileName(f.name); err == nil {
+			fNameTimes[f.name] = ts
 		}
 	}
 
@@ -403,17 +406,23 @@ func removeBundleIfDuplicate(dir string) {
 		return ss[i].Value > ss[j].Value
 	})
 
-	latestBundleFilePath := filepath.Join(dir, ss[0].Key)
-	previousBundleFilePath := filepath.Join(dir, ss[1].Key)
+	latestBundleFilePath := path.Join(dir, ss[0].Key)
+	previousBundleFilePath := path.Join(dir, ss[1].Key)
 
-	if filesIdentical(latestBundleFilePath, previousBundleFilePath) {
+	if bundlesIdentical(ctx, store, latestBundleFilePath, previousBundleFilePath) {
 		logger.Printf("no change since previous bundle: %s", ss[1].Key)
 		logger.Printf("deleting duplicate bundle: %s", ss[0].Key)
 
-		if deleteFile(filepath.Join(dir, ss[0].Key)) != nil {
+		if removeBundle(ctx, store, latestBundleFilePath) != nil {
 			logger.Println("failed to remove duplicate bundle")
+
+			return ""
 		}
+
+		return previousBundleFilePath
 	}
+
+	return ""
 }
 
 func deleteFile(path string) error {
@@ -446,13 +455,19 @@ func getSHA2Hash(filePath string) ([]byte, error) {
 	return hash.Sum(result), nil
 }
 
-func getFileSize(path string) int64 {
-	fi, err := os.Stat(path)
+// getObjectSHA2Hash returns the sha256 of the object's content.
+func getObjectSHA2Hash(ctx context.Context, store Storage, key string) ([]byte, error) {
+	r, err := store.Get(ctx, key)
 	if err != nil {
-		logger.Println(err)
+		return nil, err
+	}
 
-		return 0
+	defer r.Close()
+
+	hash := sha256.New()
+	if _, copyErr := io.Copy(hash, r); copyErr != nil {
+		return nil, errors.Wrap(copyErr, "failed to get hash")
 	}
 
-	return fi.Size()
+	return hash.Sum(nil), nil
 }
@@ -0,0 +1,57 @@
+package githosts
+
+import (
+	"context"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// CloneLimiter caps the number of repositories being cloned and bundled at once.
+// A single limiter can be shared between hosts to limit the total number of
+// git processes when backing up several providers in parallel.
+type CloneLimiter struct {
+	slots chan struct{}
+}
+
+// NewCloneLimiter returns a limiter allowing up to limit concurrent clones.
+func NewCloneLimiter(limit int) (*CloneLimiter, error) {
+	if limit < 1 {
+		return nil, errors.Errorf("clone limit must be at least 1: %d", limit)
+	}
+
+	return &CloneLimiter{
+		slots: make(chan struct{}, limit),
+	}, nil
+}
+
+// acquire blocks until a slot is available or the context is cancelled.
+// A nil limiter never blocks.
+func (l *CloneLimiter) acquire(ctx context.Context) errors.E {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "backup cancelled whilst waiting to clone")
+	}
+}
+
+func (l *CloneLimiter) release() {
+	if l == nil {
+		return
+	}
+
+	<-l.slots
+}
+
+// workerCount returns the number of workers to use, falling back to the provider's default.
+func workerCount(concurrency, defaultConcurrency int) int {
+	if concurrency < 1 {
+		return defaultConcurrency
+	}
+
+	return concurrency
+}
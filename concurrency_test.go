@@ -0,0 +1,81 @@
+package githosts
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCloneLimiterWithInvalidLimit(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewCloneLimiter(0)
+	require.Error(t, err)
+}
+
+func TestCloneLimiterBlocksUntilReleased(t *testing.T) {
+	t.Parallel()
+
+	limiter, err := NewCloneLimiter(1)
+	require.NoError(t, err)
+
+	require.NoError(t, limiter.acquire(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// limit reached so acquiring waits until the context expires
+	require.ErrorIs(t, limiter.acquire(ctx), context.DeadlineExceeded)
+
+	limiter.release()
+
+	require.NoError(t, limiter.acquire(context.Background()))
+	limiter.release()
+}
+
+func TestNilCloneLimiterDoesNotBlock(t *testing.T) {
+	t.Parallel()
+
+	var limiter *CloneLimiter
+
+	require.NoError(t, limiter.acquire(context.Background()))
+	limiter.release()
+}
+
+func TestWorkerCount(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, 5, workerCount(0, 5))
+	require.Equal(t, 5, workerCount(-1, 5))
+	require.Equal(t, 2, workerCount(2, 5))
+}
+
+func TestBackupReposWithSharedCloneLimiter(t *testing.T) {
+	t.Parallel()
+
+	limiter, err := NewCloneLimiter(1)
+	require.NoError(t, err)
+
+	sourcePath := createTestGitRepo(t)
+
+	repoOne := testRepository(sourcePath)
+	repoTwo := testRepository(sourcePath)
+	repoTwo.PathWithNameSpace = "go-soba/repo1"
+
+	res := backupRepos(context.Background(), []repository{repoOne, repoTwo}, 2, processBackupInput{
+		backupDir:        t.TempDir(),
+		diffRemoteMethod: cloneMethod,
+		cloneLimiter:     limiter,
+	})
+	require.NoError(t, res.Error)
+	require.Len(t, res.BackupResults, 2)
+
+	for _, r := range res.BackupResults {
+		require.Equal(t, StatusCreated, r.Status)
+	}
+
+	// all slots are released once backups complete
+	require.Empty(t, limiter.slots)
+}
@@ -1,12 +1,13 @@
 package githosts
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
-	"reflect"
 	"slices"
 	"strings"
 	"time"
@@ -22,8 +23,21 @@ const (
 	cloneMethod         = "clone"
 	defaultRemoteMethod = cloneMethod
 	logEntryPrefix      = "githosts-utils: "
-	statusOk            = "ok"
-	statusFailed        = "failed"
+)
+
+// statuses reported in RepoBackupResults
+const (
+	// StatusCreated means a new bundle was written.
+	StatusCreated = "created"
+	// StatusUnchanged means the repository had not changed since the latest bundle,
+	// either because the remote refs matched or the new bundle was identical.
+	StatusUnchanged = "unchanged"
+	// StatusSkippedEmpty means the repository has no commits to back up.
+	StatusSkippedEmpty = "skipped-empty"
+	// StatusSkippedFiltered means the repository was excluded by the RepositoryFilter.
+	StatusSkippedFiltered = "skipped-filtered"
+	StatusFailed          = "failed"
+	StatusCancelled       = "cancelled"
 )
 
 type repository struct {
@@ -33,18 +47,70 @@ type repository struct {
 	Domain            string
 	HTTPSUrl          string
 	SSHUrl            string
-	URLWithToken      string
-	URLWithBasicAuth  string
+	Private           bool
+	Fork              bool
+	Archived          bool
+	Size              int64
+	DefaultBranch     string
+	// credentials authenticate cloning over HTTPS
+	credentials gitCredentials
+}
+
+// Repository describes a repository hosted by a provider.
+// Metadata not made available by a provider is left as the zero value.
+type Repository struct {
+	Name              string `json:"name"`
+	Owner             string `json:"owner,omitempty"`
+	PathWithNameSpace string `json:"path_with_namespace"`
+	Domain            string `json:"domain"`
+	HTTPSUrl          string `json:"https_url,omitempty"`
+	SSHUrl            string `json:"ssh_url,omitempty"`
+	Private           bool   `json:"private"`
+	Fork              bool   `json:"fork"`
+	Archived          bool   `json:"archived"`
+	// Size is the approximate size of the repository in bytes, as reported by the provider.
+	Size          int64  `json:"size,omitempty"`
+	DefaultBranch string `json:"default_branch,omitempty"`
+}
+
+// export returns the repository without any credentials.
+func (r repository) export() Repository {
+	return Repository{
+		Name:              r.Name,
+		Owner:             r.Owner,
+		PathWithNameSpace: r.PathWithNameSpace,
+		Domain:            r.Domain,
+		HTTPSUrl:          r.HTTPSUrl,
+		SSHUrl:            r.SSHUrl,
+		Private:           r.Private,
+		Fork:              r.Fork,
+		Archived:          r.Archived,
+		Size:              r.Size,
+		DefaultBranch:     r.DefaultBranch,
+	}
 }
 
 type describeReposOutput struct {
 	Repos []repository
+	// Err reports a failure to list some of the repositories, such as those of one of
+	// several organizations, without preventing the others from being backed up.
+	Err errors.E
 }
 
 type RepoBackupResults struct {
-	Repo   string   `json:"repo,omitempty"`
-	Status string   `json:"status,omitempty"` // ok, failed
+	Repo   string `json:"repo,omitempty"`
+	Status string `json:"status,omitempty"` // one of the Status constants, e.g. StatusCreated
+	// Reason explains why a repository was skipped.
+	Reason string   `json:"reason,omitempty"`
 	Error  errors.E `json:"error,omitempty"`
+	// BundlePath is the bundle written, or the existing bundle if unchanged.
+	BundlePath string        `json:"bundle_path,omitempty"`
+	BundleSize int64         `json:"bundle_size,omitempty"`
+	RefCount   int           `json:"ref_count,omitempty"`
+	Duration   time.Duration `json:"duration,omitempty"`
+	DiffMethod string        `json:"diff_method,omitempty"`
+	// Pruned lists the bundles removed by the retention policy, or that would be if it's a dry run.
+	Pruned []string `json:"pruned,omitempty"`
 }
 
 // type ProviderBackupResult []RepoBackupResults
@@ -54,23 +120,18 @@ type ProviderBackupResult struct {
 }
 
 type gitProvider interface {
+	Provider
 	getAPIURL() string
-	describeRepos() (describeReposOutput, errors.E)
-	Backup() ProviderBackupResult
+	describeRepos(ctx context.Context) (describeReposOutput, errors.E)
 	diffRemoteMethod() string
 }
 
 // gitRefs is a mapping of references to SHAs.
 type gitRefs map[string]string
 
-func remoteRefsMatchLocalRefs(cloneURL, backupPath string) bool {
-	// if there's no backup path then return false
-	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
-		return false
-	}
-
+func remoteRefsMatchLocalRefs(ctx context.Context, cloneURL string, env []string, store Storage, backupPath string) bool {
 	// if there are no backups
-	if !dirHasBundles(backupPath) {
+	if !dirHasBundles(ctx, store, backupPath) {
 		return false
 	}
 
@@ -78,25 +139,23 @@ func remoteRefsMatchLocalRefs(cloneURL, backupPath string) bool {
 
 	var err error
 
-	lHeads, err = getLatestBundleRefs(backupPath)
+	var bundlePath string
+
+	bundlePath, lHeads, err = getLatestBundleRefs(ctx, store, backupPath)
 	if err != nil {
 		logger.Printf("failed to get latest bundle refs for %s", backupPath)
 
 		return false
 	}
 
-	rHeads, err = getRemoteRefs(cloneURL)
+	rHeads, err = getRemoteRefs(ctx, cloneURL, env)
 	if err != nil {
 		logger.Printf("failed to get remote refs")
 
 		return false
 	}
 
-	if reflect.DeepEqual(lHeads, rHeads) {
-		return true
-	}
-
-	return false
+	return bundleRefsMatch(bundlePath, lHeads, rHeads)
 }
 
 func cutBySpaceAndTrimOutput(in string) (before, after string, found bool) {
@@ -158,10 +217,12 @@ func generateMapFromRefsCmdOutput(in []byte) (refs gitRefs, err error) {
 	return
 }
 
-func getRemoteRefs(cloneURL string) (refs gitRefs, err error) {
+// getRemoteRefs lists the refs of the remote, running git with env if set.
+func getRemoteRefs(ctx context.Context, cloneURL string, env []string) (refs gitRefs, err error) {
 	// --refs ignores pseudo-refs like HEAD and FETCH_HEAD, and also peeled tags that reference other objects
 	// this enables comparison with refs from existing bundles
-	remoteHeadsCmd := exec.Command("git", "ls-remote", "--refs", cloneURL)
+	remoteHeadsCmd := exec.CommandContext(ctx, "git", "ls-remote", "--refs", cloneURL)
+	remoteHeadsCmd.Env = env
 
 	out, err := remoteHeadsCmd.CombinedOutput()
 	if err != nil {
@@ -173,77 +234,361 @@ func getRemoteRefs(cloneURL string) (refs gitRefs, err error) {
 	return
 }
 
-func processBackup(logLevel int, repo repository, backupDIR string, backupsToKeep int, diffRemoteMethod string) errors.E {
-	// create backup path
-	workingPath := filepath.Join(backupDIR, workingDIRName, repo.Domain, repo.PathWithNameSpace)
-	backupPath := filepath.Join(backupDIR, repo.Domain, repo.PathWithNameSpace)
-	// clean existing working directory
-	delErr := os.RemoveAll(workingPath)
-	if delErr != nil {
-		return errors.Errorf("failed to remove working directory: %s: %s", workingPath, delErr)
+type processBackupInput struct {
+	logLevel             int
+	repo                 repository
+	backupDir            string
+	backupsToKeep        int
+	diffRemoteMethod     string
+	filter               RepositoryFilter
+	cloneLimiter         *CloneLimiter
+	observer             Observer
+	provider             string
+	incremental          bool
+	mirrorCache          bool
+	encryptionRecipients []string
+	storage              Storage
+	retention            RetentionPolicy
+	ssh                  *SSHConfig
+	tls                  *TLSConfig
+}
+
+// notify sends an event about the repository being backed up.
+func (in processBackupInput) notify(event Event) {
+	event.Provider = in.provider
+	event.Repo = in.repo.PathWithNameSpace
+
+	notify(in.observer, event)
+}
+
+// gitEnv returns the environment for git commands that contact the remote,
+// or nil to inherit the environment.
+func (in processBackupInput) gitEnv() []string {
+	var env []string
+
+	if in.ssh != nil {
+		env = in.ssh.gitEnv()
+	} else {
+		env = in.repo.credentials.gitEnv()
+	}
+
+	env = append(env, in.tls.gitEnv()...)
+	if len(env) == 0 {
+		return nil
 	}
 
-	var cloneURL string
+	return append(os.Environ(), env...)
+}
+
+// secrets returns the values to mask in errors and logs about the repository.
+func (in processBackupInput) secrets() []string {
+	return in.repo.credentials.secrets()
+}
+
+// processBackupOutput describes the outcome of backing up a repository.
+type processBackupOutput struct {
+	status     string
+	reason     string
+	bundlePath string
+	bundleSize int64
+	refCount   int
+	// pruned lists the bundles removed by the retention policy, or that would be in a dry run.
+	pruned []string
+}
+
+// withBundle returns the output with the details of the bundle with the given key.
+func (out processBackupOutput) withBundle(ctx context.Context, store Storage, bundlePath string) processBackupOutput {
+	out.bundlePath = objectLocation(store, bundlePath)
 
-	if repo.URLWithToken != "" {
-		cloneURL = repo.URLWithToken
-	} else if repo.URLWithBasicAuth != "" {
-		cloneURL = repo.URLWithBasicAuth
+	if obj, err := store.Stat(ctx, bundlePath); err == nil {
+		out.bundleSize = obj.Size
+	}
+
+	refs, err := readBundleRefs(ctx, store, bundlePath)
+	if err != nil {
+		logger.Printf("failed to get refs for bundle: %s: %s", bundlePath, err)
+
+		return out
+	}
+
+	out.refCount = len(refs)
+
+	return out
+}
+
+// processBackup clones a repository and bundles it into the backup directory.
+// If the context is cancelled, any in-flight git command is killed and the
+// repository's working directory is removed.
+func processBackup(ctx context.Context, in processBackupInput) (processBackupOutput, errors.E) {
+	repo := in.repo
+
+	if ctx.Err() != nil {
+		return processBackupOutput{}, errors.Wrap(ctx.Err(), "backup cancelled")
+	}
+
+	store := in.storage
+	if store == nil {
+		store = NewLocalStorage(in.backupDir)
+	}
+
+	// clones are always made locally, with bundles written to the storage
+	workingPath := filepath.Join(in.backupDir, workingDIRName, repo.Domain, repo.PathWithNameSpace)
+	backupPath := path.Join(repo.Domain, repo.PathWithNameSpace)
+	// clean existing working directory, unless it's kept between backups
+	if !in.mirrorCache {
+		if delErr := os.RemoveAll(workingPath); delErr != nil {
+			return processBackupOutput{}, errors.Errorf("failed to remove working directory: %s: %s", workingPath, delErr)
+		}
+	}
+
+	// credentials are provided by the environment rather than the URL
+	cloneURL := credentialFreeURL(repo.HTTPSUrl)
+
+	if in.ssh != nil {
+		if repo.SSHUrl == "" {
+			return processBackupOutput{}, errors.Errorf("no SSH URL for repository: %s", repo.PathWithNameSpace)
+		}
+
+		cloneURL = repo.SSHUrl
 	}
 
 	// Check if existing, latest bundle refs, already match the remote
-	if diffRemoteMethod == refsMethod {
+	if in.diffRemoteMethod == refsMethod {
 		// check backup path exists before attempting to compare remote and local heads
-		if remoteRefsMatchLocalRefs(cloneURL, backupPath) {
+		if remoteRefsMatchLocalRefs(ctx, cloneURL, in.gitEnv(), store, backupPath) {
 			logger.Printf("skipping clone of %s repo '%s' as refs match existing bundle", repo.Domain, repo.PathWithNameSpace)
 
-			return nil
+			in.notify(Event{
+				Type:   EventRepoSkipped,
+				Reason: "refs match existing bundle",
+			})
+
+			out := processBackupOutput{
+				status: StatusUnchanged,
+				reason: "refs match existing bundle",
+			}
+
+			if latestBundlePath, err := getLatestBundlePath(ctx, store, backupPath); err == nil {
+				out = out.withBundle(ctx, store, latestBundlePath)
+			}
+
+			return out, nil
 		}
 	}
 
-	// clone repo
-	logger.Printf("cloning: %s to: %s", repo.HTTPSUrl, workingPath)
+	// wait for a slot if clones are limited across hosts
+	if err := in.cloneLimiter.acquire(ctx); err != nil {
+		return processBackupOutput{}, err
+	}
+
+	defer in.cloneLimiter.release()
+
+	in.notify(Event{Type: EventCloneStarted})
 
-	cloneCmd := exec.Command("git", "clone", "-v", "--mirror", cloneURL, workingPath)
-	cloneCmd.Dir = backupDIR
+	start := time.Now()
 
-	cloneOut, cloneErr := cloneCmd.CombinedOutput()
+	cached, cloneErr := updateMirror(ctx, in, cloneURL, workingPath)
 	if cloneErr != nil {
-		fmt.Printf("cloning failed for repository: %s - %s\n", repo.Name, cloneErr)
+		return processBackupOutput{}, cloneErr
 	}
 
-	cloneOutLines := strings.Split(string(cloneOut), "\n")
+	var base *incrementalBase
 
-	if cloneErr != nil {
-		if os.Getenv(envVarGitHostsLog) == "debug" {
-			fmt.Printf("debug: cloning failed for repository: %s - %s\n", repo.Name, strings.Join(cloneOutLines, ", "))
+	if in.incremental {
+		base = getIncrementalBase(ctx, store, backupPath, in.backupsToKeep)
 
-			return errors.Errorf("cloning failed: %s: %s", strings.Join(cloneOutLines, ", "), cloneErr)
-		}
+		// an incremental bundle would be empty if nothing has changed
+		if base != nil {
+			if cloneRefs, refsErr := getRemoteRefs(ctx, workingPath, nil); refsErr == nil && bundleRefsMatch(base.bundlePath, base.refs, cloneRefs) {
+				logger.Printf("no change since previous bundle: %s", path.Base(base.bundlePath))
 
-		return errors.Errorf("cloning failed for repository: %s - %s", repo.Name, cloneErr)
+				return processBackupOutput{
+					status: StatusUnchanged,
+					reason: "refs match existing bundle",
+				}.withBundle(ctx, store, base.bundlePath), nil
+			}
+		}
 	}
 
 	// create bundle
-	if err := createBundle(logLevel, workingPath, backupPath, repo); err != nil {
+	bundlePath, err := createBundle(ctx, in, store, workingPath, backupPath, base)
+	if err != nil {
+		if ctx.Err() != nil {
+			removeWorkingDir(workingPath)
+
+			return processBackupOutput{}, err
+		}
+
+		if cached && !strings.HasSuffix(err.Error(), "is empty") {
+			// the cached mirror may be corrupt, so clone afresh on the next backup
+			logger.Printf("removing cached mirror of %s as bundling failed", repo.PathWithNameSpace)
+
+			removeWorkingDir(workingPath)
+		}
+
 		if strings.HasSuffix(err.Error(), "is empty") {
 			logger.Printf("skipping empty %s repository %s", repo.Domain, repo.PathWithNameSpace)
 
-			return nil
+			in.notify(Event{
+				Type:   EventRepoSkipped,
+				Reason: "repository is empty",
+			})
+
+			return processBackupOutput{
+				status: StatusSkippedEmpty,
+				reason: "repository is empty",
+			}, nil
 		}
 
-		return err
+		return processBackupOutput{}, err
 	}
 
-	removeBundleIfDuplicate(backupPath)
+	out := processBackupOutput{status: StatusCreated}.withBundle(ctx, store, bundlePath)
+
+	in.notify(Event{
+		Type:     EventBundleWritten,
+		Duration: time.Since(start),
+		Bytes:    out.bundleSize,
+	})
 
-	if backupsToKeep > 0 {
-		if err := pruneBackups(backupPath, backupsToKeep); err != nil {
-			return err
+	if previousBundlePath := removeBundleIfDuplicate(ctx, store, backupPath); previousBundlePath != "" {
+		out.status = StatusUnchanged
+		out.reason = "bundle identical to previous"
+		out.bundlePath = objectLocation(store, previousBundlePath)
+	}
+
+	if policy := in.retentionPolicy(); !policy.IsZero() {
+		decisions, pruneErr := applyRetention(ctx, store, backupPath, policy, time.Now())
+		if pruneErr != nil {
+			return processBackupOutput{}, pruneErr
+		}
+
+		for _, d := range decisions {
+			if !d.Keep {
+				out.pruned = append(out.pruned, d.Path)
+			}
 		}
 	}
 
-	return nil
+	return out, nil
+}
+
+func removeWorkingDir(workingPath string) {
+	if err := os.RemoveAll(workingPath); err != nil {
+		logger.Printf("failed to remove working directory: %s: %s", workingPath, err)
+	}
+}
+
+// backupWorker processes repositories from the jobs channel until it is closed.
+// Once the context is done, remaining jobs are not started and are reported as cancelled.
+func backupWorker(ctx context.Context, in processBackupInput, jobs <-chan repository, results chan<- RepoBackupResults) {
+	for repo := range jobs {
+		backupResult := RepoBackupResults{
+			Repo: repo.PathWithNameSpace,
+		}
+
+		if ctx.Err() != nil {
+			backupResult.Status = StatusCancelled
+			backupResult.Error = errors.Wrap(ctx.Err(), "backup cancelled")
+
+			results <- backupResult
+
+			continue
+		}
+
+		in.repo = repo
+
+		start := time.Now()
+
+		out, err := processBackup(ctx, in)
+		err = maskError(err, in.secrets())
+
+		backupResult.Duration = time.Since(start)
+		backupResult.DiffMethod = in.diffRemoteMethod
+
+		switch {
+		case err == nil:
+			backupResult.Status = out.status
+			backupResult.Reason = out.reason
+			backupResult.BundlePath = out.bundlePath
+			backupResult.BundleSize = out.bundleSize
+			backupResult.RefCount = out.refCount
+			backupResult.Pruned = out.pruned
+		case ctx.Err() != nil:
+			backupResult.Status = StatusCancelled
+			backupResult.Error = err
+		default:
+			backupResult.Status = StatusFailed
+			backupResult.Error = err
+
+			in.notify(Event{
+				Type:     EventRepoFailed,
+				Duration: time.Since(start),
+				Error:    err,
+			})
+		}
+
+		results <- backupResult
+	}
+}
+
+// backupRepos backs up the provided repositories using up to maxConcurrent workers.
+// A result is returned for every repository, including those cancelled before they started.
+func backupRepos(ctx context.Context, repos []repository, maxConcurrent int, in processBackupInput) ProviderBackupResult {
+	repos, skipped, err := filterRepos(repos, in.filter)
+	if err != nil {
+		return ProviderBackupResult{
+			Error: errors.Wrap(err, "failed to apply repository filter"),
+		}
+	}
+
+	jobs := make(chan repository, len(repos))
+	results := make(chan RepoBackupResults, maxConcurrent)
+
+	for w := 1; w <= maxConcurrent; w++ {
+		go backupWorker(ctx, in, jobs, results)
+	}
+
+	for _, res := range skipped {
+		notify(in.observer, Event{
+			Type:     EventRepoSkipped,
+			Provider: in.provider,
+			Repo:     res.Repo,
+			Reason:   res.Reason,
+		})
+	}
+
+	for x := range repos {
+		// notify before queueing so a worker's events can't precede it
+		notify(in.observer, Event{
+			Type:     EventRepoQueued,
+			Provider: in.provider,
+			Repo:     repos[x].PathWithNameSpace,
+		})
+
+		jobs <- repos[x]
+	}
+
+	close(jobs)
+
+	providerBackupResults := ProviderBackupResult{
+		BackupResults: skipped,
+	}
+
+	for a := 1; a <= len(repos); a++ {
+		res := <-results
+		if res.Status == StatusFailed {
+			logger.Printf("backup failed: %+v\n", res.Error)
+		}
+
+		providerBackupResults.BackupResults = append(providerBackupResults.BackupResults, res)
+	}
+
+	if ctx.Err() != nil {
+		providerBackupResults.Error = errors.Wrap(ctx.Err(), "backup cancelled")
+	}
+
+	return providerBackupResults
 }
 
 func getHTTPClient() *retryablehttp.Client {
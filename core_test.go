@@ -1,9 +1,11 @@
 package githosts
 
 import (
+	"context"
 	b64 "encoding/base64"
 	"log"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"testing"
@@ -60,6 +62,8 @@ func TestHostsImplementGitHostsInterface(t *testing.T) {
 	require.Implements(t, (*gitProvider)(nil), new(GitHubHost))
 	require.Implements(t, (*gitProvider)(nil), new(BitbucketHost))
 	require.Implements(t, (*gitProvider)(nil), new(GitLabHost))
+	require.Implements(t, (*gitProvider)(nil), new(AzureDevOpsHost))
+	require.Implements(t, (*Provider)(nil), new(AzureDevOpsHost))
 }
 
 func TestAllTrue(t *testing.T) {
@@ -71,7 +75,7 @@ func TestAllTrue(t *testing.T) {
 func TestGetLatestBundleRefs(t *testing.T) {
 	t.Parallel()
 
-	refs, err := getLatestBundleRefs("testfiles/example-bundles")
+	_, refs, err := getLatestBundleRefs(context.Background(), NewLocalStorage(""), "testfiles/example-bundles")
 	require.NoError(t, err)
 
 	var found int
@@ -120,11 +124,11 @@ func TestFilesIdentical(t *testing.T) {
 
 	pathOne := createTestTextFile("one", txtSomeContent)
 	pathTwo := createTestTextFile("two", txtSomeContent)
-	require.True(t, filesIdentical(pathOne, pathTwo))
+	require.True(t, filesIdentical(context.Background(), NewLocalStorage(""), pathOne, pathTwo))
 
 	pathOne = createTestTextFile("one", txtSomeContent)
 	pathTwo = createTestTextFile("two", "some other content")
-	require.False(t, filesIdentical(pathOne, pathTwo))
+	require.False(t, filesIdentical(context.Background(), NewLocalStorage(""), pathOne, pathTwo))
 }
 
 func TestGetTimeStampPartFromFileName(t *testing.T) {
@@ -170,20 +174,22 @@ func TestCreateHost(t *testing.T) {
 func TestGetLatestBundlePath(t *testing.T) {
 	t.Parallel()
 
-	// invalid directory
-	bundlePath, err := getLatestBundlePath("invalid-directory")
+	store := NewLocalStorage("")
+
+	// missing directory
+	bundlePath, err := getLatestBundlePath(context.Background(), store, "invalid-directory")
 	require.Empty(t, bundlePath)
-	require.Contains(t, err.Error(), "backup path read failed")
+	require.Contains(t, err.Error(), "no bundle files found in path")
 
 	// empty directory
 	dir, err := os.MkdirTemp(t.TempDir(), "soba-*")
 	require.NoError(t, err)
-	bundlePath, err = getLatestBundlePath(dir)
+	bundlePath, err = getLatestBundlePath(context.Background(), store, dir)
 	require.Empty(t, bundlePath)
 	require.Contains(t, err.Error(), "no bundle files found in path")
 
 	// directory with two bundles
-	bundlePath, err = getLatestBundlePath("testfiles/example-bundles")
+	bundlePath, err = getLatestBundlePath(context.Background(), store, "testfiles/example-bundles")
 	require.NoError(t, err)
 	require.Equal(t, "testfiles/example-bundles/example.20221102202522.bundle", bundlePath)
 }
@@ -212,7 +218,7 @@ func TestPruneBackups(t *testing.T) {
 		require.NoError(t, err, "failed to open file: %s"+dfPath)
 	}
 
-	require.NoError(t, pruneBackups(dfDir, 2))
+	require.NoError(t, pruneBackups(context.Background(), NewLocalStorage(dfDir), "", 2))
 
 	files, err := os.ReadDir(dfDir)
 	require.NoError(t, err)
@@ -257,7 +263,7 @@ func TestPruneBackupsWithNonBundleFiles(t *testing.T) {
 		require.NoError(t, err, "failed to open file: ", dfPath)
 	}
 
-	require.NoError(t, pruneBackups(dfDir, 2))
+	require.NoError(t, pruneBackups(context.Background(), NewLocalStorage(dfDir), "", 2))
 }
 
 func TestTimeStampFromBundleName(t *testing.T) {
@@ -312,3 +318,169 @@ func TestGenerateMapFromRefsCmdOutput(t *testing.T) {
 	require.Equal(t, "74e5977463007b3cb29ef11d776afa620e4e8698", refs["refs/heads/example"])
 	require.Equal(t, "74e5977463007b3cb29ef11d776afa620e4e8698", refs["refs/heads/master"])
 }
+
+// createTestGitRepo creates a local repository with a single commit for use as a backup source.
+func createTestGitRepo(t *testing.T) string {
+	t.Helper()
+
+	repoDir := filepath.Join(t.TempDir(), "source")
+
+	for _, args := range [][]string{
+		{"init", "--quiet", repoDir},
+		{"-C", repoDir, "-c", "user.name=soba", "-c", "user.email=soba@example.com", "commit", "--quiet", "--allow-empty", "-m", "initial"},
+	} {
+		out, err := exec.Command("git", args...).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	return repoDir
+}
+
+func testRepository(sourcePath string) repository {
+	return repository{
+		Name:              "repo0",
+		Owner:             "go-soba",
+		PathWithNameSpace: "go-soba/repo0",
+		Domain:            "example.com",
+		HTTPSUrl:          sourcePath,
+	}
+}
+
+func TestProcessBackupCreatesBundle(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+	repo := testRepository(createTestGitRepo(t))
+
+	out, err := processBackup(context.Background(), processBackupInput{
+		repo:             repo,
+		backupDir:        backupDir,
+		diffRemoteMethod: cloneMethod,
+	})
+	require.NoError(t, err)
+
+	entries, dirErr := dirContents(filepath.Join(backupDir, repo.Domain, repo.PathWithNameSpace))
+	require.NoError(t, dirErr)
+	// the bundle and its manifest
+	require.Len(t, entries, 2)
+	require.Regexp(t, `^repo0\.\d{14}\.bundle$`, entries[0].Name())
+	require.Equal(t, entries[0].Name()+bundleManifestExtension, entries[1].Name())
+
+	require.Equal(t, StatusCreated, out.status)
+	require.Equal(t, filepath.Join(backupDir, repo.Domain, repo.PathWithNameSpace, entries[0].Name()), out.bundlePath)
+	require.Positive(t, out.bundleSize)
+	require.Equal(t, 1, out.refCount)
+}
+
+func TestProcessBackupUnchangedWhenRefsMatch(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+	repo := testRepository(createTestGitRepo(t))
+
+	in := processBackupInput{
+		repo:             repo,
+		backupDir:        backupDir,
+		diffRemoteMethod: refsMethod,
+	}
+
+	first, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusCreated, first.status)
+
+	second, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusUnchanged, second.status)
+	require.Equal(t, "refs match existing bundle", second.reason)
+	require.Equal(t, first.bundlePath, second.bundlePath)
+	require.Equal(t, first.bundleSize, second.bundleSize)
+	require.Equal(t, first.refCount, second.refCount)
+}
+
+func TestProcessBackupSkipsEmptyRepository(t *testing.T) {
+	t.Parallel()
+
+	sourcePath := t.TempDir()
+	require.NoError(t, exec.Command("git", "init", "-q", sourcePath).Run())
+
+	backupDir := t.TempDir()
+
+	out, err := processBackup(context.Background(), processBackupInput{
+		repo:             testRepository(sourcePath),
+		backupDir:        backupDir,
+		diffRemoteMethod: cloneMethod,
+	})
+	require.NoError(t, err)
+	require.Equal(t, StatusSkippedEmpty, out.status)
+	require.Empty(t, out.bundlePath)
+}
+
+func TestProcessBackupWithCancelledContext(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+	repo := testRepository(createTestGitRepo(t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := processBackup(ctx, processBackupInput{
+		repo:             repo,
+		backupDir:        backupDir,
+		diffRemoteMethod: cloneMethod,
+	})
+	require.Error(t, err)
+	require.ErrorIs(t, err, context.Canceled)
+	require.NoDirExists(t, filepath.Join(backupDir, repo.Domain))
+	require.NoDirExists(t, filepath.Join(backupDir, workingDIRName, repo.Domain, repo.PathWithNameSpace))
+}
+
+func TestBackupReposWithCancelledContext(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+	sourcePath := createTestGitRepo(t)
+
+	repoOne := testRepository(sourcePath)
+	repoTwo := testRepository(sourcePath)
+	repoTwo.Name = "repo1"
+	repoTwo.PathWithNameSpace = "go-soba/repo1"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	res := backupRepos(ctx, []repository{repoOne, repoTwo}, 2, processBackupInput{
+		backupDir:        backupDir,
+		diffRemoteMethod: cloneMethod,
+	})
+	require.Error(t, res.Error)
+	require.ErrorIs(t, res.Error, context.Canceled)
+	require.Len(t, res.BackupResults, 2)
+
+	for _, r := range res.BackupResults {
+		require.Equal(t, StatusCancelled, r.Status)
+		require.Error(t, r.Error)
+	}
+
+	require.NoDirExists(t, filepath.Join(backupDir, repoOne.Domain))
+}
+
+func TestBackupReposCompletesWithoutCancellation(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+	repo := testRepository(createTestGitRepo(t))
+
+	res := backupRepos(context.Background(), []repository{repo}, 1, processBackupInput{
+		backupDir:        backupDir,
+		diffRemoteMethod: cloneMethod,
+	})
+	require.NoError(t, res.Error)
+	require.Len(t, res.BackupResults, 1)
+	require.Equal(t, StatusCreated, res.BackupResults[0].Status)
+	require.Equal(t, cloneMethod, res.BackupResults[0].DiffMethod)
+	require.FileExists(t, res.BackupResults[0].BundlePath)
+	require.Positive(t, res.BackupResults[0].BundleSize)
+	require.Equal(t, 1, res.BackupResults[0].RefCount)
+	require.Positive(t, res.BackupResults[0].Duration)
+}
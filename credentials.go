@@ -0,0 +1,64 @@
+package githosts
+
+import (
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	// tokenUsername is the username given with tokens by hosts that only need the token.
+	tokenUsername     = "x-access-token"
+	envVarGitUsername = "GITHOSTS_GIT_USERNAME"
+	envVarGitPassword = "GITHOSTS_GIT_PASSWORD"
+	// credentialHelper answers git's requests for credentials using the environment,
+	// ignoring requests to store or erase them.
+	credentialHelper = `!f() { test "$1" = get && printf 'username=%s\npassword=%s\n' "$` + envVarGitUsername + `" "$` + envVarGitPassword + `"; }; f`
+)
+
+// gitCredentials authenticate git with the remote. Rather than being added to clone URLs,
+// where they'd be visible in process arguments, the mirror's config and git's output, they
+// are passed to git in its environment and provided by a credential helper.
+type gitCredentials struct {
+	username string
+	password string
+}
+
+// gitEnv returns the environment variables for git commands that contact the remote,
+// or nil if there are no credentials.
+func (c gitCredentials) gitEnv() []string {
+	if c.username == "" && c.password == "" {
+		return nil
+	}
+
+	return []string{
+		// set the helper as git config in the environment, so it's not in the process arguments
+		// or saved to the mirror's config, after removing any configured helpers
+		"GIT_CONFIG_COUNT=2",
+		"GIT_CONFIG_KEY_0=credential.helper",
+		"GIT_CONFIG_VALUE_0=",
+		"GIT_CONFIG_KEY_1=credential.helper",
+		"GIT_CONFIG_VALUE_1=" + credentialHelper,
+		// fail rather than prompt if the credentials are rejected
+		"GIT_TERMINAL_PROMPT=0",
+		envVarGitUsername + "=" + c.username,
+		envVarGitPassword + "=" + c.password,
+	}
+}
+
+// secrets returns the values to mask in errors and logs.
+func (c gitCredentials) secrets() []string {
+	return []string{c.password}
+}
+
+// maskError returns the error with any secrets in its message masked.
+func maskError(err errors.E, secrets []string) errors.E {
+	if err == nil {
+		return nil
+	}
+
+	masked := maskSecrets(err.Error(), secrets)
+	if masked == err.Error() {
+		return err
+	}
+
+	return errors.New(masked)
+}
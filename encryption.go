@@ -0,0 +1,274 @@
+package githosts
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"filippo.io/age"
+	"gitlab.com/tozd/go/errors"
+)
+
+// encrypted bundles are age files named <repo-name>.<timestamp>.bundle.age
+const (
+	ageExtension             = ".age"
+	encryptedBundleExtension = bundleExtension + ageExtension
+)
+
+// isBundleName returns true if the file name is that of a bundle, whether encrypted or not.
+func isBundleName(name string) bool {
+	return strings.HasSuffix(name, bundleExtension) || strings.HasSuffix(name, encryptedBundleExtension)
+}
+
+func isEncryptedBundle(bundlePath string) bool {
+	return strings.HasSuffix(bundlePath, encryptedBundleExtension)
+}
+
+// parseRecipients parses age recipients, such as age1... public keys.
+func parseRecipients(recipients []string) ([]age.Recipient, errors.E) {
+	rs, err := age.ParseRecipients(strings.NewReader(strings.Join(recipients, "\n")))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid encryption recipients")
+	}
+
+	return rs, nil
+}
+
+// parseIdentities parses age identities, such as AGE-SECRET-KEY-1... private keys.
+func parseIdentities(identities []string) ([]age.Identity, errors.E) {
+	ids, err := age.ParseIdentities(strings.NewReader(strings.Join(identities, "\n")))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid decryption identities")
+	}
+
+	return ids, nil
+}
+
+// bundleContent describes the unencrypted content of a bundle.
+type bundleContent struct {
+	sha256 []byte
+	size   int64
+	refs   gitRefs
+}
+
+// writeBundle streams the output of git bundle create to dst, encrypting it to any recipients, so the
+// unencrypted bundle is never written to disk. The bundle's hash, size, and refs are recorded
+// as it is written so they can be stored in its manifest. The git output is also returned.
+func writeBundle(ctx context.Context, dst io.Writer, workingPath string, revArgs []string, recipients []age.Recipient) (bundleContent, string, errors.E) {
+	out := dst
+
+	var encrypted io.WriteCloser
+
+	if len(recipients) > 0 {
+		var err error
+
+		if encrypted, err = age.Encrypt(dst, recipients...); err != nil {
+			return bundleContent{}, "", errors.Wrap(err, "failed to start encryption")
+		}
+
+		out = encrypted
+	}
+
+	hash := sha256.New()
+
+	var size countingWriter
+
+	var header bundleHeaderWriter
+
+	var bundleOut bytes.Buffer
+
+	bundleCmd := exec.CommandContext(ctx, "git", append([]string{"bundle", "create", "-"}, revArgs...)...)
+	bundleCmd.Dir = workingPath
+	bundleCmd.Stdout = io.MultiWriter(out, hash, &size, &header)
+	bundleCmd.Stderr = &bundleOut
+
+	if runErr := bundleCmd.Run(); runErr != nil {
+		return bundleContent{}, bundleOut.String(), errors.Wrap(runErr, "failed to create bundle")
+	}
+
+	if encrypted != nil {
+		if err := encrypted.Close(); err != nil {
+			return bundleContent{}, bundleOut.String(), errors.Wrap(err, "failed to finish encryption")
+		}
+	}
+
+	refs, refsErr := header.refs()
+	if refsErr != nil {
+		return bundleContent{}, bundleOut.String(), refsErr
+	}
+
+	return bundleContent{
+		sha256: hash.Sum(nil),
+		size:   int64(size),
+		refs:   refs,
+	}, bundleOut.String(), nil
+}
+
+// putBundle writes the bundle to the storage as it is created.
+func putBundle(ctx context.Context, store Storage, key, workingPath string, revArgs []string, recipients []age.Recipient) (bundleContent, string, errors.E) {
+	type result struct {
+		content bundleContent
+		out     string
+		err     errors.E
+	}
+
+	pr, pw := io.Pipe()
+
+	done := make(chan result, 1)
+
+	go func() {
+		content, out, err := writeBundle(ctx, pw, workingPath, revArgs, recipients)
+		if err != nil {
+			pw.CloseWithError(err)
+		} else {
+			pw.Close()
+		}
+
+		done <- result{content: content, out: out, err: err}
+	}()
+
+	putErr := store.Put(ctx, key, pr)
+
+	// stop the bundle being written if the storage stopped reading it
+	pr.Close()
+
+	res := <-done
+	if res.err != nil {
+		return bundleContent{}, res.out, res.err
+	}
+
+	if putErr != nil {
+		return bundleContent{}, res.out, putErr
+	}
+
+	return res.content, res.out, nil
+}
+
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+
+	return len(p), nil
+}
+
+// bundleHeaderWriter keeps the header of a bundle written to it, which ends with an empty line.
+type bundleHeaderWriter struct {
+	buf      bytes.Buffer
+	complete bool
+}
+
+func (h *bundleHeaderWriter) Write(p []byte) (int, error) {
+	if h.complete {
+		return len(p), nil
+	}
+
+	h.buf.Write(p)
+
+	if i := bytes.Index(h.buf.Bytes(), []byte("\n\n")); i >= 0 {
+		h.buf.Truncate(i + 1)
+		h.complete = true
+	}
+
+	return len(p), nil
+}
+
+// refs returns the refs listed in the header, as git bundle list-heads would.
+func (h *bundleHeaderWriter) refs() (gitRefs, errors.E) {
+	if !h.complete {
+		return nil, errors.New("failed to read bundle header")
+	}
+
+	var refLines []string
+
+	for _, line := range strings.Split(h.buf.String(), "\n") {
+		// skip the signature, capabilities, and prerequisites
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "@") || strings.HasPrefix(line, "-") {
+			continue
+		}
+
+		refLines = append(refLines, line)
+	}
+
+	refs, err := generateMapFromRefsCmdOutput([]byte(strings.Join(refLines, "\n")))
+	if err != nil {
+		return nil, errors.Errorf("failed to generate map from bundle header: %s", err)
+	}
+
+	return refs, nil
+}
+
+// localBundle returns the path of a file git can read the bundle from. Unencrypted bundles in
+// local storage are read in place, with others copied, and decrypted if necessary, to a
+// temporary file in dir. The returned function removes any temporary file.
+func localBundle(ctx context.Context, store Storage, key, dir string, identities []age.Identity) (string, func(), errors.E) {
+	if l, ok := store.(*LocalStorage); ok && !isEncryptedBundle(key) {
+		return l.Location(key), func() {}, nil
+	}
+
+	if isEncryptedBundle(key) && len(identities) == 0 {
+		return "", nil, errors.Errorf("no identities provided to decrypt bundle %s", key)
+	}
+
+	src, err := store.Get(ctx, key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer src.Close()
+
+	dst, createErr := os.CreateTemp(dir, "."+strings.TrimSuffix(path.Base(key), ageExtension)+".*")
+	if createErr != nil {
+		return "", nil, errors.Wrap(createErr, "failed to create local bundle")
+	}
+
+	cleanup := func() {
+		if rmErr := os.Remove(dst.Name()); rmErr != nil && !os.IsNotExist(rmErr) {
+			logger.Printf("failed to remove local bundle: %s: %s", dst.Name(), rmErr)
+		}
+	}
+
+	var r io.Reader = src
+
+	var copyErr error
+
+	if isEncryptedBundle(key) {
+		r, copyErr = age.Decrypt(src, identities...)
+	}
+
+	if copyErr == nil {
+		_, copyErr = io.Copy(dst, r)
+	}
+
+	if closeErr := dst.Close(); closeErr != nil && copyErr == nil {
+		copyErr = closeErr
+	}
+
+	if copyErr != nil {
+		cleanup()
+
+		if isEncryptedBundle(key) {
+			return "", nil, errors.Errorf("failed to decrypt bundle: %s: %s", key, copyErr)
+		}
+
+		return "", nil, errors.Errorf("failed to copy bundle: %s: %s", key, copyErr)
+	}
+
+	return dst.Name(), cleanup, nil
+}
+
+// validateRecipients checks any encryption recipients can be parsed.
+func validateRecipients(recipients []string) errors.E {
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	_, err := parseRecipients(recipients)
+
+	return err
+}
@@ -0,0 +1,208 @@
+package githosts
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedIncrementalBundles(t *testing.T) {
+	t.Parallel()
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	sourcePath := createTestGitRepo(t)
+	backupDir := t.TempDir()
+
+	in := processBackupInput{
+		repo:                 testRepository(sourcePath),
+		backupDir:            backupDir,
+		diffRemoteMethod:     cloneMethod,
+		incremental:          true,
+		encryptionRecipients: []string{identity.Recipient().String()},
+	}
+
+	full, backupErr := processBackup(context.Background(), in)
+	require.NoError(t, backupErr)
+	require.Equal(t, StatusCreated, full.status)
+	require.True(t, strings.HasSuffix(full.bundlePath, encryptedBundleExtension))
+	require.Equal(t, 1, full.refCount)
+
+	// the bundle cannot be read without decrypting it
+	_, refsErr := getBundleRefs(full.bundlePath)
+	require.Error(t, refsErr)
+
+	// bundle names have a timestamp with a resolution of one second
+	time.Sleep(time.Second)
+
+	addTestCommit(t, sourcePath, "second")
+
+	incremental, backupErr := processBackup(context.Background(), in)
+	require.NoError(t, backupErr)
+	require.Equal(t, StatusCreated, incremental.status)
+
+	manifest, found, manifestErr := readBundleManifest(context.Background(), localFiles, incremental.bundlePath)
+	require.NoError(t, manifestErr)
+	require.True(t, found)
+	require.Equal(t, filepath.Base(full.bundlePath), manifest.Parent)
+
+	// only the digests of the refs are readable without the identity
+	refs := gitRefs{
+		"refs/heads/" + gitOutput(t, sourcePath, "branch", "--show-current"): gitOutput(t, sourcePath, "rev-parse", "HEAD"),
+	}
+
+	require.Nil(t, manifest.Refs)
+	require.Empty(t, manifest.SHA256)
+	require.Equal(t, digestRefs(refs), manifest.RefDigests)
+
+	raw, readErr := os.ReadFile(manifestPath(incremental.bundlePath))
+	require.NoError(t, readErr)
+
+	for _, secret := range []string{"refs/heads/", gitOutput(t, sourcePath, "rev-parse", "HEAD"), sourcePath} {
+		require.NotContains(t, string(raw), secret)
+	}
+
+	_, openErr := manifest.open(nil)
+	require.Error(t, openErr)
+
+	manifest, openErr = manifest.open([]age.Identity{identity})
+	require.NoError(t, openErr)
+	require.Equal(t, refs, manifest.Refs)
+	require.NotEmpty(t, manifest.SHA256)
+	require.Equal(t, []string{gitOutput(t, sourcePath, "rev-parse", "HEAD~1")}, manifest.Prerequisites)
+
+	// the manifest describes the unencrypted bundle
+	targetDir := filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, ReconstructRepository(context.Background(), incremental.bundlePath, targetDir, identity.String()))
+	require.Equal(t, gitOutput(t, sourcePath, "rev-parse", "HEAD"), gitOutput(t, targetDir, "rev-parse", "HEAD"))
+
+	entries, readErr := os.ReadDir(filepath.Dir(incremental.bundlePath))
+	require.NoError(t, readErr)
+
+	for _, e := range entries {
+		require.False(t, strings.HasSuffix(e.Name(), bundleExtension), "unencrypted bundle %s written", e.Name())
+	}
+
+	// the refs are read from the manifest, so nothing is decrypted to find no changes
+	refsIn := in
+	refsIn.diffRemoteMethod = refsMethod
+
+	unchanged, backupErr := processBackup(context.Background(), refsIn)
+	require.NoError(t, backupErr)
+	require.Equal(t, StatusUnchanged, unchanged.status)
+	require.Equal(t, incremental.bundlePath, unchanged.bundlePath)
+
+	// bundles can only be verified and restored with the identity
+	report, verifyErr := Verify(context.Background(), VerifyInput{BackupDir: backupDir})
+	require.NoError(t, verifyErr)
+	require.Equal(t, 2, report.Unreadable)
+
+	report, verifyErr = Verify(context.Background(), VerifyInput{
+		BackupDir:            backupDir,
+		DecryptionIdentities: []string{identity.String()},
+	})
+	require.NoError(t, verifyErr)
+	require.Equal(t, 2, report.Healthy)
+
+	restoreIn := RestoreInput{
+		BackupDir:         backupDir,
+		Domain:            in.repo.Domain,
+		PathWithNameSpace: in.repo.PathWithNameSpace,
+		DestDir:           filepath.Join(t.TempDir(), "checkout"),
+	}
+
+	_, restoreErr := Restore(context.Background(), restoreIn)
+	require.ErrorContains(t, restoreErr, "no identities provided")
+
+	restoreIn.DecryptionIdentities = []string{identity.String()}
+
+	_, restoreErr = Restore(context.Background(), restoreIn)
+	require.NoError(t, restoreErr)
+	require.Equal(t, gitOutput(t, sourcePath, "rev-parse", "HEAD"), gitOutput(t, restoreIn.DestDir, "rev-parse", "HEAD"))
+}
+
+func TestEncryptedBundleDuplicatesAreRemoved(t *testing.T) {
+	t.Parallel()
+
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	in := processBackupInput{
+		repo:                 testRepository(createTestGitRepo(t)),
+		backupDir:            t.TempDir(),
+		diffRemoteMethod:     cloneMethod,
+		encryptionRecipients: []string{identity.Recipient().String()},
+	}
+
+	first, backupErr := processBackup(context.Background(), in)
+	require.NoError(t, backupErr)
+	require.Equal(t, StatusCreated, first.status)
+
+	time.Sleep(time.Second)
+
+	// encryption is not deterministic, so duplicates are found using the manifests
+	second, backupErr := processBackup(context.Background(), in)
+	require.NoError(t, backupErr)
+	require.Equal(t, StatusUnchanged, second.status)
+	require.Equal(t, first.bundlePath, second.bundlePath)
+
+	bfs, bfErr := getBundleFiles(context.Background(), localFiles, filepath.Dir(first.bundlePath))
+	require.NoError(t, bfErr)
+	require.Len(t, bfs, 1)
+}
+
+func TestEncryptedBundleNames(t *testing.T) {
+	t.Parallel()
+
+	ts, err := timeStampFromBundleName("repo0.20200401111111.bundle.age")
+	require.NoError(t, err)
+	require.Equal(t, "20200401111111", ts.Format(timeStampFormat))
+
+	tsPart, tsErr := getTimeStampPartFromFileName("repo0.20200401111111.bundle.age")
+	require.NoError(t, tsErr)
+	require.Equal(t, 20200401111111, tsPart)
+
+	require.True(t, isBundleName("repo0.20200401111111.bundle.age"))
+	require.False(t, isBundleName("repo0.20200401111111.bundle.age.manifest.json"))
+}
+
+func TestBundleHeaderRefs(t *testing.T) {
+	t.Parallel()
+
+	sha1 := strings.Repeat("a", 40)
+	sha2 := strings.Repeat("b", 40)
+
+	var h bundleHeaderWriter
+
+	// headers may be split across writes
+	for _, s := range []string{
+		"# v3 git bundle\n@object-format=sha1\n-" + sha1 + " prerequisite\n",
+		sha2 + " refs/heads/main\n" + sha2 + " HEAD",
+		"\n\nPACK",
+	} {
+		_, err := fmt.Fprint(&h, s)
+		require.NoError(t, err)
+	}
+
+	refs, err := h.refs()
+	require.NoError(t, err)
+	require.Equal(t, gitRefs{"refs/heads/main": sha2}, refs)
+}
+
+func TestNewGitHubHostWithInvalidRecipients(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewGitHubHost(NewGitHubHostInput{
+		BackupDir:     t.TempDir(),
+		BackupOptions: BackupOptions{EncryptionRecipients: []string{"invalid"}},
+	})
+	require.ErrorContains(t, err, "invalid encryption recipients")
+}
@@ -0,0 +1,91 @@
+package githosts
+
+import (
+	"context"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// EventType identifies a stage in a provider's backup run.
+type EventType string
+
+const (
+	EventListingStarted  EventType = "listing_started"
+	EventListingFinished EventType = "listing_finished"
+	EventRepoQueued      EventType = "repo_queued"
+	EventCloneStarted    EventType = "clone_started"
+	EventBundleWritten   EventType = "bundle_written"
+	EventRepoSkipped     EventType = "repo_skipped"
+	EventRepoFailed      EventType = "repo_failed"
+)
+
+// Event describes progress during a backup.
+type Event struct {
+	Type     EventType
+	Provider string
+	// Repo is the repository's PathWithNameSpace. It is empty for listing events.
+	Repo string
+	Time time.Time
+	// Duration is the time taken to list repositories, or the time spent on
+	// a repository for bundle written and repo failed events.
+	Duration time.Duration
+	// Bytes is the size of the bundle written.
+	Bytes int64
+	// Count is the number of repositories found when listing finishes.
+	Count int
+	// Reason explains why a repository was skipped.
+	Reason string
+	Error  errors.E
+}
+
+// Observer receives events as a backup progresses.
+// Events for different repositories are delivered concurrently, so implementations
+// must be safe for concurrent use and should return quickly.
+type Observer interface {
+	OnEvent(event Event)
+}
+
+// ObserverFunc allows a function to be used as an Observer.
+type ObserverFunc func(event Event)
+
+// OnEvent calls f(event).
+func (f ObserverFunc) OnEvent(event Event) {
+	f(event)
+}
+
+// notify sends the event to the observer, if one is set.
+func notify(observer Observer, event Event) {
+	if observer == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	observer.OnEvent(event)
+}
+
+// describeProviderRepos describes a provider's repositories, notifying the observer
+// when listing starts and finishes.
+func describeProviderRepos(ctx context.Context, p gitProvider, observer Observer) (describeReposOutput, errors.E) {
+	notify(observer, Event{
+		Type:     EventListingStarted,
+		Provider: p.Name(),
+	})
+
+	start := time.Now()
+
+	repoDesc, err := p.describeRepos(ctx)
+
+	notify(observer, Event{
+		Type:     EventListingFinished,
+		Provider: p.Name(),
+		Duration: time.Since(start),
+		Count:    len(repoDesc.Repos),
+		Error:    err,
+	})
+
+	return repoDesc, err
+}
@@ -0,0 +1,177 @@
+package githosts
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+)
+
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (o *recordingObserver) OnEvent(event Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.events = append(o.events, event)
+}
+
+func (o *recordingObserver) eventsFor(repo string) []Event {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var events []Event
+
+	for _, e := range o.events {
+		if e.Repo == repo {
+			events = append(events, e)
+		}
+	}
+
+	return events
+}
+
+type describingProvider struct {
+	testProvider
+	repos []repository
+	err   errors.E
+}
+
+func (p describingProvider) getAPIURL() string {
+	return ""
+}
+
+func (p describingProvider) diffRemoteMethod() string {
+	return cloneMethod
+}
+
+func (p describingProvider) describeRepos(_ context.Context) (describeReposOutput, errors.E) {
+	return describeReposOutput{Repos: p.repos}, p.err
+}
+
+func TestBackupReposNotifiesObserver(t *testing.T) {
+	t.Parallel()
+
+	sourcePath := createTestGitRepo(t)
+
+	kept := testRepository(sourcePath)
+	skipped := testRepository(sourcePath)
+	skipped.PathWithNameSpace = "go-soba/sandbox"
+	failed := testRepository(t.TempDir())
+	failed.PathWithNameSpace = "go-soba/missing"
+
+	observer := &recordingObserver{}
+
+	res := backupRepos(context.Background(), []repository{kept, skipped, failed}, 2, processBackupInput{
+		backupDir:        t.TempDir(),
+		diffRemoteMethod: cloneMethod,
+		filter:           RepositoryFilter{Exclude: []string{"sandbox"}},
+		observer:         observer,
+		provider:         "test",
+	})
+	require.NoError(t, res.Error)
+
+	keptEvents := observer.eventsFor(kept.PathWithNameSpace)
+	require.Len(t, keptEvents, 3)
+	require.Equal(t, EventRepoQueued, keptEvents[0].Type)
+	require.Equal(t, EventCloneStarted, keptEvents[1].Type)
+	require.Equal(t, EventBundleWritten, keptEvents[2].Type)
+	require.Equal(t, "test", keptEvents[2].Provider)
+	require.Positive(t, keptEvents[2].Bytes)
+	require.Positive(t, keptEvents[2].Duration)
+
+	skippedEvents := observer.eventsFor(skipped.PathWithNameSpace)
+	require.Len(t, skippedEvents, 1)
+	require.Equal(t, EventRepoSkipped, skippedEvents[0].Type)
+	require.Equal(t, "excluded by pattern sandbox", skippedEvents[0].Reason)
+
+	failedEvents := observer.eventsFor(failed.PathWithNameSpace)
+	require.Len(t, failedEvents, 3)
+	require.Equal(t, EventRepoFailed, failedEvents[2].Type)
+	require.Error(t, failedEvents[2].Error)
+}
+
+func TestBackupReposNotifiesQueuedFirst(t *testing.T) {
+	t.Parallel()
+
+	sourcePath := createTestGitRepo(t)
+
+	var repos []repository
+
+	for _, name := range []string{"repo0", "repo1", "repo2"} {
+		repo := testRepository(sourcePath)
+		repo.Name = name
+		repo.PathWithNameSpace = "go-soba/" + name
+
+		repos = append(repos, repo)
+	}
+
+	observer := &recordingObserver{}
+
+	// slow observers give workers the chance to start jobs before they're reported as queued
+	slowObserver := ObserverFunc(func(event Event) {
+		if event.Type == EventRepoQueued {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		observer.OnEvent(event)
+	})
+
+	res := backupRepos(context.Background(), repos, len(repos), processBackupInput{
+		backupDir:        t.TempDir(),
+		diffRemoteMethod: cloneMethod,
+		observer:         slowObserver,
+		provider:         "test",
+	})
+	require.NoError(t, res.Error)
+
+	for _, repo := range repos {
+		events := observer.eventsFor(repo.PathWithNameSpace)
+		require.NotEmpty(t, events)
+		require.Equal(t, EventRepoQueued, events[0].Type, repo.PathWithNameSpace)
+	}
+}
+
+func TestDescribeProviderReposNotifiesObserver(t *testing.T) {
+	t.Parallel()
+
+	observer := &recordingObserver{}
+
+	p := describingProvider{
+		testProvider: testProvider{},
+		repos:        []repository{{Name: "repo0", PathWithNameSpace: "go-soba/repo0"}},
+	}
+
+	repoDesc, err := describeProviderRepos(context.Background(), p, observer)
+	require.NoError(t, err)
+	require.Len(t, repoDesc.Repos, 1)
+
+	require.Len(t, observer.events, 2)
+	require.Equal(t, EventListingStarted, observer.events[0].Type)
+	require.Equal(t, EventListingFinished, observer.events[1].Type)
+	require.Equal(t, "Test", observer.events[1].Provider)
+	require.Equal(t, 1, observer.events[1].Count)
+	require.NoError(t, observer.events[1].Error)
+}
+
+func TestObserverFunc(t *testing.T) {
+	t.Parallel()
+
+	var received Event
+
+	notify(ObserverFunc(func(e Event) {
+		received = e
+	}), Event{Type: EventRepoQueued})
+
+	require.Equal(t, EventRepoQueued, received.Type)
+	require.False(t, received.Time.IsZero())
+
+	// a nil observer is ignored
+	notify(nil, Event{Type: EventRepoQueued})
+}
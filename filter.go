@@ -0,0 +1,211 @@
+package githosts
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// regexPatternPrefix marks a filter pattern as a regular expression rather than a glob.
+const regexPatternPrefix = "re:"
+
+// RepositoryFilter selects the repositories to back up by matching patterns
+// against each repository's PathWithNameSpace, e.g. my-org/my-repo.
+//
+// Patterns are globs unless prefixed with "re:", in which case the remainder is
+// a regular expression matched against the full path. Globs containing a slash
+// are matched against the full path, whereas those without one are matched
+// against the repository name, so "team-*" matches my-org/team-api.
+type RepositoryFilter struct {
+	// Include limits backups to repositories matching at least one pattern.
+	// All repositories are included if none are specified.
+	Include []string
+	// Exclude skips repositories matching any pattern, taking precedence over Include.
+	Exclude []string
+	// IgnoreFile is the path of a file of exclude patterns, one per line.
+	// Empty lines and those starting with # are ignored.
+	IgnoreFile string
+}
+
+type repoPattern struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+func (p repoPattern) match(pathWithNameSpace string) bool {
+	if p.re != nil {
+		return p.re.MatchString(pathWithNameSpace)
+	}
+
+	subject := pathWithNameSpace
+	if !strings.Contains(p.pattern, "/") {
+		subject = path.Base(pathWithNameSpace)
+	}
+
+	// patterns are validated when compiled, so errors cannot occur
+	matched, _ := path.Match(p.pattern, subject)
+
+	return matched
+}
+
+type repoFilter struct {
+	include []repoPattern
+	exclude []repoPattern
+}
+
+func compileRepoPatterns(patterns []string) ([]repoPattern, errors.E) {
+	var compiled []repoPattern
+
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		if strings.HasPrefix(pattern, regexPatternPrefix) {
+			re, err := regexp.Compile(strings.TrimPrefix(pattern, regexPatternPrefix))
+			if err != nil {
+				return nil, errors.Errorf("invalid regular expression in pattern %s: %s", pattern, err)
+			}
+
+			compiled = append(compiled, repoPattern{pattern: pattern, re: re})
+
+			continue
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Errorf("invalid glob pattern %s: %s", pattern, err)
+		}
+
+		compiled = append(compiled, repoPattern{pattern: pattern})
+	}
+
+	return compiled, nil
+}
+
+func readIgnoreFile(ignoreFile string) ([]string, errors.E) {
+	f, err := os.Open(ignoreFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open ignore file %s", ignoreFile)
+	}
+
+	defer f.Close()
+
+	var patterns []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		patterns = append(patterns, line)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read ignore file %s", ignoreFile)
+	}
+
+	return patterns, nil
+}
+
+func (f RepositoryFilter) compile() (*repoFilter, errors.E) {
+	include, err := compileRepoPatterns(f.Include)
+	if err != nil {
+		return nil, err
+	}
+
+	excludePatterns := f.Exclude
+
+	if f.IgnoreFile != "" {
+		var ignored []string
+
+		ignored, err = readIgnoreFile(f.IgnoreFile)
+		if err != nil {
+			return nil, err
+		}
+
+		excludePatterns = append(append([]string{}, excludePatterns...), ignored...)
+	}
+
+	exclude, err := compileRepoPatterns(excludePatterns)
+	if err != nil {
+		return nil, err
+	}
+
+	return &repoFilter{
+		include: include,
+		exclude: exclude,
+	}, nil
+}
+
+// isZero reports whether the filter has no patterns or ignore file.
+func (f RepositoryFilter) isZero() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0 && f.IgnoreFile == ""
+}
+
+// Validate checks the filter's patterns and ignore file.
+func (f RepositoryFilter) Validate() error {
+	if _, err := f.compile(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// skipReason returns why a repository is filtered out, or an empty string if it should be backed up.
+func (rf *repoFilter) skipReason(pathWithNameSpace string) string {
+	for _, p := range rf.exclude {
+		if p.match(pathWithNameSpace) {
+			return "excluded by pattern " + p.pattern
+		}
+	}
+
+	if len(rf.include) == 0 {
+		return ""
+	}
+
+	for _, p := range rf.include {
+		if p.match(pathWithNameSpace) {
+			return ""
+		}
+	}
+
+	return "not matched by any include pattern"
+}
+
+// filterRepos splits repositories into those to back up and results for those skipped by the filter.
+func filterRepos(repos []repository, filter RepositoryFilter) ([]repository, []RepoBackupResults, errors.E) {
+	rf, err := filter.compile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		kept    []repository
+		skipped []RepoBackupResults
+	)
+
+	for _, repo := range repos {
+		if reason := rf.skipReason(repo.PathWithNameSpace); reason != "" {
+			logger.Printf("skipping %s: %s", repo.PathWithNameSpace, reason)
+
+			skipped = append(skipped, RepoBackupResults{
+				Repo:   repo.PathWithNameSpace,
+				Status: StatusSkippedFiltered,
+				Reason: reason,
+			})
+
+			continue
+		}
+
+		kept = append(kept, repo)
+	}
+
+	return kept, skipped, nil
+}
@@ -0,0 +1,101 @@
+package githosts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepositoryFilterSkipReason(t *testing.T) {
+	t.Parallel()
+
+	rf, err := RepositoryFilter{
+		Include: []string{"team-*", "go-soba/*"},
+		Exclude: []string{"re:sandbox$", "go-soba/private"},
+	}.compile()
+	require.NoError(t, err)
+
+	require.Empty(t, rf.skipReason("my-org/team-api"))
+	require.Empty(t, rf.skipReason("go-soba/repo0"))
+	require.Equal(t, "excluded by pattern re:sandbox$", rf.skipReason("my-org/team-sandbox"))
+	require.Equal(t, "excluded by pattern go-soba/private", rf.skipReason("go-soba/private"))
+	require.Equal(t, "not matched by any include pattern", rf.skipReason("my-org/other"))
+	// globs with a slash must match the full path
+	require.Equal(t, "not matched by any include pattern", rf.skipReason("go-soba/sub/repo1"))
+}
+
+func TestRepositoryFilterWithoutPatternsIncludesAll(t *testing.T) {
+	t.Parallel()
+
+	rf, err := RepositoryFilter{}.compile()
+	require.NoError(t, err)
+	require.Empty(t, rf.skipReason("my-org/anything"))
+}
+
+func TestRepositoryFilterIgnoreFile(t *testing.T) {
+	t.Parallel()
+
+	ignoreFile := filepath.Join(t.TempDir(), "ignore")
+	require.NoError(t, os.WriteFile(ignoreFile, []byte("# noisy repos\n\nsandbox\nre:^archive/\n"), 0o600))
+
+	rf, err := RepositoryFilter{IgnoreFile: ignoreFile}.compile()
+	require.NoError(t, err)
+
+	require.Equal(t, "excluded by pattern sandbox", rf.skipReason("my-org/sandbox"))
+	require.Equal(t, "excluded by pattern re:^archive/", rf.skipReason("archive/old"))
+	require.Empty(t, rf.skipReason("my-org/app"))
+}
+
+func TestRepositoryFilterValidate(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, RepositoryFilter{Include: []string{"team-*"}}.Validate())
+	require.Error(t, RepositoryFilter{Include: []string{"team-["}}.Validate())
+	require.Error(t, RepositoryFilter{Exclude: []string{"re:("}}.Validate())
+	require.Error(t, RepositoryFilter{IgnoreFile: filepath.Join(t.TempDir(), "missing")}.Validate())
+}
+
+func TestNewHostWithInvalidFilter(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewGitHubHost(NewGitHubHostInput{
+		BackupDir:     t.TempDir(),
+		Token:         "test-token",
+		BackupOptions: BackupOptions{Filter: RepositoryFilter{Include: []string{"re:["}}},
+	})
+	require.Error(t, err)
+}
+
+func TestBackupReposReportsFilteredRepos(t *testing.T) {
+	t.Parallel()
+
+	sourcePath := createTestGitRepo(t)
+
+	kept := testRepository(sourcePath)
+	skipped := testRepository(sourcePath)
+	skipped.Name = "sandbox"
+	skipped.PathWithNameSpace = "go-soba/sandbox"
+
+	backupDir := t.TempDir()
+
+	res := backupRepos(context.Background(), []repository{kept, skipped}, 1, processBackupInput{
+		backupDir:        backupDir,
+		diffRemoteMethod: cloneMethod,
+		filter:           RepositoryFilter{Exclude: []string{"sandbox"}},
+	})
+	require.NoError(t, res.Error)
+	require.Len(t, res.BackupResults, 2)
+
+	statuses := map[string]RepoBackupResults{}
+	for _, r := range res.BackupResults {
+		statuses[r.Repo] = r
+	}
+
+	require.Equal(t, StatusCreated, statuses[kept.PathWithNameSpace].Status)
+	require.Equal(t, StatusSkippedFiltered, statuses[skipped.PathWithNameSpace].Status)
+	require.Equal(t, "excluded by pattern sandbox", statuses[skipped.PathWithNameSpace].Reason)
+	require.NoDirExists(t, filepath.Join(backupDir, skipped.Domain, "go-soba", "sandbox"))
+}
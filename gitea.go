@@ -11,6 +11,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gitlab.com/tozd/go/errors"
@@ -30,9 +31,32 @@ const (
 	giteaMatchByExact                = "exact"
 	giteaMatchByIfDefined            = "anyDefined"
 	giteaProviderName                = "Gitea"
+	giteaPageSizeDefault             = 50
 	txtNext                          = "next"
+
+	// rate limited requests are retried with exponential backoff unless the server says when to retry
+	giteaRateLimitRetries = 5
+	giteaRateLimitWaitMin = 5 * time.Second
+	giteaRateLimitWaitMax = 5 * time.Minute
+
+	// flavours of server speaking the Gitea API
+	GiteaFlavourGitea   = "gitea"
+	GiteaFlavourForgejo = "forgejo"
+
+	// CodebergAPIURL is the API URL of Codeberg, a public Forgejo instance.
+	CodebergAPIURL = "https://codeberg.org/api/v1"
 )
 
+// GiteaServer describes the server behind a Gitea API URL.
+type GiteaServer struct {
+	// Flavour is GiteaFlavourGitea or GiteaFlavourForgejo.
+	Flavour string
+	// Version is the server's version, such as 1.22.3 for Gitea or 9.0.3+gitea-1.22.0 for Forgejo.
+	Version string
+	// MaxPageSize is the most items the server returns in a page.
+	MaxPageSize int
+}
+
 type NewGiteaHostInput struct {
 	Caller           string
 	HTTPClient       *retryablehttp.Client
@@ -43,6 +67,13 @@ type NewGiteaHostInput struct {
 	Orgs             []string
 	BackupsToRetain  int
 	LogLevel         int
+	BackupOptions
+	// AdminCrawl backs up the repositories of every user, which requires a site admin token.
+	// Otherwise, the authenticated user's own repositories and those of the organizations
+	// they belong to are backed up.
+	AdminCrawl bool
+	// Users are the users whose repositories are also backed up.
+	Users []string
 }
 
 type GiteaHost struct {
@@ -55,6 +86,14 @@ type GiteaHost struct {
 	Token            string
 	Orgs             []string
 	LogLevel         int
+	BackupOptions
+	AdminCrawl bool
+	Users      []string
+
+	serverMu sync.Mutex
+	server   *GiteaServer
+	// serverErr is the failure to detect the server, kept until the next listing or backup
+	serverErr errors.E
 }
 
 func NewGiteaHost(input NewGiteaHostInput) (*GiteaHost, error) {
@@ -76,9 +115,14 @@ func NewGiteaHost(input NewGiteaHostInput) (*GiteaHost, error) {
 		logger.Print("using diff remote method: " + diffRemoteMethod)
 	}
 
+	if err = input.validate(input.BackupsToRetain); err != nil {
+		return nil, err
+	}
+
 	httpClient := input.HTTPClient
 	if httpClient == nil {
 		httpClient = getHTTPClient()
+		httpClient.CheckRetry = giteaCheckRetry
 	}
 
 	return &GiteaHost{
@@ -90,6 +134,9 @@ func NewGiteaHost(input NewGiteaHostInput) (*GiteaHost, error) {
 		Token:            input.Token,
 		Orgs:             input.Orgs,
 		LogLevel:         input.LogLevel,
+		BackupOptions:    input.BackupOptions,
+		AdminCrawl:       input.AdminCrawl,
+		Users:            input.Users,
 	}, nil
 }
 
@@ -120,8 +167,54 @@ type (
 	giteaGetOrganizationsResponse []giteaOrganization
 )
 
-func (g *GiteaHost) makeGiteaRequest(reqUrl string) (*http.Response, []byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultHttpRequestTimeout)
+// makeGiteaRequest requests reqUrl, waiting and retrying whilst the server's rate limit is exceeded.
+func (g *GiteaHost) makeGiteaRequest(ctx context.Context, reqUrl string) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		resp, body, err := g.makeGiteaRequestOnce(ctx, reqUrl)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt == giteaRateLimitRetries {
+			return resp, body, err
+		}
+
+		wait := giteaRetryAfter(resp.Header, attempt)
+
+		logger.Printf("%s rate limit exceeded, retrying in %s", giteaProviderName, wait)
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("failed to request %s: %w", reqUrl, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+}
+
+// giteaRetryAfter returns how long to wait before retrying a rate limited request, using the
+// response's Retry-After header if set, or otherwise backing off exponentially.
+func giteaRetryAfter(header http.Header, attempt int) time.Duration {
+	if v := header.Get("Retry-After"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+			return min(time.Duration(seconds)*time.Second, giteaRateLimitWaitMax)
+		}
+
+		if at, err := http.ParseTime(v); err == nil {
+			return min(max(time.Until(at), 0), giteaRateLimitWaitMax)
+		}
+	}
+
+	return min(giteaRateLimitWaitMin<<attempt, giteaRateLimitWaitMax)
+}
+
+// giteaCheckRetry leaves rate limited requests to makeGiteaRequest, retrying others as the
+// default client would.
+func giteaCheckRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if err == nil && resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		return false, nil
+	}
+
+	return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+}
+
+func (g *GiteaHost) makeGiteaRequestOnce(ctx context.Context, reqUrl string) (*http.Response, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultHttpRequestTimeout)
 	defer cancel()
 
 	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, reqUrl, nil)
@@ -150,6 +243,122 @@ func (g *GiteaHost) makeGiteaRequest(reqUrl string) (*http.Response, []byte, err
 	return resp, body, err
 }
 
+type giteaVersionResponse struct {
+	Version string `json:"version"`
+}
+
+type giteaAPISettingsResponse struct {
+	MaxResponseItems int `json:"max_response_items"`
+}
+
+// Server detects the flavour and version of the server using its /version endpoint.
+// The result is cached once detected. A failure is cached until the next listing or
+// backup of repositories, so each page requested doesn't wait for detection to fail again.
+func (g *GiteaHost) Server(ctx context.Context) (GiteaServer, errors.E) {
+	g.serverMu.Lock()
+	defer g.serverMu.Unlock()
+
+	if g.server != nil {
+		return *g.server, nil
+	}
+
+	if g.serverErr != nil {
+		return GiteaServer{}, g.serverErr
+	}
+
+	server, err := g.detectServer(ctx)
+	if err != nil {
+		g.serverErr = err
+
+		return GiteaServer{}, err
+	}
+
+	g.server = &server
+
+	return server, nil
+}
+
+// retryServerDetection forgets any failure to detect the server, so it's detected again.
+func (g *GiteaHost) retryServerDetection() {
+	g.serverMu.Lock()
+	defer g.serverMu.Unlock()
+
+	g.serverErr = nil
+}
+
+func (g *GiteaHost) detectServer(ctx context.Context) (GiteaServer, errors.E) {
+	resp, body, err := g.makeGiteaRequest(ctx, g.APIURL+"/version")
+	if err != nil {
+		return GiteaServer{}, errors.Errorf("failed to get server version: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return GiteaServer{}, errors.Errorf("failed to get server version: %s", resp.Status)
+	}
+
+	var version giteaVersionResponse
+
+	if uErr := json.Unmarshal(body, &version); uErr != nil {
+		return GiteaServer{}, errors.Wrap(uErr, "failed to unmarshal Gitea version response")
+	}
+
+	if version.Version == "" {
+		return GiteaServer{}, errors.New("failed to get server version: no version returned")
+	}
+
+	server := GiteaServer{
+		Flavour:     giteaFlavour(version.Version),
+		Version:     version.Version,
+		MaxPageSize: giteaPageSizeDefault,
+	}
+
+	// the page size is capped by the server's MAX_RESPONSE_ITEMS setting
+	resp, body, err = g.makeGiteaRequest(ctx, g.APIURL+"/settings/api")
+	if err == nil && resp.StatusCode == http.StatusOK {
+		var settings giteaAPISettingsResponse
+
+		if uErr := json.Unmarshal(body, &settings); uErr == nil && settings.MaxResponseItems > 0 {
+			server.MaxPageSize = settings.MaxResponseItems
+		}
+	}
+
+	if g.LogLevel > 0 {
+		logger.Printf("detected %s server version %s", server.Flavour, server.Version)
+	}
+
+	return server, nil
+}
+
+// giteaFlavour returns the flavour of server reporting the version.
+// Forgejo reports the Gitea version it's compatible with as build metadata, e.g. 9.0.3+gitea-1.22.0.
+func giteaFlavour(version string) string {
+	v := strings.ToLower(version)
+	if strings.Contains(v, "+gitea-") || strings.Contains(v, "forgejo") {
+		return GiteaFlavourForgejo
+	}
+
+	return GiteaFlavourGitea
+}
+
+// setPageSize sets the page size of a paginated request. Gitea and Forgejo page with limit,
+// so servers that are detected are asked for their largest pages. Otherwise, per_page is
+// also set for older or other servers speaking the API.
+func (g *GiteaHost) setPageSize(ctx context.Context, q url.Values, perPage, limit int) {
+	server, err := g.Server(ctx)
+	if err != nil {
+		if g.LogLevel > 0 {
+			logger.Printf("failed to detect %s server: %s", giteaProviderName, err)
+		}
+
+		q.Set("per_page", strconv.Itoa(perPage))
+		q.Set("limit", strconv.Itoa(limit))
+
+		return
+	}
+
+	q.Set("limit", strconv.Itoa(server.MaxPageSize))
+}
+
 type repoExistsInput struct {
 	matchBy           string // anyDefined, allDefined, exact
 	repos             []repository
@@ -159,8 +368,6 @@ type repoExistsInput struct {
 	domain            string
 	httpsUrl          string
 	sshUrl            string
-	urlWithToken      string
-	urlWithBasicAuth  string
 	logLevel          int
 }
 
@@ -218,14 +425,11 @@ func repoExists(in repoExistsInput) bool {
 		domainMatch := in.domain == r.Domain
 		cloneUrlMatch := in.httpsUrl == r.HTTPSUrl
 		sshUrlMatch := in.sshUrl == r.SSHUrl
-		urlWithTokenMatch := in.urlWithToken == r.URLWithToken
-		urlWithBasicAuthMatch := in.urlWithBasicAuth == r.URLWithBasicAuth
 		pathWithNamespaceMatch := in.pathWithNamespace == r.PathWithNameSpace
 
 		switch in.matchBy {
 		case giteaMatchByExact:
-			if allTrue(nameMatch, domainMatch, ownerMatch, cloneUrlMatch, sshUrlMatch, urlWithTokenMatch,
-				urlWithBasicAuthMatch, pathWithNamespaceMatch) {
+			if allTrue(nameMatch, domainMatch, ownerMatch, cloneUrlMatch, sshUrlMatch, pathWithNamespaceMatch) {
 				return true
 			}
 
@@ -244,10 +448,6 @@ func repoExists(in repoExistsInput) bool {
 				continue
 			case in.sshUrl != "" && !sshUrlMatch:
 				continue
-			case in.urlWithToken != "" && !urlWithTokenMatch:
-				continue
-			case in.urlWithBasicAuth != "" && !urlWithBasicAuthMatch:
-				continue
 			case in.pathWithNamespace != "" && !pathWithNamespaceMatch:
 				continue
 			default:
@@ -332,32 +532,215 @@ func organisationExists(in organizationExistsInput) bool {
 	return false
 }
 
-func (g *GiteaHost) describeRepos() (describeReposOutput, errors.E) {
+func (g *GiteaHost) describeRepos(ctx context.Context) (describeReposOutput, errors.E) {
 	logger.Println("listing repositories")
 
-	userRepos, err := g.getAllUserRepositories()
-	if err != nil {
-		return describeReposOutput{}, errors.Errorf("failed to get user repositories: %s", err)
+	// a server that couldn't be detected during an earlier listing may now be available
+	g.retryServerDetection()
+
+	var (
+		userRepos  []repository
+		memberOrgs []giteaOrganization
+		err        errors.E
+	)
+
+	if g.AdminCrawl {
+		userRepos, err = g.getAllUserRepositories(ctx)
+		if err != nil {
+			return describeReposOutput{}, errors.Errorf("failed to get user repositories: %s", err)
+		}
+	} else {
+		userRepos, err = g.getAuthenticatedUserRepos(ctx)
+		if err != nil {
+			return describeReposOutput{}, errors.Errorf("failed to get authenticated user's repositories: %s", err)
+		}
+
+		memberOrgs, err = g.getMemberOrganizations(ctx)
+		if err != nil {
+			return describeReposOutput{}, errors.Errorf("failed to get authenticated user's organizations: %s", err)
+		}
 	}
 
-	orgs, err := g.getOrganizations()
+	for _, user := range g.Users {
+		var repos []repository
+
+		repos, err = g.getAllUserRepos(ctx, user)
+		if err != nil {
+			return describeReposOutput{}, errors.Errorf("failed to get user %s repositories: %s", user, err)
+		}
+
+		userRepos = append(userRepos, repos...)
+	}
+
+	orgs, err := g.getOrganizations(ctx)
 	if err != nil {
 		return describeReposOutput{}, errors.Errorf("failed to get organizations: %s", err)
 	}
 
+	// organizations may be both specified and a membership
+	for _, org := range memberOrgs {
+		if !organisationExists(organizationExistsInput{
+			matchBy:       giteaMatchByIfDefined,
+			organizations: orgs,
+			name:          org.Name,
+		}) {
+			orgs = append(orgs, org)
+		}
+	}
+
 	var orgsRepos []repository
 	if len(orgs) > 0 {
-		orgsRepos, err = g.getOrganizationsRepos(orgs)
+		orgsRepos, err = g.getOrganizationsRepos(ctx, orgs)
 		if err != nil {
 			return describeReposOutput{}, errors.Errorf("failed to get organizations repos: %s", err)
 		}
 	}
 
 	return describeReposOutput{
-		Repos: append(userRepos, orgsRepos...),
+		Repos: removeDuplicates(append(userRepos, orgsRepos...)),
 	}, nil
 }
 
+// getAuthenticatedUser returns the user the token belongs to.
+func (g *GiteaHost) getAuthenticatedUser(ctx context.Context) (giteaUser, errors.E) {
+	resp, body, err := g.makeGiteaRequest(ctx, g.APIURL+"/user")
+	if err != nil {
+		return giteaUser{}, errors.Wrap(err, "failed to make Gitea request")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return giteaUser{}, errors.Errorf("failed to get authenticated user with unexpected response: %d (%s)", resp.StatusCode, resp.Status)
+	}
+
+	var user giteaUser
+
+	if err = json.Unmarshal(body, &user); err != nil {
+		return giteaUser{}, errors.Wrap(err, "failed to unmarshal authenticated user json response")
+	}
+
+	return user, nil
+}
+
+// getAuthenticatedUserRepos returns the repositories owned by the authenticated user,
+// without needing a site admin token.
+func (g *GiteaHost) getAuthenticatedUserRepos(ctx context.Context) ([]repository, errors.E) {
+	user, err := g.getAuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Printf("retrieving repositories for authenticated user %s", user.Login)
+
+	var repos []repository
+
+	if err = g.getPaged(ctx, g.APIURL+"/user/repos", giteaReposPerPageDefault, giteaReposLimit, "repos", func(body []byte) errors.E {
+		var respObj []giteaRepository
+
+		if uErr := json.Unmarshal(body, &respObj); uErr != nil {
+			return errors.Wrap(uErr, "failed to unmarshal user repos json response")
+		}
+
+		for _, r := range respObj {
+			// the user may also collaborate on others' repositories
+			if r.Owner.Login != user.Login {
+				continue
+			}
+
+			ru, pErr := url.Parse(r.CloneUrl)
+			if pErr != nil {
+				return errors.Wrap(pErr, fmt.Sprintf("failed to parse clone url for: %s", r.CloneUrl))
+			}
+
+			repos = append(repos, r.repository(ru.Host))
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return repos, nil
+}
+
+// getMemberOrganizations returns the organizations the authenticated user belongs to.
+func (g *GiteaHost) getMemberOrganizations(ctx context.Context) ([]giteaOrganization, errors.E) {
+	logger.Printf("retrieving organizations for authenticated user")
+
+	var organizations []giteaOrganization
+
+	if err := g.getPaged(ctx, g.APIURL+"/user/orgs", giteaOrganizationsPerPageDefault, giteaOrganizationsLimit, "organizations", func(body []byte) errors.E {
+		var respObj giteaGetOrganizationsResponse
+
+		if uErr := json.Unmarshal(body, &respObj); uErr != nil {
+			return errors.Wrap(uErr, "failed to unmarshal Gitea response")
+		}
+
+		organizations = append(organizations, respObj...)
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return organizations, nil
+}
+
+// getPaged requests reqUrl and each following page, passing each page's body to fn.
+// The description, such as "repos", is used in logs and errors.
+func (g *GiteaHost) getPaged(ctx context.Context, reqUrl string, perPage, limit int, description string, fn func(body []byte) errors.E) errors.E {
+	u, err := url.Parse(reqUrl)
+	if err != nil {
+		return errors.Errorf("failed to parse get %s URL %s: %s", description, reqUrl, err)
+	}
+
+	q := u.Query()
+	// set initial max per page
+	g.setPageSize(ctx, q, perPage, limit)
+	u.RawQuery = q.Encode()
+
+	reqUrl = u.String()
+
+	for reqUrl != "" {
+		resp, body, rErr := g.makeGiteaRequest(ctx, reqUrl)
+		if rErr != nil {
+			return errors.Errorf("failed to make Gitea request: %s", rErr)
+		}
+
+		if g.LogLevel > 0 {
+			logger.Print(string(body))
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			if g.LogLevel > 0 {
+				logger.Printf("%s retrieved successfully", description)
+			}
+		case http.StatusForbidden:
+			logger.Printf("failed to get %s due to invalid or missing credentials (HTTP 403)", description)
+
+			return errors.Errorf("failed to get %s due to invalid or missing credentials (HTTP 403)", description)
+		default:
+			logger.Printf("failed to get %s with unexpected response: %d (%s)", description, resp.StatusCode, resp.Status)
+
+			return errors.Errorf("failed to get %s with unexpected response: %d (%s)", description, resp.StatusCode, resp.Status)
+		}
+
+		if fErr := fn(body); fErr != nil {
+			return fErr
+		}
+
+		reqUrl = ""
+
+		for _, l := range link.ParseResponse(resp) {
+			if l.Rel == txtNext {
+				reqUrl = l.URI
+			}
+		}
+	}
+
+	return nil
+}
+
 func extractDomainFromAPIUrl(apiUrl string) string {
 	u, err := url.Parse(apiUrl)
 	if err != nil {
@@ -367,7 +750,7 @@ func extractDomainFromAPIUrl(apiUrl string) string {
 	return u.Hostname()
 }
 
-func (g *GiteaHost) getOrganizationsRepos(organizations []giteaOrganization) ([]repository, errors.E) {
+func (g *GiteaHost) getOrganizationsRepos(ctx context.Context, organizations []giteaOrganization) ([]repository, errors.E) {
 	domain := extractDomainFromAPIUrl(g.APIURL)
 
 	var repos []repository
@@ -377,27 +760,20 @@ func (g *GiteaHost) getOrganizationsRepos(organizations []giteaOrganization) ([]
 			logger.Printf("getting repositories from gitea organization %s", org.Name)
 		}
 
-		orgRepos, err := g.getOrganizationRepos(org.Name)
+		orgRepos, err := g.getOrganizationRepos(ctx, org.Name)
 		if err != nil {
 			return nil, errors.Errorf("failed to get organization %s repos: %s", org.Name, err)
 		}
 
 		for _, orgRepo := range orgRepos {
-			repos = append(repos, repository{
-				Name:              orgRepo.Name,
-				Owner:             orgRepo.Owner.Login,
-				HTTPSUrl:          orgRepo.CloneUrl,
-				SSHUrl:            orgRepo.SshUrl,
-				PathWithNameSpace: orgRepo.FullName,
-				Domain:            domain,
-			})
+			repos = append(repos, orgRepo.repository(domain))
 		}
 	}
 
 	return repos, nil
 }
 
-func (g *GiteaHost) getAllUsers() ([]giteaUser, errors.E) {
+func (g *GiteaHost) getAllUsers(ctx context.Context) ([]giteaUser, errors.E) {
 	if strings.TrimSpace(g.APIURL) == "" {
 		g.APIURL = gitlabAPIURL
 	}
@@ -417,8 +793,7 @@ func (g *GiteaHost) getAllUsers() ([]giteaUser, errors.E) {
 
 	q := u.Query()
 	// set initial max per page
-	q.Set("per_page", strconv.Itoa(giteaUsersPerPageDefault))
-	q.Set("limit", strconv.Itoa(giteaUsersLimit))
+	g.setPageSize(ctx, q, giteaUsersPerPageDefault, giteaUsersLimit)
 	u.RawQuery = q.Encode()
 
 	var body []byte
@@ -430,7 +805,7 @@ func (g *GiteaHost) getAllUsers() ([]giteaUser, errors.E) {
 	for {
 		var resp *http.Response
 
-		resp, body, err = g.makeGiteaRequest(reqUrl)
+		resp, body, err = g.makeGiteaRequest(ctx, reqUrl)
 		if err != nil {
 			logger.Printf("failed to get users: %v", err)
 
@@ -449,11 +824,11 @@ func (g *GiteaHost) getAllUsers() ([]giteaUser, errors.E) {
 		case http.StatusForbidden:
 			logger.Println("failed to get users due to invalid or missing credentials (HTTP 403)")
 
-			return nil, errors.Wrap(err, "forbidden response to Gitea request")
+			return nil, errors.New("forbidden response to Gitea request")
 		default:
 			logger.Printf("failed to get users with unexpected response: %d (%s)", resp.StatusCode, resp.Status)
 
-			return nil, errors.Wrap(err, "unexpected errors making Gitea request")
+			return nil, errors.Errorf("unexpected response to Gitea request: %d (%s)", resp.StatusCode, resp.Status)
 		}
 
 		var respObj giteaGetUsersResponse
@@ -482,7 +857,7 @@ func (g *GiteaHost) getAllUsers() ([]giteaUser, errors.E) {
 	return users, nil
 }
 
-func (g *GiteaHost) getOrganizations() ([]giteaOrganization, errors.E) {
+func (g *GiteaHost) getOrganizations(ctx context.Context) ([]giteaOrganization, errors.E) {
 	if len(g.Orgs) == 0 {
 		if g.LogLevel > 0 {
 			logger.Print("no organizations specified")
@@ -500,13 +875,13 @@ func (g *GiteaHost) getOrganizations() ([]giteaOrganization, errors.E) {
 	if slices.Contains(g.Orgs, "*") {
 		var err errors.E
 
-		organizations, err = g.getAllOrganizations()
+		organizations, err = g.getAllOrganizations(ctx)
 		if err != nil {
 			return nil, errors.Errorf("failed to get all organizations: %s", err.Error())
 		}
 	} else {
 		for _, orgName := range g.Orgs {
-			org, err := g.getOrganization(orgName)
+			org, err := g.getOrganization(ctx, orgName)
 			if err != nil {
 				return nil, errors.Errorf("failed to get organization %s: %s", orgName, err.Error())
 			}
@@ -518,7 +893,7 @@ func (g *GiteaHost) getOrganizations() ([]giteaOrganization, errors.E) {
 	return organizations, nil
 }
 
-func (g *GiteaHost) getOrganization(orgName string) (giteaOrganization, errors.E) {
+func (g *GiteaHost) getOrganization(ctx context.Context, orgName string) (giteaOrganization, errors.E) {
 	if g.LogLevel > 0 {
 		logger.Printf("retrieving organization %s", orgName)
 	}
@@ -548,7 +923,7 @@ func (g *GiteaHost) getOrganization(orgName string) (giteaOrganization, errors.E
 
 	var resp *http.Response
 
-	resp, body, err = g.makeGiteaRequest(reqUrl)
+	resp, body, err = g.makeGiteaRequest(ctx, reqUrl)
 	if err != nil {
 		return giteaOrganization{}, errors.Wrap(err, fmt.Sprintf("failed to get organization: %s", orgName))
 	}
@@ -587,7 +962,7 @@ func (g *GiteaHost) getOrganization(orgName string) (giteaOrganization, errors.E
 	return organization, nil
 }
 
-func (g *GiteaHost) getAllOrganizations() ([]giteaOrganization, errors.E) {
+func (g *GiteaHost) getAllOrganizations(ctx context.Context) ([]giteaOrganization, errors.E) {
 	logger.Printf("retrieving organizations")
 
 	if strings.TrimSpace(g.APIURL) == "" {
@@ -609,8 +984,7 @@ func (g *GiteaHost) getAllOrganizations() ([]giteaOrganization, errors.E) {
 
 	q := u.Query()
 	// set initial max per page
-	q.Set("per_page", strconv.Itoa(giteaOrganizationsPerPageDefault))
-	q.Set("limit", strconv.Itoa(giteaOrganizationsLimit))
+	g.setPageSize(ctx, q, giteaOrganizationsPerPageDefault, giteaOrganizationsLimit)
 	u.RawQuery = q.Encode()
 
 	var body []byte
@@ -622,7 +996,7 @@ func (g *GiteaHost) getAllOrganizations() ([]giteaOrganization, errors.E) {
 	for {
 		var resp *http.Response
 
-		resp, body, err = g.makeGiteaRequest(reqUrl)
+		resp, body, err = g.makeGiteaRequest(ctx, reqUrl)
 		if err != nil {
 			logger.Printf("failed to get organizations: %v", err.Error())
 
@@ -763,7 +1137,25 @@ type giteaRepository struct {
 	RepoTransfer                  interface{} `json:"repo_transfer"`
 }
 
-func (g *GiteaHost) getOrganizationRepos(organizationName string) ([]giteaRepository, errors.E) {
+// repository returns the repository hosted on the given domain.
+func (r giteaRepository) repository(domain string) repository {
+	return repository{
+		Name:              r.Name,
+		Owner:             r.Owner.Login,
+		HTTPSUrl:          r.CloneUrl,
+		SSHUrl:            r.SshUrl,
+		PathWithNameSpace: r.FullName,
+		Domain:            domain,
+		Private:           r.Private,
+		Fork:              r.Fork,
+		Archived:          r.Archived,
+		// size is reported in kilobytes
+		Size:          int64(r.Size) * bytesPerKB,
+		DefaultBranch: r.DefaultBranch,
+	}
+}
+
+func (g *GiteaHost) getOrganizationRepos(ctx context.Context, organizationName string) ([]giteaRepository, errors.E) {
 	logger.Printf("retrieving repositories for organization %s", organizationName)
 
 	if strings.TrimSpace(g.APIURL) == "" {
@@ -783,8 +1175,7 @@ func (g *GiteaHost) getOrganizationRepos(organizationName string) ([]giteaReposi
 
 	q := u.Query()
 	// set initial max per page
-	q.Set("per_page", strconv.Itoa(giteaReposPerPageDefault))
-	q.Set("limit", strconv.Itoa(giteaReposLimit))
+	g.setPageSize(ctx, q, giteaReposPerPageDefault, giteaReposLimit)
 	u.RawQuery = q.Encode()
 
 	var body []byte
@@ -796,7 +1187,7 @@ func (g *GiteaHost) getOrganizationRepos(organizationName string) ([]giteaReposi
 	for {
 		var resp *http.Response
 
-		resp, body, err = g.makeGiteaRequest(reqUrl)
+		resp, body, err = g.makeGiteaRequest(ctx, reqUrl)
 		if err != nil {
 			return nil, errors.Errorf("failed to make Gitea request: %s", err)
 		}
@@ -845,7 +1236,7 @@ func (g *GiteaHost) getOrganizationRepos(organizationName string) ([]giteaReposi
 	return repos, nil
 }
 
-func (g *GiteaHost) getAllUserRepos(userName string) ([]repository, errors.E) {
+func (g *GiteaHost) getAllUserRepos(ctx context.Context, userName string) ([]repository, errors.E) {
 	logger.Printf("retrieving all repositories for user %s", userName)
 
 	if strings.TrimSpace(g.APIURL) == "" {
@@ -867,8 +1258,7 @@ func (g *GiteaHost) getAllUserRepos(userName string) ([]repository, errors.E) {
 
 	q := u.Query()
 	// set initial max per page
-	q.Set("per_page", strconv.Itoa(giteaReposPerPageDefault))
-	q.Set("limit", strconv.Itoa(giteaReposLimit))
+	g.setPageSize(ctx, q, giteaReposPerPageDefault, giteaReposLimit)
 	u.RawQuery = q.Encode()
 
 	var body []byte
@@ -880,7 +1270,7 @@ func (g *GiteaHost) getAllUserRepos(userName string) ([]repository, errors.E) {
 	for {
 		var resp *http.Response
 
-		resp, body, err = g.makeGiteaRequest(reqUrl)
+		resp, body, err = g.makeGiteaRequest(ctx, reqUrl)
 		if err != nil {
 			logger.Printf("failed to get repos: %v", err)
 
@@ -922,14 +1312,7 @@ func (g *GiteaHost) getAllUserRepos(userName string) ([]repository, errors.E) {
 				return nil, errors.Wrap(err, fmt.Sprintf("failed to parse clone url for: %s", r.CloneUrl))
 			}
 
-			repos = append(repos, repository{
-				Name:              r.Name,
-				Owner:             r.Owner.Login,
-				HTTPSUrl:          r.CloneUrl,
-				SSHUrl:            r.SshUrl,
-				Domain:            ru.Host,
-				PathWithNameSpace: r.FullName,
-			})
+			repos = append(repos, r.repository(ru.Host))
 		}
 
 		reqUrl = ""
@@ -952,6 +1335,21 @@ func (g *GiteaHost) getAPIURL() string {
 	return g.APIURL
 }
 
+// GetAPIURL returns the URL of the Gitea API.
+func (g *GiteaHost) GetAPIURL() string {
+	return g.getAPIURL()
+}
+
+// Name returns the name of the provider.
+func (g *GiteaHost) Name() string {
+	return giteaProviderName
+}
+
+// ListRepositories returns the repositories available to back up.
+func (g *GiteaHost) ListRepositories(ctx context.Context) ([]Repository, errors.E) {
+	return listRepositories(ctx, g, g.Filter, g.Observer)
+}
+
 // return normalised method.
 func (g *GiteaHost) diffRemoteMethod() string {
 	switch strings.ToLower(g.DiffRemoteMethod) {
@@ -966,38 +1364,23 @@ func (g *GiteaHost) diffRemoteMethod() string {
 	}
 }
 
-func giteaWorker(token string, logLevel int, backupDIR, diffRemoteMethod string, backupsToKeep int, jobs <-chan repository, results chan<- RepoBackupResults) {
-	for repo := range jobs {
-		firstPos := strings.Index(repo.HTTPSUrl, "//")
-		repo.URLWithToken = fmt.Sprintf("%s%s@%s", repo.HTTPSUrl[:firstPos+2], token, repo.HTTPSUrl[firstPos+2:])
-		err := processBackup(logLevel, repo, backupDIR, backupsToKeep, diffRemoteMethod)
-
-		backupResult := RepoBackupResults{
-			Repo: repo.PathWithNameSpace,
-		}
-
-		status := statusOk
-		if err != nil {
-			status = statusFailed
-			backupResult.Error = err
-		}
-
-		backupResult.Status = status
-
-		results <- backupResult
-	}
+func (g *GiteaHost) Backup() ProviderBackupResult {
+	return g.BackupWithContext(context.Background())
 }
 
-func (g *GiteaHost) Backup() ProviderBackupResult {
+// BackupWithContext backs up the host's repositories. Cancelling the context stops
+// pending jobs and kills any in-flight git commands, with the results of repositories
+// not backed up marked as cancelled.
+func (g *GiteaHost) BackupWithContext(ctx context.Context) ProviderBackupResult {
 	if g.BackupDir == "" {
 		logger.Printf("backup skipped as backup directory not specified")
 
 		return ProviderBackupResult{}
 	}
 
-	maxConcurrent := 5
+	maxConcurrent := workerCount(g.Concurrency, giteaDefaultConcurrency)
 
-	repoDesc, err := g.describeRepos()
+	repoDesc, err := describeProviderRepos(ctx, g, g.Observer)
 	if err != nil {
 		return ProviderBackupResult{
 			BackupResults: nil,
@@ -1005,36 +1388,24 @@ func (g *GiteaHost) Backup() ProviderBackupResult {
 		}
 	}
 
-	jobs := make(chan repository, len(repoDesc.Repos))
-	results := make(chan RepoBackupResults, maxConcurrent)
-
-	for w := 1; w <= maxConcurrent; w++ {
-		go giteaWorker(g.Token, g.LogLevel, g.BackupDir, g.diffRemoteMethod(), g.BackupsToRetain, jobs, results)
-	}
-
 	for x := range repoDesc.Repos {
-		repo := repoDesc.Repos[x]
-		jobs <- repo
-	}
-
-	close(jobs)
-
-	var providerBackupResults ProviderBackupResult
-
-	for a := 1; a <= len(repoDesc.Repos); a++ {
-		res := <-results
-		if res.Error != nil {
-			logger.Printf("backup failed: %+v\n", res.Error)
+		repoDesc.Repos[x].credentials = gitCredentials{
+			username: tokenUsername,
+			password: g.Token,
 		}
-
-		providerBackupResults.BackupResults = append(providerBackupResults.BackupResults, res)
 	}
 
-	return providerBackupResults
+	return backupRepos(ctx, repoDesc.Repos, maxConcurrent, g.backupInput(processBackupInput{
+		logLevel:         g.LogLevel,
+		backupDir:        g.BackupDir,
+		backupsToKeep:    g.BackupsToRetain,
+		diffRemoteMethod: g.diffRemoteMethod(),
+		provider:         g.Name(),
+	}))
 }
 
-func (g *GiteaHost) getAllUserRepositories() ([]repository, errors.E) {
-	users, err := g.getAllUsers()
+func (g *GiteaHost) getAllUserRepositories(ctx context.Context) ([]repository, errors.E) {
+	users, err := g.getAllUsers(ctx)
 	if err != nil {
 		logger.Print("failed to get all users")
 
@@ -1050,7 +1421,7 @@ func (g *GiteaHost) getAllUserRepositories() ([]repository, errors.E) {
 
 		var userRepos []repository
 
-		userRepos, err = g.getAllUserRepos(user.Login)
+		userRepos, err = g.getAllUserRepos(ctx, user.Login)
 		if err != nil {
 			logger.Print("failed to get all user repositories")
 
@@ -1060,17 +1431,5 @@ func (g *GiteaHost) getAllUserRepositories() ([]repository, errors.E) {
 		repos = append(repos, userRepos...)
 	}
 
-	var repositories []repository
-	for _, repo := range repos {
-		repositories = append(repositories, repository{
-			Name:              repo.Name,
-			Owner:             repo.Owner,
-			PathWithNameSpace: repo.PathWithNameSpace,
-			Domain:            repo.Domain,
-			HTTPSUrl:          repo.HTTPSUrl,
-			SSHUrl:            repo.SSHUrl,
-		})
-	}
-
-	return repositories, nil
+	return repos, nil
 }
@@ -1,11 +1,19 @@
 package githosts
 
 import (
+	"context"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -49,7 +57,7 @@ func TestGiteaGetUsers(t *testing.T) {
 
 	gHost.Token = giteaToken
 
-	users, _ := gHost.getAllUsers()
+	users, _ := gHost.getAllUsers(context.Background())
 	require.True(t, userExists(userExistsInput{
 		matchBy:  giteaMatchByIfDefined,
 		users:    users,
@@ -89,14 +97,14 @@ func TestGiteaGetOrganisations(t *testing.T) {
 	require.NoError(t, err)
 
 	// without org names we should get no orgs
-	organizations, err := gHost.getOrganizations()
+	organizations, err := gHost.getOrganizations(context.Background())
 	require.NoError(t, err)
 
 	require.Empty(t, organizations)
 
 	// with single org name we should only get that org
 	gHost.Orgs = []string{"soba-org-two"}
-	organizations, err = gHost.getOrganizations()
+	organizations, err = gHost.getOrganizations(context.Background())
 	require.NoError(t, err)
 
 	require.False(t, organisationExists(organizationExistsInput{
@@ -142,7 +150,7 @@ func TestGetOrganizationsRepos(t *testing.T) {
 	require.NoError(t, err)
 
 	// without env vars, we shouldn't get any orgs
-	repos, _ := gHost.getOrganizationsRepos([]giteaOrganization{
+	repos, _ := gHost.getOrganizationsRepos(context.Background(), []giteaOrganization{
 		{Name: "soba-org-one", FullName: "soba org one"},
 	})
 
@@ -195,7 +203,7 @@ func TestGetAllOrganizationRepos(t *testing.T) {
 
 	require.NoError(t, err)
 
-	organizations, _ := gHost.getOrganizations()
+	organizations, _ := gHost.getOrganizations(context.Background())
 	require.GreaterOrEqual(t, len(organizations), 0)
 	require.False(t, organisationExists(organizationExistsInput{
 		matchBy:       giteaMatchByIfDefined,
@@ -206,7 +214,7 @@ func TestGetAllOrganizationRepos(t *testing.T) {
 	// gHost.Orgs = []string{"soba-org-two"}
 
 	gHost.Orgs = []string{"soba-org-two"}
-	organizations, _ = gHost.getOrganizations()
+	organizations, _ = gHost.getOrganizations(context.Background())
 
 	require.GreaterOrEqual(t, len(organizations), 1)
 	require.False(t, organisationExists(organizationExistsInput{
@@ -225,7 +233,7 @@ func TestGetAllOrganizationRepos(t *testing.T) {
 
 	// * should return all orgs
 	gHost.Orgs = []string{"*"}
-	organizations, _ = gHost.getOrganizations()
+	organizations, _ = gHost.getOrganizations(context.Background())
 
 	require.GreaterOrEqual(t, len(organizations), 2)
 	require.True(t, organisationExists(organizationExistsInput{
@@ -270,7 +278,7 @@ func TestGetAllUserRepos(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	users, _ := gHost.getAllUsers()
+	users, _ := gHost.getAllUsers(context.Background())
 
 	var repos []repository
 
@@ -280,7 +288,7 @@ func TestGetAllUserRepos(t *testing.T) {
 		userCount++
 
 		var allUserRepos []repository
-		allUserRepos, err = gHost.getAllUserRepos(user.Login)
+		allUserRepos, err = gHost.getAllUserRepos(context.Background(), user.Login)
 
 		require.NoError(t, err)
 
@@ -362,6 +370,7 @@ func TestGiteaRepositoryBackup(t *testing.T) {
 		DiffRemoteMethod: cloneMethod,
 		BackupDir:        backupDIR,
 		Token:            giteaToken,
+		AdminCrawl:       true,
 	})
 	require.NoError(t, err)
 
@@ -409,6 +418,7 @@ func TestGiteaRepositoryBackupWithoutBackupDir(t *testing.T) {
 		APIURL:           giteaAPIURL,
 		DiffRemoteMethod: cloneMethod,
 		Token:            giteaToken,
+		AdminCrawl:       true,
 	})
 	// no error expected as backup dir not required for all usage
 	require.NoError(t, err)
@@ -422,13 +432,12 @@ func TestGiteaRepositoryBackupWithoutBackupDir(t *testing.T) {
 func TestGiteaRepositoryExistsWithoutRepos(t *testing.T) {
 	// without repos presented - should return false
 	require.False(t, repoExists(repoExistsInput{
-		repos:        []repository{},
-		name:         "repo1",
-		owner:        "go-soba",
-		domain:       "gitea.example.com",
-		httpsUrl:     "",
-		sshUrl:       "",
-		urlWithToken: "",
+		repos:    []repository{},
+		name:     "repo1",
+		owner:    "go-soba",
+		domain:   "gitea.example.com",
+		httpsUrl: "",
+		sshUrl:   "",
 	}))
 }
 
@@ -438,21 +447,18 @@ func TestGiteaRepositoryExistsWithMatch(t *testing.T) {
 		matchBy: giteaMatchByIfDefined,
 		repos: []repository{
 			{
-				Name:             "repo0",
-				Owner:            "go-soba",
-				Domain:           "gitea.example.com",
-				HTTPSUrl:         "",
-				SSHUrl:           "",
-				URLWithToken:     "",
-				URLWithBasicAuth: "",
+				Name:     "repo0",
+				Owner:    "go-soba",
+				Domain:   "gitea.example.com",
+				HTTPSUrl: "",
+				SSHUrl:   "",
 			},
 		},
-		name:         "repo0",
-		owner:        "go-soba",
-		domain:       "gitea.example.com",
-		httpsUrl:     "",
-		sshUrl:       "",
-		urlWithToken: "",
+		name:     "repo0",
+		owner:    "go-soba",
+		domain:   "gitea.example.com",
+		httpsUrl: "",
+		sshUrl:   "",
 	}))
 }
 
@@ -462,21 +468,18 @@ func TestGiteaRepositoryExistsWithoutMatch(t *testing.T) {
 		matchBy: giteaMatchByIfDefined,
 		repos: []repository{
 			{
-				Name:             "repo0",
-				Owner:            "go-soba",
-				Domain:           "gitea.example.com",
-				HTTPSUrl:         "",
-				SSHUrl:           "",
-				URLWithToken:     "",
-				URLWithBasicAuth: "",
+				Name:     "repo0",
+				Owner:    "go-soba",
+				Domain:   "gitea.example.com",
+				HTTPSUrl: "",
+				SSHUrl:   "",
 			},
 		},
-		name:         "repo1",
-		owner:        "go-soba",
-		domain:       "gitea.example.com",
-		httpsUrl:     "",
-		sshUrl:       "",
-		urlWithToken: "",
+		name:     "repo1",
+		owner:    "go-soba",
+		domain:   "gitea.example.com",
+		httpsUrl: "",
+		sshUrl:   "",
 	}))
 
 	// negative 'if defined' match with "if defined check"
@@ -484,21 +487,18 @@ func TestGiteaRepositoryExistsWithoutMatch(t *testing.T) {
 		matchBy: giteaMatchByIfDefined,
 		repos: []repository{
 			{
-				Name:             "repo0",
-				Owner:            "go-soba",
-				Domain:           "gitea.example.com",
-				HTTPSUrl:         "https://gitea.example.com/go-soba/repo0.git",
-				SSHUrl:           "",
-				URLWithToken:     "",
-				URLWithBasicAuth: "",
+				Name:     "repo0",
+				Owner:    "go-soba",
+				Domain:   "gitea.example.com",
+				HTTPSUrl: "https://gitea.example.com/go-soba/repo0.git",
+				SSHUrl:   "",
 			},
 		},
-		name:         "repo0",
-		owner:        "go-soba",
-		domain:       "https://gitea.example.com/go-soba/repo1.git",
-		httpsUrl:     "",
-		sshUrl:       "",
-		urlWithToken: "",
+		name:     "repo0",
+		owner:    "go-soba",
+		domain:   "https://gitea.example.com/go-soba/repo1.git",
+		httpsUrl: "",
+		sshUrl:   "",
 	}))
 
 	// negative 'if defined' match with "match all check"
@@ -506,21 +506,18 @@ func TestGiteaRepositoryExistsWithoutMatch(t *testing.T) {
 		matchBy: giteaMatchByExact,
 		repos: []repository{
 			{
-				Name:             "repo0",
-				Owner:            "go-soba",
-				Domain:           "gitea.example.com",
-				HTTPSUrl:         "https://gitea.example.com/go-soba/repo0.git",
-				SSHUrl:           "git@ssh://gitea.example.com/go-soba/repo0.git",
-				URLWithToken:     "",
-				URLWithBasicAuth: "",
+				Name:     "repo0",
+				Owner:    "go-soba",
+				Domain:   "gitea.example.com",
+				HTTPSUrl: "https://gitea.example.com/go-soba/repo0.git",
+				SSHUrl:   "git@ssh://gitea.example.com/go-soba/repo0.git",
 			},
 		},
-		name:         "repo0",
-		owner:        "go-soba",
-		domain:       "gitea.example.com",
-		httpsUrl:     "https://gitea.example.com/go-soba/repo0.git",
-		sshUrl:       "",
-		urlWithToken: "",
+		name:     "repo0",
+		owner:    "go-soba",
+		domain:   "gitea.example.com",
+		httpsUrl: "https://gitea.example.com/go-soba/repo0.git",
+		sshUrl:   "",
 	}))
 }
 
@@ -535,8 +532,6 @@ func TestRepoExists1(t *testing.T) {
 				Domain:            "domain1",
 				HTTPSUrl:          "httpsUrl1",
 				SSHUrl:            "sshUrl1",
-				URLWithToken:      "urlWithToken1",
-				URLWithBasicAuth:  "urlWithBasicAuth1",
 			},
 		},
 		name:              "repo1",
@@ -545,8 +540,6 @@ func TestRepoExists1(t *testing.T) {
 		domain:            "domain1",
 		httpsUrl:          "httpsUrl1",
 		sshUrl:            "sshUrl1",
-		urlWithToken:      "urlWithToken1",
-		urlWithBasicAuth:  "urlWithBasicAuth1",
 	}))
 }
 
@@ -561,8 +554,6 @@ func TestRepoExists2(t *testing.T) {
 				Domain:            "domain1",
 				HTTPSUrl:          "httpsUrl1",
 				SSHUrl:            "sshUrl1",
-				URLWithToken:      "urlWithToken1",
-				URLWithBasicAuth:  "urlWithBasicAuth1",
 			},
 		},
 		name:              "repo1",
@@ -571,8 +562,6 @@ func TestRepoExists2(t *testing.T) {
 		domain:            "domain1",
 		httpsUrl:          "httpsUrl1",
 		sshUrl:            "sshUrl1",
-		urlWithToken:      "urlWithToken1",
-		urlWithBasicAuth:  "urlWithBasicAuth1",
 	}))
 }
 
@@ -587,8 +576,6 @@ func TestRepoExists3(t *testing.T) {
 				HTTPSUrl:          "httpsUrl1",
 				Domain:            "domain1",
 				SSHUrl:            "sshUrl1",
-				URLWithToken:      "urlWithToken1",
-				URLWithBasicAuth:  "urlWithBasicAuth1",
 			},
 		},
 		name:              "repo1",
@@ -596,8 +583,6 @@ func TestRepoExists3(t *testing.T) {
 		pathWithNamespace: "pwns1",
 		domain:            "domain1",
 		sshUrl:            "sshUrl1",
-		urlWithToken:      "urlWithToken1",
-		urlWithBasicAuth:  "urlWithBasicAuth1",
 	}))
 }
 
@@ -677,3 +662,294 @@ func TestUserExistsIfDefinedMatch(t *testing.T) {
 		fullName:  "fullname1",
 	}))
 }
+
+// newTestGiteaServer stands in for a Gitea instance, serving fixed responses by path
+// and refusing all others, such as the site admin API.
+func newTestGiteaServer(t *testing.T, responses map[string]string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func giteaTestRepo(owner, name string) string {
+	return `{"name": "` + name + `", "full_name": "` + owner + `/` + name + `", "owner": {"login": "` + owner +
+		`"}, "clone_url": "https://gitea.example.com/` + owner + `/` + name + `.git"}`
+}
+
+func TestGiteaDescribeReposWithoutAdmin(t *testing.T) {
+	t.Parallel()
+
+	server := newTestGiteaServer(t, map[string]string{
+		"/api/v1/user": `{"id": 1, "login": "soba"}`,
+		// includes repositories the user collaborates on and those of their organizations
+		"/api/v1/user/repos": `[` + giteaTestRepo("soba", "mine") + `,` + giteaTestRepo("udon", "shared") + `,` +
+			giteaTestRepo("noodles", "one") + `]`,
+		"/api/v1/user/orgs":          `[{"id": 2, "name": "noodles"}]`,
+		"/api/v1/orgs/noodles":       `{"id": 2, "name": "noodles"}`,
+		"/api/v1/orgs/noodles/repos": `[` + giteaTestRepo("noodles", "one") + `,` + giteaTestRepo("noodles", "two") + `]`,
+		"/api/v1/users/ramen/repos":  `[` + giteaTestRepo("ramen", "bowl") + `]`,
+	})
+
+	g, err := NewGiteaHost(NewGiteaHostInput{
+		APIURL: server.URL + "/api/v1",
+		Token:  "test-token",
+		Orgs:   []string{"noodles"},
+		Users:  []string{"ramen"},
+	})
+	require.NoError(t, err)
+
+	repos, listErr := g.ListRepositories(context.Background())
+	require.NoError(t, listErr)
+
+	var paths []string
+	for _, repo := range repos {
+		paths = append(paths, repo.PathWithNameSpace)
+	}
+
+	require.Equal(t, []string{"soba/mine", "ramen/bowl", "noodles/one", "noodles/two"}, paths)
+
+	// listing every user requires a site admin token
+	g.AdminCrawl = true
+
+	_, listErr = g.ListRepositories(context.Background())
+	require.ErrorContains(t, listErr, "failed to get user repositories")
+}
+
+// newGiteaFixtureServer serves the responses recorded from a server in testfiles/<dir>,
+// recording the query of each request by path.
+func newGiteaFixtureServer(t *testing.T, dir string) (*httptest.Server, *sync.Map) {
+	t.Helper()
+
+	fixtures := map[string]string{
+		"/api/v1/version":            "version.json",
+		"/api/v1/settings/api":       "settings_api.json",
+		"/api/v1/user":               "user.json",
+		"/api/v1/user/repos":         "user_repos.json",
+		"/api/v1/user/orgs":          "user_orgs.json",
+		"/api/v1/orgs/noodles":       "org.json",
+		"/api/v1/orgs/noodles/repos": "org_repos.json",
+	}
+
+	queries := &sync.Map{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := fixtures[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		queries.Store(r.URL.Path, r.URL.Query())
+
+		body, err := os.ReadFile(filepath.Join("testfiles", dir, name))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, queries
+}
+
+func TestGiteaServerFlavours(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		dir    string
+		server GiteaServer
+	}{
+		{dir: "gitea", server: GiteaServer{Flavour: GiteaFlavourGitea, Version: "1.22.3", MaxPageSize: 50}},
+		{dir: "forgejo", server: GiteaServer{Flavour: GiteaFlavourForgejo, Version: "9.0.3+gitea-1.22.0", MaxPageSize: 100}},
+	} {
+		t.Run(tc.dir, func(t *testing.T) {
+			t.Parallel()
+
+			server, queries := newGiteaFixtureServer(t, tc.dir)
+
+			g, err := NewGiteaHost(NewGiteaHostInput{
+				APIURL: server.URL + "/api/v1",
+				Token:  "test-token",
+				Orgs:   []string{"noodles"},
+			})
+			require.NoError(t, err)
+
+			detected, serverErr := g.Server(context.Background())
+			require.NoError(t, serverErr)
+			require.Equal(t, tc.server, detected)
+
+			repos, listErr := g.ListRepositories(context.Background())
+			require.NoError(t, listErr)
+
+			var paths []string
+			for _, repo := range repos {
+				paths = append(paths, repo.PathWithNameSpace)
+			}
+
+			require.Equal(t, []string{"soba/mine", "noodles/broth", "noodles/toppings"}, paths)
+
+			// pages are requested with limit alone, at the server's maximum size
+			for _, path := range []string{"/api/v1/user/repos", "/api/v1/user/orgs", "/api/v1/orgs/noodles/repos"} {
+				q, ok := queries.Load(path)
+				require.True(t, ok, path)
+				require.Equal(t, strconv.Itoa(tc.server.MaxPageSize), q.(url.Values).Get("limit"), path)
+				require.False(t, q.(url.Values).Has("per_page"), path)
+			}
+		})
+	}
+}
+
+func TestGiteaServerUndetected(t *testing.T) {
+	t.Parallel()
+
+	var query url.Values
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/orgs/noodles/repos" {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		query = r.URL.Query()
+
+		_, _ = w.Write([]byte(`[` + giteaTestRepo("noodles", "broth") + `]`))
+	}))
+	t.Cleanup(server.Close)
+
+	g, err := NewGiteaHost(NewGiteaHostInput{
+		APIURL: server.URL + "/api/v1",
+		Token:  "test-token",
+	})
+	require.NoError(t, err)
+
+	_, serverErr := g.Server(context.Background())
+	require.Error(t, serverErr)
+
+	repos, reposErr := g.getOrganizationRepos(context.Background(), "noodles")
+	require.NoError(t, reposErr)
+	require.Len(t, repos, 1)
+
+	// both page size parameters are sent to servers that can't be identified
+	require.Equal(t, strconv.Itoa(giteaReposPerPageDefault), query.Get("per_page"))
+	require.Equal(t, strconv.Itoa(giteaReposLimit), query.Get("limit"))
+}
+
+func TestGiteaServerCachesFailedDetection(t *testing.T) {
+	t.Parallel()
+
+	var versionRequests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first detection fails, as if the server were briefly unavailable
+		if r.URL.Path != "/api/v1/version" || versionRequests.Add(1) == 1 {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"version": "1.22.3"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	g, err := NewGiteaHost(NewGiteaHostInput{
+		APIURL: server.URL + "/api/v1",
+		Token:  "test-token",
+	})
+	require.NoError(t, err)
+
+	_, serverErr := g.Server(context.Background())
+	require.Error(t, serverErr)
+
+	// the failure is kept for the rest of the listing, so each page falls back to per_page
+	for range 3 {
+		q := url.Values{}
+		g.setPageSize(context.Background(), q, 100, 50)
+		require.Equal(t, "100", q.Get("per_page"))
+	}
+
+	require.EqualValues(t, 1, versionRequests.Load())
+
+	// the next listing detects the server again
+	g.retryServerDetection()
+
+	detected, serverErr := g.Server(context.Background())
+	require.NoError(t, serverErr)
+	require.Equal(t, GiteaFlavourGitea, detected.Flavour)
+
+	// successful detection is cached
+	g.retryServerDetection()
+
+	_, serverErr = g.Server(context.Background())
+	require.NoError(t, serverErr)
+	require.EqualValues(t, 2, versionRequests.Load())
+}
+
+func TestGiteaRateLimitedRequestsAreRetried(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/orgs/noodles/repos" {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		if requests.Add(1) <= 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+
+			return
+		}
+
+		_, _ = w.Write([]byte(`[` + giteaTestRepo("noodles", "broth") + `]`))
+	}))
+	t.Cleanup(server.Close)
+
+	g, err := NewGiteaHost(NewGiteaHostInput{
+		APIURL: server.URL + "/api/v1",
+		Token:  "test-token",
+	})
+	require.NoError(t, err)
+
+	repos, reposErr := g.getOrganizationRepos(context.Background(), "noodles")
+	require.NoError(t, reposErr)
+	require.Len(t, repos, 1)
+	require.EqualValues(t, 3, requests.Load())
+}
+
+func TestGiteaRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, 30*time.Second, giteaRetryAfter(http.Header{"Retry-After": []string{"30"}}, 0))
+	require.Equal(t, giteaRateLimitWaitMax, giteaRetryAfter(http.Header{"Retry-After": []string{"86400"}}, 0))
+
+	at := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	wait := giteaRetryAfter(http.Header{"Retry-After": []string{at}}, 0)
+	require.Greater(t, wait, 50*time.Second)
+	require.LessOrEqual(t, wait, time.Minute)
+
+	// without the header, waits double with each attempt
+	require.Equal(t, giteaRateLimitWaitMin, giteaRetryAfter(http.Header{}, 0))
+	require.Equal(t, 4*giteaRateLimitWaitMin, giteaRetryAfter(http.Header{}, 2))
+	require.Equal(t, giteaRateLimitWaitMax, giteaRetryAfter(http.Header{}, 10))
+}
@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"slices"
 	"strconv"
@@ -21,6 +21,9 @@ const (
 	githubEnvVarCallSize = "GITHUB_CALL_SIZE"
 	gitHubDomain         = "github.com"
 	gitHubProviderName   = "GitHub"
+	// githubRepoNodeFields are the repository fields requested in GraphQL queries.
+	githubRepoNodeFields = "name nameWithOwner url sshUrl isPrivate isFork isArchived diskUsage defaultBranchRef { name }"
+	bytesPerKB           = 1024
 )
 
 type NewGitHubHostInput struct {
@@ -35,12 +38,34 @@ type NewGitHubHostInput struct {
 	Orgs             []string
 	BackupsToRetain  int
 	LogLevel         int
+	BackupOptions
+	// Domain is the domain repositories are stored under, defaulting to that of APIURL,
+	// e.g. github.com for api.github.com.
+	Domain string
+	// TLS configures connections to a GitHub Enterprise Server instance, such as one with
+	// certificates issued by a private authority. It can't be used with HTTPClient.
+	TLS *TLSConfig
 }
 
 func (gh *GitHubHost) getAPIURL() string {
 	return gh.APIURL
 }
 
+// GetAPIURL returns the URL of the GitHub API.
+func (gh *GitHubHost) GetAPIURL() string {
+	return gh.getAPIURL()
+}
+
+// Name returns the name of the provider.
+func (gh *GitHubHost) Name() string {
+	return gitHubProviderName
+}
+
+// ListRepositories returns the repositories available to back up.
+func (gh *GitHubHost) ListRepositories(ctx context.Context) ([]Repository, errors.E) {
+	return listRepositories(ctx, gh, gh.Filter, gh.Observer)
+}
+
 func NewGitHubHost(input NewGitHubHostInput) (*GitHubHost, error) {
 	setLoggerPrefix(input.Caller)
 
@@ -49,6 +74,15 @@ func NewGitHubHost(input NewGitHubHostInput) (*GitHubHost, error) {
 		apiURL = input.APIURL
 	}
 
+	apiURL, domain, endpointsErr := gitHubEndpoints(apiURL)
+	if endpointsErr != nil {
+		return nil, endpointsErr
+	}
+
+	if input.Domain != "" {
+		domain = input.Domain
+	}
+
 	diffRemoteMethod, err := getDiffRemoteMethod(input.DiffRemoteMethod)
 	if err != nil {
 		return nil, err
@@ -61,9 +95,20 @@ func NewGitHubHost(input NewGitHubHostInput) (*GitHubHost, error) {
 		logger.Print("using diff remote method: " + diffRemoteMethod)
 	}
 
+	if err = input.validate(input.BackupsToRetain); err != nil {
+		return nil, err
+	}
+
+	if input.TLS != nil && input.HTTPClient != nil {
+		return nil, errors.New("TLS config can't be used with a custom HTTP client")
+	}
+
 	httpClient := input.HTTPClient
 	if httpClient == nil {
-		httpClient = getHTTPClient()
+		var clientErr errors.E
+		if httpClient, clientErr = input.TLS.httpClient(); clientErr != nil {
+			return nil, clientErr
+		}
 	}
 
 	return &GitHubHost{
@@ -71,6 +116,7 @@ func NewGitHubHost(input NewGitHubHostInput) (*GitHubHost, error) {
 		HttpClient:       httpClient,
 		Provider:         gitHubProviderName,
 		APIURL:           apiURL,
+		Domain:           domain,
 		DiffRemoteMethod: diffRemoteMethod,
 		BackupDir:        input.BackupDir,
 		SkipUserRepos:    input.SkipUserRepos,
@@ -79,6 +125,8 @@ func NewGitHubHost(input NewGitHubHostInput) (*GitHubHost, error) {
 		Token:            input.Token,
 		Orgs:             input.Orgs,
 		LogLevel:         input.LogLevel,
+		BackupOptions:    input.BackupOptions,
+		TLS:              input.TLS,
 	}, nil
 }
 
@@ -87,6 +135,7 @@ type GitHubHost struct {
 	HttpClient       *retryablehttp.Client
 	Provider         string
 	APIURL           string
+	Domain           string
 	DiffRemoteMethod string
 	BackupDir        string
 	SkipUserRepos    bool
@@ -95,18 +144,95 @@ type GitHubHost struct {
 	Token            string
 	Orgs             []string
 	LogLevel         int
+	BackupOptions
+	TLS *TLSConfig
+}
+
+// domain returns the domain repositories are hosted on, defaulting to github.com.
+func (gh *GitHubHost) domain() string {
+	if gh.Domain == "" {
+		return gitHubDomain
+	}
+
+	return gh.Domain
+}
+
+// graphQLURL returns the URL of the GraphQL API, defaulting to GitHub's.
+func (gh *GitHubHost) graphQLURL() string {
+	if gh.APIURL == "" {
+		return githubAPIURL
+	}
+
+	return gh.APIURL
+}
+
+// gitHubEndpoints returns the GraphQL API URL and repository domain for the URL of a
+// GitHub API, accepting either the REST or GraphQL URL. GitHub Enterprise Server serves
+// both APIs from the instance's domain under /api, whereas github.com and GitHub
+// Enterprise Cloud with data residency serve them from an api subdomain.
+func gitHubEndpoints(apiURL string) (string, string, errors.E) {
+	u, err := url.Parse(apiURL)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", "", errors.Errorf("invalid GitHub API URL: %s", apiURL)
+	}
+
+	hostname := strings.ToLower(u.Hostname())
+
+	if hostname == "api."+gitHubDomain || (strings.HasPrefix(hostname, "api.") && strings.HasSuffix(hostname, ".ghe.com")) {
+		return u.Scheme + "://" + u.Host + "/graphql", strings.TrimPrefix(hostname, "api."), nil
+	}
+
+	base := strings.TrimSuffix(u.Path, "/")
+	for _, suffix := range []string{"/api/graphql", "/api/v3", "/api"} {
+		if strings.HasSuffix(base, suffix) {
+			base = strings.TrimSuffix(base, suffix)
+
+			break
+		}
+	}
+
+	return u.Scheme + "://" + u.Host + base + "/api/graphql", hostname, nil
 }
 
 type edge struct {
 	Node struct {
-		Name          string
-		NameWithOwner string
-		URL           string `json:"Url"`
-		SSHURL        string `json:"sshUrl"`
+		Name             string
+		NameWithOwner    string
+		URL              string `json:"Url"`
+		SSHURL           string `json:"sshUrl"`
+		IsPrivate        bool   `json:"isPrivate"`
+		IsFork           bool   `json:"isFork"`
+		IsArchived       bool   `json:"isArchived"`
+		DiskUsage        int64  `json:"diskUsage"`
+		DefaultBranchRef *struct {
+			Name string `json:"name"`
+		} `json:"defaultBranchRef"`
 	}
 	Cursor string
 }
 
+// repository returns the repository described by the edge's node, hosted on the domain.
+func (e edge) repository(domain string) repository {
+	repo := repository{
+		Name:              e.Node.Name,
+		SSHUrl:            e.Node.SSHURL,
+		HTTPSUrl:          e.Node.URL,
+		PathWithNameSpace: e.Node.NameWithOwner,
+		Domain:            domain,
+		Private:           e.Node.IsPrivate,
+		Fork:              e.Node.IsFork,
+		Archived:          e.Node.IsArchived,
+		// disk usage is reported in kilobytes
+		Size: e.Node.DiskUsage * bytesPerKB,
+	}
+
+	if e.Node.DefaultBranchRef != nil {
+		repo.DefaultBranch = e.Node.DefaultBranchRef.Name
+	}
+
+	return repo
+}
+
 type githubQueryNamesResponse struct {
 	Data struct {
 		Viewer struct {
@@ -170,13 +296,13 @@ type graphQLRequest struct {
 	Variables string `json:"variables"`
 }
 
-func (gh *GitHubHost) makeGithubRequest(payload string) (string, errors.E) {
+func (gh *GitHubHost) makeGithubRequest(ctx context.Context, payload string) (string, errors.E) {
 	contentReader := bytes.NewReader([]byte(payload))
 
-	ctx, cancel := context.WithTimeout(context.Background(), defaultHttpRequestTimeout)
+	ctx, cancel := context.WithTimeout(ctx, defaultHttpRequestTimeout)
 	defer cancel()
 
-	req, newReqErr := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, "https://api.github.com/graphql", contentReader)
+	req, newReqErr := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, gh.graphQLURL(), contentReader)
 
 	if newReqErr != nil {
 		logger.Println(newReqErr)
@@ -228,7 +354,7 @@ func (gh *GitHubHost) makeGithubRequest(payload string) (string, errors.E) {
 }
 
 // describeGithubUserRepos returns a list of repositories owned by authenticated user.
-func (gh *GitHubHost) describeGithubUserRepos() ([]repository, errors.E) {
+func (gh *GitHubHost) describeGithubUserRepos(ctx context.Context) ([]repository, errors.E) {
 	logger.Println("listing GitHub user's owned repositories")
 
 	gcs := gitHubCallSize
@@ -245,13 +371,13 @@ func (gh *GitHubHost) describeGithubUserRepos() ([]repository, errors.E) {
 	var reqBody string
 
 	if gh.LimitUserOwned {
-		reqBody = "{\"query\": \"query { viewer { repositories(first:" + strconv.Itoa(gcs) + ", affiliations: OWNER, ownerAffiliations: OWNER) { edges { node { name nameWithOwner url sshUrl } cursor } pageInfo { endCursor hasNextPage }} } }\""
+		reqBody = "{\"query\": \"query { viewer { repositories(first:" + strconv.Itoa(gcs) + ", affiliations: OWNER, ownerAffiliations: OWNER) { edges { node { " + githubRepoNodeFields + " } cursor } pageInfo { endCursor hasNextPage }} } }\""
 	} else {
-		reqBody = "{\"query\": \"query { viewer { repositories(first:" + strconv.Itoa(gcs) + ") { edges { node { name nameWithOwner url sshUrl } cursor } pageInfo { endCursor hasNextPage }} } }\""
+		reqBody = "{\"query\": \"query { viewer { repositories(first:" + strconv.Itoa(gcs) + ") { edges { node { " + githubRepoNodeFields + " } cursor } pageInfo { endCursor hasNextPage }} } }\""
 	}
 
 	for {
-		bodyStr, err := gh.makeGithubRequest(reqBody)
+		bodyStr, err := gh.makeGithubRequest(ctx, reqBody)
 		if err != nil {
 			return nil, errors.Wrap(err, "GitHub request failed")
 		}
@@ -264,22 +390,16 @@ func (gh *GitHubHost) describeGithubUserRepos() ([]repository, errors.E) {
 		}
 
 		for _, repo := range respObj.Data.Viewer.Repositories.Edges {
-			repos = append(repos, repository{
-				Name:              repo.Node.Name,
-				SSHUrl:            repo.Node.SSHURL,
-				HTTPSUrl:          repo.Node.URL,
-				PathWithNameSpace: repo.Node.NameWithOwner,
-				Domain:            gitHubDomain,
-			})
+			repos = append(repos, repo.repository(gh.domain()))
 		}
 
 		if !respObj.Data.Viewer.Repositories.PageInfo.HasNextPage {
 			break
 		} else {
 			if gh.LimitUserOwned {
-				reqBody = "{\"query\": \"query($first:Int $after:String){ viewer { repositories(first:$first after:$after, affiliations: OWNER, ownerAffiliations: OWNER) { edges { node { name nameWithOwner url sshUrl } cursor } pageInfo { endCursor hasNextPage }} } }\", \"variables\":{\"first\":" + strconv.Itoa(gcs) + ",\"after\":\"" + respObj.Data.Viewer.Repositories.PageInfo.EndCursor + "\"} }"
+				reqBody = "{\"query\": \"query($first:Int $after:String){ viewer { repositories(first:$first after:$after, affiliations: OWNER, ownerAffiliations: OWNER) { edges { node { " + githubRepoNodeFields + " } cursor } pageInfo { endCursor hasNextPage }} } }\", \"variables\":{\"first\":" + strconv.Itoa(gcs) + ",\"after\":\"" + respObj.Data.Viewer.Repositories.PageInfo.EndCursor + "\"} }"
 			} else {
-				reqBody = "{\"query\": \"query($first:Int $after:String){ viewer { repositories(first:$first after:$after) { edges { node { name nameWithOwner url sshUrl } cursor } pageInfo { endCursor hasNextPage }} } }\", \"variables\":{\"first\":" + strconv.Itoa(gcs) + ",\"after\":\"" + respObj.Data.Viewer.Repositories.PageInfo.EndCursor + "\"} }"
+				reqBody = "{\"query\": \"query($first:Int $after:String){ viewer { repositories(first:$first after:$after) { edges { node { " + githubRepoNodeFields + " } cursor } pageInfo { endCursor hasNextPage }} } }\", \"variables\":{\"first\":" + strconv.Itoa(gcs) + ",\"after\":\"" + respObj.Data.Viewer.Repositories.PageInfo.EndCursor + "\"} }"
 			}
 		}
 	}
@@ -287,14 +407,14 @@ func (gh *GitHubHost) describeGithubUserRepos() ([]repository, errors.E) {
 	return repos, nil
 }
 
-func (gh *GitHubHost) describeGithubUserOrganizations() ([]githubOrganization, errors.E) {
+func (gh *GitHubHost) describeGithubUserOrganizations(ctx context.Context) ([]githubOrganization, errors.E) {
 	logger.Println("listing GitHub user's related Organizations")
 
 	var orgs []githubOrganization
 
 	reqBody := "{\"query\": \"{ viewer { organizations(first:100) { edges { node { name } } } } }\""
 
-	bodyStr, err := gh.makeGithubRequest(reqBody)
+	bodyStr, err := gh.makeGithubRequest(ctx, reqBody)
 	if err != nil {
 		logger.Print(err)
 
@@ -340,7 +460,7 @@ func createGithubRequestPayload(body string) (string, errors.E) {
 	return string(gqlMarshalled), nil
 }
 
-func (gh *GitHubHost) describeGithubOrgRepos(orgName string) ([]repository, errors.E) {
+func (gh *GitHubHost) describeGithubOrgRepos(ctx context.Context, orgName string) ([]repository, errors.E) {
 	logger.Printf("listing GitHub organization %s's repositories", orgName)
 
 	gcs := gitHubCallSize
@@ -354,7 +474,7 @@ func (gh *GitHubHost) describeGithubOrgRepos(orgName string) ([]repository, erro
 
 	var repos []repository
 
-	reqBody := "query { organization(login: \"" + orgName + "\") { repositories(first:" + strconv.Itoa(gcs) + ") { edges { node { name nameWithOwner url sshUrl } cursor } pageInfo { endCursor hasNextPage }}}}"
+	reqBody := "query { organization(login: \"" + orgName + "\") { repositories(first:" + strconv.Itoa(gcs) + ") { edges { node { " + githubRepoNodeFields + " } cursor } pageInfo { endCursor hasNextPage }}}}"
 
 	for {
 		payload, err := createGithubRequestPayload(reqBody)
@@ -364,7 +484,7 @@ func (gh *GitHubHost) describeGithubOrgRepos(orgName string) ([]repository, erro
 			return nil, errors.Wrap(err, "failed to create request payload")
 		}
 
-		bodyStr, err := gh.makeGithubRequest(payload)
+		bodyStr, err := gh.makeGithubRequest(ctx, payload)
 		if err != nil {
 			logger.Print(err)
 
@@ -394,33 +514,27 @@ func (gh *GitHubHost) describeGithubOrgRepos(orgName string) ([]repository, erro
 		}
 
 		for _, repo := range respObj.Data.Organization.Repositories.Edges {
-			repos = append(repos, repository{
-				Name:              repo.Node.Name,
-				SSHUrl:            repo.Node.SSHURL,
-				HTTPSUrl:          repo.Node.URL,
-				PathWithNameSpace: repo.Node.NameWithOwner,
-				Domain:            gitHubDomain,
-			})
+			repos = append(repos, repo.repository(gh.domain()))
 		}
 
 		if !respObj.Data.Organization.Repositories.PageInfo.HasNextPage {
 			break
 		} else {
-			reqBody = "query { organization(login: \"" + orgName + "\") { repositories(first:" + strconv.Itoa(gcs) + " after: \"" + respObj.Data.Organization.Repositories.PageInfo.EndCursor + "\") { edges { node { name nameWithOwner url sshUrl } cursor } pageInfo { endCursor hasNextPage }}}}"
+			reqBody = "query { organization(login: \"" + orgName + "\") { repositories(first:" + strconv.Itoa(gcs) + " after: \"" + respObj.Data.Organization.Repositories.PageInfo.EndCursor + "\") { edges { node { " + githubRepoNodeFields + " } cursor } pageInfo { endCursor hasNextPage }}}}"
 		}
 	}
 
 	return repos, nil
 }
 
-func (gh *GitHubHost) describeRepos() (describeReposOutput, errors.E) {
+func (gh *GitHubHost) describeRepos(ctx context.Context) (describeReposOutput, errors.E) {
 	var repos []repository
 
 	if !gh.SkipUserRepos {
 		// get authenticated user's owned repos
 		var err errors.E
 
-		repos, err = gh.describeGithubUserRepos()
+		repos, err = gh.describeGithubUserRepos(ctx)
 		if err != nil {
 			logger.Print("failed to get GitHub user repos")
 
@@ -436,7 +550,7 @@ func (gh *GitHubHost) describeRepos() (describeReposOutput, errors.E) {
 		// delete the wildcard, leaving any existing specified orgs that may have been passed in
 		orgs = remove(orgs, "*")
 		// get a list of orgs the authenticated user belongs to
-		githubOrgs, err := gh.describeGithubUserOrganizations()
+		githubOrgs, err := gh.describeGithubUserOrganizations(ctx)
 		if err != nil {
 			logger.Print("failed to get user's GitHub organizations")
 
@@ -450,7 +564,7 @@ func (gh *GitHubHost) describeRepos() (describeReposOutput, errors.E) {
 
 	// append repos belonging to any orgs specified
 	for _, org := range orgs {
-		dRepos, err := gh.describeGithubOrgRepos(org)
+		dRepos, err := gh.describeGithubOrgRepos(ctx, org)
 		if err != nil {
 			logger.Printf("failed to get GitHub organization %s repos", org)
 
@@ -485,29 +599,14 @@ func removeDuplicates(repos []repository) []repository {
 	return uniqueRepos
 }
 
-func gitHubWorker(logLevel int, token, backupDIR, diffRemoteMethod string, backupsToKeep int, jobs <-chan repository, results chan<- RepoBackupResults) {
-	for repo := range jobs {
-		firstPos := strings.Index(repo.HTTPSUrl, "//")
-		repo.URLWithToken = fmt.Sprintf("%s%s@%s", repo.HTTPSUrl[:firstPos+2], stripTrailing(token, "\n"), repo.HTTPSUrl[firstPos+2:])
-		err := processBackup(logLevel, repo, backupDIR, backupsToKeep, diffRemoteMethod)
-
-		backupResult := RepoBackupResults{
-			Repo: repo.PathWithNameSpace,
-		}
-
-		status := statusOk
-		if err != nil {
-			status = statusFailed
-			backupResult.Error = err
-		}
-
-		backupResult.Status = status
-
-		results <- backupResult
-	}
+func (gh *GitHubHost) Backup() ProviderBackupResult {
+	return gh.BackupWithContext(context.Background())
 }
 
-func (gh *GitHubHost) Backup() ProviderBackupResult {
+// BackupWithContext backs up the host's repositories. Cancelling the context stops
+// pending jobs and kills any in-flight git commands, with the results of repositories
+// not backed up marked as cancelled.
+func (gh *GitHubHost) BackupWithContext(ctx context.Context) ProviderBackupResult {
 	if gh.BackupDir == "" {
 		logger.Printf("backup skipped as backup directory not specified")
 
@@ -517,9 +616,9 @@ func (gh *GitHubHost) Backup() ProviderBackupResult {
 		}
 	}
 
-	maxConcurrent := 10
+	maxConcurrent := workerCount(gh.Concurrency, githubDefaultConcurrency)
 
-	repoDesc, err := gh.describeRepos()
+	repoDesc, err := describeProviderRepos(ctx, gh, gh.Observer)
 	if err != nil {
 		return ProviderBackupResult{
 			BackupResults: nil,
@@ -527,32 +626,21 @@ func (gh *GitHubHost) Backup() ProviderBackupResult {
 		}
 	}
 
-	jobs := make(chan repository, len(repoDesc.Repos))
-	results := make(chan RepoBackupResults, maxConcurrent)
-
-	for w := 1; w <= maxConcurrent; w++ {
-		go gitHubWorker(gh.LogLevel, gh.Token, gh.BackupDir, gh.DiffRemoteMethod, gh.BackupsToRetain, jobs, results)
-	}
-
 	for x := range repoDesc.Repos {
-		repo := repoDesc.Repos[x]
-		jobs <- repo
-	}
-
-	close(jobs)
-
-	var providerBackupResults ProviderBackupResult
-
-	for a := 1; a <= len(repoDesc.Repos); a++ {
-		res := <-results
-		if res.Error != nil {
-			logger.Printf("backup failed: %+v\n", errors.Unwrap(res.Error))
+		repoDesc.Repos[x].credentials = gitCredentials{
+			username: tokenUsername,
+			password: stripTrailing(gh.Token, "\n"),
 		}
-
-		providerBackupResults.BackupResults = append(providerBackupResults.BackupResults, res)
 	}
 
-	return providerBackupResults
+	return backupRepos(ctx, repoDesc.Repos, maxConcurrent, gh.backupInput(processBackupInput{
+		logLevel:         gh.LogLevel,
+		backupDir:        gh.BackupDir,
+		backupsToKeep:    gh.BackupsToRetain,
+		diffRemoteMethod: gh.diffRemoteMethod(),
+		provider:         gh.Name(),
+		tls:              gh.TLS,
+	}))
 }
 
 // return normalised method.
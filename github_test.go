@@ -2,7 +2,11 @@ package githosts
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -101,7 +105,7 @@ func TestDescribeGithubOrgRepos(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	repos, err := gh.describeGithubOrgRepos("Nudelmesse")
+	repos, err := gh.describeGithubOrgRepos(context.Background(), "Nudelmesse")
 	require.NoError(t, err)
 	require.Len(t, repos, 4)
 }
@@ -287,7 +291,7 @@ func TestDescribeGithubReposWithWildcard(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	descReposResp, err := gh.describeRepos()
+	descReposResp, err := gh.describeRepos(context.Background())
 	require.NoError(t, err)
 
 	require.True(t, repoExists(repoExistsInput{
@@ -369,7 +373,7 @@ func TestDescribeGithubReposWithWildcardAndLimitUserOwned(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	descReposResp, err := gh.describeRepos()
+	descReposResp, err := gh.describeRepos(context.Background())
 	require.NoError(t, err)
 
 	require.True(t, repoExists(repoExistsInput{
@@ -452,7 +456,7 @@ func TestDescribeGithubReposWithWildcardAndNoLimitUserOwned(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	descReposResp, err := gh.describeRepos()
+	descReposResp, err := gh.describeRepos(context.Background())
 	require.NoError(t, err)
 
 	require.True(t, repoExists(repoExistsInput{
@@ -536,7 +540,7 @@ func TestDescribeGithubReposWithSkipUserRepos(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	descReposResp, err := gh.describeRepos()
+	descReposResp, err := gh.describeRepos(context.Background())
 	require.NoError(t, err)
 
 	require.True(t, repoExists(repoExistsInput{
@@ -618,3 +622,132 @@ func TestDiffRemoteMethodReturnsCloneMethodWhenInputIsEmpty(t *testing.T) {
 
 	assert.Equal(t, "clone", result)
 }
+
+func TestGitHubEdgeRepository(t *testing.T) {
+	t.Parallel()
+
+	var respObj githubQueryNamesResponse
+
+	require.NoError(t, json.Unmarshal([]byte(`{"data": {"viewer": {"repositories": {"edges": [
+  {"node": {"name": "repo0", "nameWithOwner": "go-soba/repo0", "url": "https://github.com/go-soba/repo0",
+    "sshUrl": "git@github.com:go-soba/repo0.git", "isPrivate": true, "isFork": true, "isArchived": true,
+    "diskUsage": 3, "defaultBranchRef": {"name": "main"}}},
+  {"node": {"name": "empty", "nameWithOwner": "go-soba/empty", "url": "https://github.com/go-soba/empty",
+    "defaultBranchRef": null}}
+]}}}}`), &respObj))
+
+	edges := respObj.Data.Viewer.Repositories.Edges
+	require.Len(t, edges, 2)
+
+	require.Equal(t, repository{
+		Name:              "repo0",
+		PathWithNameSpace: "go-soba/repo0",
+		Domain:            gitHubDomain,
+		HTTPSUrl:          "https://github.com/go-soba/repo0",
+		SSHUrl:            "git@github.com:go-soba/repo0.git",
+		Private:           true,
+		Fork:              true,
+		Archived:          true,
+		Size:              3 * bytesPerKB,
+		DefaultBranch:     "main",
+	}, edges[0].repository(gitHubDomain))
+
+	require.Empty(t, edges[1].repository(gitHubDomain).DefaultBranch)
+}
+
+func TestGitHubEndpoints(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		apiURL  string
+		graphQL string
+		domain  string
+	}{
+		{apiURL: githubAPIURL, graphQL: githubAPIURL, domain: gitHubDomain},
+		{apiURL: "https://api.github.com", graphQL: githubAPIURL, domain: gitHubDomain},
+		{apiURL: "https://api.soba.ghe.com/graphql", graphQL: "https://api.soba.ghe.com/graphql", domain: "soba.ghe.com"},
+		{apiURL: "https://github.example.com/api/graphql", graphQL: "https://github.example.com/api/graphql", domain: "github.example.com"},
+		{apiURL: "https://github.example.com/api/v3/", graphQL: "https://github.example.com/api/graphql", domain: "github.example.com"},
+		{apiURL: "https://github.example.com:8443/api", graphQL: "https://github.example.com:8443/api/graphql", domain: "github.example.com"},
+		{apiURL: "https://example.com/github", graphQL: "https://example.com/github/api/graphql", domain: "example.com"},
+	} {
+		graphQL, domain, err := gitHubEndpoints(tc.apiURL)
+		require.NoError(t, err, tc.apiURL)
+		require.Equal(t, tc.graphQL, graphQL, tc.apiURL)
+		require.Equal(t, tc.domain, domain, tc.apiURL)
+	}
+
+	for _, apiURL := range []string{"github.example.com/api/v3", "ftp://github.example.com", "://"} {
+		_, _, err := gitHubEndpoints(apiURL)
+		require.ErrorContains(t, err, "invalid GitHub API URL", apiURL)
+	}
+}
+
+func TestGitHubEnterpriseServer(t *testing.T) {
+	t.Parallel()
+
+	const token = "ghp_s3cr3t"
+
+	sourcePath := createTestGitRepo(t)
+	gitHandler := testGitHTTPHandler(t, filepath.Dir(sourcePath), tokenUsername, token)
+
+	// a stand-in for an instance serving the GraphQL API and git
+	var server *httptest.Server
+
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/graphql" {
+			gitHandler.ServeHTTP(w, r)
+
+			return
+		}
+
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"data": {"viewer": {"repositories": {"edges": [{"node": {"name": "source",
+  "nameWithOwner": "soba/source", "url": "` + server.URL + `/source", "defaultBranchRef": {"name": "main"}}}],
+  "pageInfo": {"hasNextPage": false}}}}}`))
+	}))
+	defer server.Close()
+
+	backupDir := t.TempDir()
+
+	gh, err := NewGitHubHost(NewGitHubHostInput{
+		APIURL:    server.URL + "/api/v3",
+		BackupDir: backupDir,
+		Token:     token,
+		TLS:       &TLSConfig{CAFile: writeTestCAFile(t, server)},
+	})
+	require.NoError(t, err)
+	require.Equal(t, server.URL+"/api/graphql", gh.GetAPIURL())
+	require.Equal(t, "127.0.0.1", gh.Domain)
+
+	repos, err := gh.ListRepositories(context.Background())
+	require.NoError(t, err)
+	require.Len(t, repos, 1)
+	require.Equal(t, "127.0.0.1", repos[0].Domain)
+
+	result := gh.Backup()
+	require.NoError(t, result.Error)
+	require.Len(t, result.BackupResults, 1)
+	require.Equal(t, StatusCreated, result.BackupResults[0].Status)
+	require.DirExists(t, filepath.Join(backupDir, "127.0.0.1", "soba", "source"))
+
+	// the domain can be set in place of that of the API
+	gh, err = NewGitHubHost(NewGitHubHostInput{
+		APIURL: server.URL + "/api/v3",
+		Domain: "github.example.com",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "github.example.com", gh.domain())
+
+	// the TLS config can't be applied to a custom client
+	_, err = NewGitHubHost(NewGitHubHostInput{
+		HTTPClient: getHTTPClient(),
+		TLS:        &TLSConfig{},
+	})
+	require.Error(t, err)
+}
@@ -23,6 +23,7 @@ const (
 	// GitLabDefaultMinimumProjectAccessLevel https://docs.gitlab.com/ee/user/permissions.html#roles
 	GitLabDefaultMinimumProjectAccessLevel = 20
 	gitLabDomain                           = "gitlab.com"
+	gitLabProviderName                     = "GitLab"
 )
 
 type gitlabUser struct {
@@ -41,9 +42,13 @@ type GitLabHost struct {
 	Token                 string
 	User                  gitlabUser
 	LogLevel              int
+	BackupOptions
+	Domain string
+	TLS    *TLSConfig
+	Groups []string
 }
 
-func (gl *GitLabHost) getAuthenticatedGitLabUser() (gitlabUser, errors.E) {
+func (gl *GitLabHost) getAuthenticatedGitLabUser(ctx context.Context) (gitlabUser, errors.E) {
 	gitlabToken := strings.TrimSpace(gl.Token)
 	if gitlabToken == "" {
 		return gitlabUser{}, errors.New("GitLab token not provided")
@@ -58,7 +63,7 @@ func (gl *GitLabHost) getAuthenticatedGitLabUser() (gitlabUser, errors.E) {
 
 	getUserIDURL := gl.APIURL + "/user"
 
-	ctx, cancel := context.WithTimeout(context.Background(), defaultHttpRequestTimeout)
+	ctx, cancel := context.WithTimeout(ctx, defaultHttpRequestTimeout)
 	defer cancel()
 
 	var req *retryablehttp.Request
@@ -126,6 +131,16 @@ type gitLabProject struct {
 	HTTPSURL          string      `json:"http_url_to_repo"`
 	SSHURL            string      `json:"ssh_url_to_repo"`
 	Owner             gitLabOwner `json:"owner"`
+	Visibility        string      `json:"visibility"`
+	Archived          bool        `json:"archived"`
+	DefaultBranch     string      `json:"default_branch"`
+	// ForkedFromProject is only set for forks
+	ForkedFromProject *struct {
+		ID int64 `json:"id"`
+	} `json:"forked_from_project"`
+	Statistics struct {
+		RepositorySize int64 `json:"repository_size"`
+	} `json:"statistics"`
 }
 type gitLabGetProjectsResponse []gitLabProject
 
@@ -136,7 +151,7 @@ var validAccessLevels = map[int]string{
 	50: "Owner",
 }
 
-func (gl *GitLabHost) getAllProjectRepositories(client http.Client) ([]repository, errors.E) {
+func (gl *GitLabHost) getAllProjectRepositories(ctx context.Context, client http.Client) ([]repository, errors.E) {
 	var sortedLevels []int
 	for k := range validAccessLevels {
 		sortedLevels = append(sortedLevels, k)
@@ -150,14 +165,10 @@ func (gl *GitLabHost) getAllProjectRepositories(client http.Client) ([]repositor
 		validMinimumProjectAccessLevels = append(validMinimumProjectAccessLevels, fmt.Sprintf("%s (%d)", validAccessLevels[level], level))
 	}
 
-	logger.Printf("retrieving all projects for user %s (%d):", gl.User.UserName, gl.User.ID)
-
 	if strings.TrimSpace(gl.APIURL) == "" {
 		gl.APIURL = gitlabAPIURL
 	}
 
-	getProjectsURL := gl.APIURL + "/projects"
-
 	if gl.ProjectMinAccessLevel == 0 {
 		gl.ProjectMinAccessLevel = GitLabDefaultMinimumProjectAccessLevel
 	}
@@ -173,8 +184,88 @@ func (gl *GitLabHost) getAllProjectRepositories(client http.Client) ([]repositor
 		validAccessLevels[gl.ProjectMinAccessLevel],
 		gl.ProjectMinAccessLevel)
 
-	// Initial request
-	u, err := url.Parse(getProjectsURL)
+	if len(gl.Groups) > 0 {
+		return gl.getGroupsProjectRepositories(ctx, client)
+	}
+
+	logger.Printf("retrieving all projects for user %s (%d):", gl.User.UserName, gl.User.ID)
+
+	return gl.getProjectRepositories(ctx, client, gl.APIURL+"/projects", nil)
+}
+
+// getGroupsProjectRepositories returns the repositories of the projects in the host's groups
+// and their subgroups, with the wildcard selecting every group the user is a member of.
+// Projects in more than one of the groups are only returned once.
+func (gl *GitLabHost) getGroupsProjectRepositories(ctx context.Context, client http.Client) ([]repository, errors.E) {
+	groups := gl.Groups
+
+	if slices.Contains(gl.Groups, "*") {
+		memberGroups, err := gl.getMemberGroups(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+
+		groups = append(remove(slices.Clone(gl.Groups), "*"), memberGroups...)
+	}
+
+	var repos []repository
+
+	for _, group := range groups {
+		logger.Printf("retrieving projects for group %s", group)
+
+		groupRepos, err := gl.getProjectRepositories(ctx, client,
+			gl.APIURL+"/groups/"+url.PathEscape(group)+"/projects",
+			url.Values{"include_subgroups": {"true"}})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get projects for group %s", group)
+		}
+
+		repos = append(repos, groupRepos...)
+	}
+
+	return removeDuplicates(repos), nil
+}
+
+type gitLabGroup struct {
+	FullPath string `json:"full_path"`
+}
+
+// getMemberGroups returns the full paths of the groups the user is a member of.
+func (gl *GitLabHost) getMemberGroups(ctx context.Context, client http.Client) ([]string, errors.E) {
+	u, err := url.Parse(gl.APIURL + "/groups")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse url")
+	}
+
+	q := u.Query()
+	q.Set("per_page", strconv.Itoa(gitlabProjectsPerPageDefault))
+	q.Set("min_access_level", strconv.Itoa(gl.ProjectMinAccessLevel))
+	u.RawQuery = q.Encode()
+
+	var groups []string
+
+	if pErr := gl.getPages(ctx, client, u.String(), "groups", func(body []byte) errors.E {
+		var respObj []gitLabGroup
+
+		if uErr := json.Unmarshal(body, &respObj); uErr != nil {
+			return errors.Errorf("failed to unmarshall gitlab json response: %s", uErr.Error())
+		}
+
+		for _, group := range respObj {
+			groups = append(groups, group.FullPath)
+		}
+
+		return nil
+	}); pErr != nil {
+		return nil, pErr
+	}
+
+	return groups, nil
+}
+
+// getProjectRepositories returns the repositories of the projects listed by the endpoint.
+func (gl *GitLabHost) getProjectRepositories(ctx context.Context, client http.Client, projectsURL string, params url.Values) ([]repository, errors.E) {
+	u, err := url.Parse(projectsURL)
 	if err != nil {
 		logger.Print(err)
 
@@ -182,27 +273,65 @@ func (gl *GitLabHost) getAllProjectRepositories(client http.Client) ([]repositor
 	}
 
 	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
 	// set initial max per page
 	q.Set("per_page", strconv.Itoa(gitlabProjectsPerPageDefault))
 	q.Set("min_access_level", strconv.Itoa(gl.ProjectMinAccessLevel))
+	// include repository sizes
+	q.Set("statistics", "true")
 	u.RawQuery = q.Encode()
 
-	var body []byte
+	var repos []repository
 
-	reqUrl := u.String()
+	if pErr := gl.getPages(ctx, client, u.String(), "projects", func(body []byte) errors.E {
+		var respObj gitLabGetProjectsResponse
 
-	var repos []repository
+		if uErr := json.Unmarshal(body, &respObj); uErr != nil {
+			logger.Println(uErr)
 
-	for {
-		var resp *http.Response
+			return errors.Errorf("failed to unmarshall gitlab json response: %s", uErr.Error())
+		}
 
-		var rErr errors.E
+		for _, project := range respObj {
+			// gitlab replaces hyphens with spaces in owner names, so fix
+			owner := strings.ReplaceAll(project.Owner.Name, " ", "-")
+			// internal projects are visible to any signed in user, but aren't public, so are private
+			repo := repository{
+				Name:              project.Path,
+				Owner:             owner,
+				PathWithNameSpace: project.PathWithNameSpace,
+				HTTPSUrl:          project.HTTPSURL,
+				SSHUrl:            project.SSHURL,
+				Domain:            gl.domain(),
+				Private:           project.Visibility != "public",
+				Fork:              project.ForkedFromProject != nil,
+				Archived:          project.Archived,
+				Size:              project.Statistics.RepositorySize,
+				DefaultBranch:     project.DefaultBranch,
+			}
 
-		resp, body, rErr = makeGitLabRequest(&client, reqUrl, gl.Token)
+			repos = append(repos, repo)
+		}
+
+		return nil
+	}); pErr != nil {
+		return []repository{}, pErr
+	}
+
+	return repos, nil
+}
+
+// getPages requests reqUrl and each following page, passing each page's body to fn.
+// The description, such as "projects", is used in logs and errors.
+func (gl *GitLabHost) getPages(ctx context.Context, client http.Client, reqUrl, description string, fn func(body []byte) errors.E) errors.E {
+	for reqUrl != "" {
+		resp, body, rErr := makeGitLabRequest(ctx, &client, reqUrl, gl.Token)
 		if rErr != nil {
 			logger.Print(rErr)
 
-			return []repository{}, rErr
+			return rErr
 		}
 
 		if gl.LogLevel > 0 {
@@ -212,39 +341,20 @@ func (gl *GitLabHost) getAllProjectRepositories(client http.Client) ([]repositor
 		switch resp.StatusCode {
 		case http.StatusOK:
 			if gl.LogLevel > 0 {
-				logger.Println("projects retrieved successfully")
+				logger.Printf("%s retrieved successfully", description)
 			}
 		case http.StatusForbidden:
-			logger.Println("failed to get projects due to invalid missing permissions (HTTP 403)")
+			logger.Printf("failed to get %s due to invalid missing permissions (HTTP 403)", description)
 
-			return []repository{}, errors.New("failed to get projects due to invalid missing permissions (HTTP 403)")
+			return errors.Errorf("failed to get %s due to invalid missing permissions (HTTP 403)", description)
 		default:
-			logger.Printf("failed to get projects due to unexpected response: %d (%s)", resp.StatusCode, resp.Status)
+			logger.Printf("failed to get %s due to unexpected response: %d (%s)", description, resp.StatusCode, resp.Status)
 
-			return []repository{}, errors.Errorf("failed to get projects due to unexpected response: %d (%s)", resp.StatusCode, resp.Status)
+			return errors.Errorf("failed to get %s due to unexpected response: %d (%s)", description, resp.StatusCode, resp.Status)
 		}
 
-		var respObj gitLabGetProjectsResponse
-
-		if err = json.Unmarshal(body, &respObj); err != nil {
-			logger.Println(err)
-
-			return []repository{}, errors.Errorf("failed to unmarshall gitlab json response: %s", err.Error())
-		}
-
-		for _, project := range respObj {
-			// gitlab replaces hyphens with spaces in owner names, so fix
-			owner := strings.ReplaceAll(project.Owner.Name, " ", "-")
-			repo := repository{
-				Name:              project.Path,
-				Owner:             owner,
-				PathWithNameSpace: project.PathWithNameSpace,
-				HTTPSUrl:          project.HTTPSURL,
-				SSHUrl:            project.SSHURL,
-				Domain:            gitLabDomain,
-			}
-
-			repos = append(repos, repo)
+		if err := fn(body); err != nil {
+			return err
 		}
 
 		// if we got a link response then
@@ -256,17 +366,13 @@ func (gl *GitLabHost) getAllProjectRepositories(client http.Client) ([]repositor
 				reqUrl = l.URI
 			}
 		}
-
-		if reqUrl == "" {
-			break
-		}
 	}
 
-	return repos, nil
+	return nil
 }
 
-func makeGitLabRequest(c *http.Client, reqUrl, token string) (*http.Response, []byte, errors.E) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultHttpRequestTimeout)
+func makeGitLabRequest(ctx context.Context, c *http.Client, reqUrl, token string) (*http.Response, []byte, errors.E) {
+	ctx, cancel := context.WithTimeout(ctx, defaultHttpRequestTimeout)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqUrl, nil)
@@ -305,6 +411,17 @@ type NewGitLabHostInput struct {
 	ProjectMinAccessLevel int
 	BackupsToRetain       int
 	LogLevel              int
+	BackupOptions
+	// Domain is the domain repositories are stored under, defaulting to the host of APIURL,
+	// so that repositories from different instances are kept apart.
+	Domain string
+	// TLS configures connections to a self-managed instance, such as one with certificates
+	// issued by a private authority. It can't be used with HTTPClient.
+	TLS *TLSConfig
+	// Groups limits the backup to the projects in these groups and their subgroups, given
+	// by ID or full path, with "*" selecting every group the user is a member of. All
+	// projects the user can access are backed up if none are given.
+	Groups []string
 }
 
 func NewGitLabHost(input NewGitLabHostInput) (*GitLabHost, error) {
@@ -315,6 +432,16 @@ func NewGitLabHost(input NewGitLabHostInput) (*GitLabHost, error) {
 		apiURL = input.APIURL
 	}
 
+	domain := input.Domain
+	if domain == "" {
+		u, uErr := url.Parse(apiURL)
+		if uErr != nil || u.Hostname() == "" {
+			return nil, errors.Errorf("invalid GitLab API URL: %s", apiURL)
+		}
+
+		domain = strings.ToLower(u.Hostname())
+	}
+
 	diffRemoteMethod, err := getDiffRemoteMethod(input.DiffRemoteMethod)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get diff remote method: %w", err)
@@ -327,9 +454,20 @@ func NewGitLabHost(input NewGitLabHostInput) (*GitLabHost, error) {
 		logger.Print("using diff remote method: " + diffRemoteMethod)
 	}
 
+	if err = input.validate(input.BackupsToRetain); err != nil {
+		return nil, err
+	}
+
+	if input.TLS != nil && input.HTTPClient != nil {
+		return nil, errors.New("TLS config can't be used with a custom HTTP client")
+	}
+
 	httpClient := input.HTTPClient
 	if httpClient == nil {
-		httpClient = getHTTPClient()
+		var clientErr errors.E
+		if httpClient, clientErr = input.TLS.httpClient(); clientErr != nil {
+			return nil, clientErr
+		}
 	}
 
 	return &GitLabHost{
@@ -342,21 +480,31 @@ func NewGitLabHost(input NewGitLabHostInput) (*GitLabHost, error) {
 		Token:                 input.Token,
 		ProjectMinAccessLevel: input.ProjectMinAccessLevel,
 		LogLevel:              input.LogLevel,
+		BackupOptions:         input.BackupOptions,
+		Domain:                domain,
+		TLS:                   input.TLS,
+		Groups:                input.Groups,
 	}, nil
 }
 
-func (gl *GitLabHost) describeRepos() (describeReposOutput, errors.E) {
+func (gl *GitLabHost) describeRepos(ctx context.Context) (describeReposOutput, errors.E) {
 	logger.Println("listing repositories")
 
+	tlsConfig, err := gl.TLS.tlsClientConfig()
+	if err != nil {
+		return describeReposOutput{}, err
+	}
+
 	tr := &http.Transport{
 		MaxIdleConns:       maxIdleConns,
 		IdleConnTimeout:    idleConnTimeout,
 		DisableCompression: true,
+		TLSClientConfig:    tlsConfig,
 	}
 
 	client := &http.Client{Transport: tr}
 
-	userRepos, err := gl.getAllProjectRepositories(*client)
+	userRepos, err := gl.getAllProjectRepositories(ctx, *client)
 	if err != nil {
 		return describeReposOutput{}, err
 	}
@@ -366,44 +514,53 @@ func (gl *GitLabHost) describeRepos() (describeReposOutput, errors.E) {
 	}, nil
 }
 
+// domain returns the domain repositories are stored under, defaulting to gitlab.com.
+func (gl *GitLabHost) domain() string {
+	if gl.Domain == "" {
+		return gitLabDomain
+	}
+
+	return gl.Domain
+}
+
 func (gl *GitLabHost) getAPIURL() string {
 	return gl.APIURL
 }
 
-func gitlabWorker(logLevel int, userName, token, backupDIR, diffRemoteMethod string, backupsToKeep int, jobs <-chan repository, results chan<- RepoBackupResults) {
-	for repo := range jobs {
-		firstPos := strings.Index(repo.HTTPSUrl, "//")
-		repo.URLWithToken = repo.HTTPSUrl[:firstPos+2] + userName + ":" + stripTrailing(token, "\n") + "@" + repo.HTTPSUrl[firstPos+2:]
-		err := processBackup(logLevel, repo, backupDIR, backupsToKeep, diffRemoteMethod)
-
-		backupResult := RepoBackupResults{
-			Repo: repo.PathWithNameSpace,
-		}
-
-		status := statusOk
-		if err != nil {
-			status = statusFailed
-			backupResult.Error = err
-		}
+// GetAPIURL returns the URL of the GitLab API.
+func (gl *GitLabHost) GetAPIURL() string {
+	return gl.getAPIURL()
+}
 
-		backupResult.Status = status
+// Name returns the name of the provider.
+func (gl *GitLabHost) Name() string {
+	return gitLabProviderName
+}
 
-		results <- backupResult
-	}
+// ListRepositories returns the repositories available to back up.
+func (gl *GitLabHost) ListRepositories(ctx context.Context) ([]Repository, errors.E) {
+	return listRepositories(ctx, gl, gl.Filter, gl.Observer)
 }
 
 func (gl *GitLabHost) Backup() ProviderBackupResult {
+	return gl.BackupWithContext(context.Background())
+}
+
+// BackupWithContext backs up the host's repositories. Cancelling the context stops
+// pending jobs and kills any in-flight git commands, with the results of repositories
+// not backed up marked as cancelled.
+func (gl *GitLabHost) BackupWithContext(ctx context.Context) ProviderBackupResult {
 	if gl.BackupDir == "" {
 		logger.Printf("backup skipped as backup directory not specified")
 
 		return ProviderBackupResult{}
 	}
 
-	maxConcurrent := 5
+	maxConcurrent := workerCount(gl.Concurrency, gitlabDefaultConcurrency)
 
 	var err errors.E
 
-	gl.User, err = gl.getAuthenticatedGitLabUser()
+	gl.User, err = gl.getAuthenticatedGitLabUser(ctx)
 	if err != nil {
 		return ProviderBackupResult{
 			BackupResults: nil,
@@ -416,39 +573,28 @@ func (gl *GitLabHost) Backup() ProviderBackupResult {
 		return ProviderBackupResult{}
 	}
 
-	repoDesc, err := gl.describeRepos()
+	repoDesc, err := describeProviderRepos(ctx, gl, gl.Observer)
 	if err != nil {
 		return ProviderBackupResult{
 			Error: errors.Wrap(err, "failed to describe repos"),
 		}
 	}
 
-	jobs := make(chan repository, len(repoDesc.Repos))
-	results := make(chan RepoBackupResults, maxConcurrent)
-
-	for w := 1; w <= maxConcurrent; w++ {
-		go gitlabWorker(gl.LogLevel, gl.User.UserName, gl.Token, gl.BackupDir, gl.diffRemoteMethod(), gl.BackupsToRetain, jobs, results)
-	}
-
-	var providerBackupResults ProviderBackupResult
-
 	for x := range repoDesc.Repos {
-		repo := repoDesc.Repos[x]
-		jobs <- repo
-	}
-
-	close(jobs)
-
-	for a := 1; a <= len(repoDesc.Repos); a++ {
-		res := <-results
-		if res.Error != nil {
-			logger.Printf("backup failed: %+v\n", res.Error)
+		repoDesc.Repos[x].credentials = gitCredentials{
+			username: gl.User.UserName,
+			password: stripTrailing(gl.Token, "\n"),
 		}
-
-		providerBackupResults.BackupResults = append(providerBackupResults.BackupResults, res)
 	}
 
-	return providerBackupResults
+	return backupRepos(ctx, repoDesc.Repos, maxConcurrent, gl.backupInput(processBackupInput{
+		logLevel:         gl.LogLevel,
+		backupDir:        gl.BackupDir,
+		backupsToKeep:    gl.BackupsToRetain,
+		diffRemoteMethod: gl.diffRemoteMethod(),
+		provider:         gl.Name(),
+		tls:              gl.TLS,
+	}))
 }
 
 // return normalised method.
@@ -1,6 +1,10 @@
 package githosts
 
 import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
@@ -85,3 +89,223 @@ func TestPublicGitLabRepositoryBackupRefsMethod(t *testing.T) {
 	require.Len(t, projectTwoEntries, 1)
 	require.Contains(t, projectTwoEntries[0].Name(), "soba-sub-project-two.")
 }
+
+func TestGitLabListRepositories(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/projects", r.URL.Path)
+		require.Equal(t, "true", r.URL.Query().Get("statistics"))
+
+		_, _ = w.Write([]byte(`[
+  {
+    "path": "repo-one",
+    "path_with_namespace": "soba-test/repo-one",
+    "http_url_to_repo": "https://gitlab.com/soba-test/repo-one.git",
+    "ssh_url_to_repo": "git@gitlab.com:soba-test/repo-one.git",
+    "owner": {"name": "soba test"},
+    "visibility": "private",
+    "archived": true,
+    "default_branch": "main",
+    "forked_from_project": {"id": 1},
+    "statistics": {"repository_size": 2048}
+  },
+  {
+    "path": "repo-two",
+    "path_with_namespace": "soba-test/repo-two",
+    "http_url_to_repo": "https://gitlab.com/soba-test/repo-two.git",
+    "visibility": "public"
+  },
+  {
+    "path": "repo-three",
+    "path_with_namespace": "soba-test/repo-three",
+    "http_url_to_repo": "https://gitlab.com/soba-test/repo-three.git",
+    "visibility": "internal"
+  }
+]`))
+	}))
+	defer ts.Close()
+
+	gl, err := NewGitLabHost(NewGitLabHostInput{
+		APIURL:    ts.URL,
+		BackupDir: t.TempDir(),
+		Token:     "test-token",
+	})
+	require.NoError(t, err)
+
+	repos, err := gl.ListRepositories(context.Background())
+	require.NoError(t, err)
+	require.Len(t, repos, 3)
+
+	require.Equal(t, Repository{
+		Name:              "repo-one",
+		Owner:             "soba-test",
+		PathWithNameSpace: "soba-test/repo-one",
+		Domain:            "127.0.0.1",
+		HTTPSUrl:          "https://gitlab.com/soba-test/repo-one.git",
+		SSHUrl:            "git@gitlab.com:soba-test/repo-one.git",
+		Private:           true,
+		Fork:              true,
+		Archived:          true,
+		Size:              2048,
+		DefaultBranch:     "main",
+	}, repos[0])
+
+	require.False(t, repos[1].Private)
+	require.False(t, repos[1].Fork)
+	require.False(t, repos[1].Archived)
+
+	require.True(t, repos[2].Private)
+}
+
+func TestGitLabHostDomain(t *testing.T) {
+	t.Parallel()
+
+	gl, err := NewGitLabHost(NewGitLabHostInput{})
+	require.NoError(t, err)
+	require.Equal(t, gitLabDomain, gl.Domain)
+
+	gl, err = NewGitLabHost(NewGitLabHostInput{APIURL: "https://GitLab.example.com:8443/api/v4"})
+	require.NoError(t, err)
+	require.Equal(t, "gitlab.example.com", gl.Domain)
+
+	gl, err = NewGitLabHost(NewGitLabHostInput{APIURL: "https://10.0.0.1/api/v4", Domain: "gitlab.internal"})
+	require.NoError(t, err)
+	require.Equal(t, "gitlab.internal", gl.Domain)
+
+	_, err = NewGitLabHost(NewGitLabHostInput{APIURL: "gitlab.example.com/api/v4"})
+	require.ErrorContains(t, err, "invalid GitLab API URL")
+}
+
+func TestSelfManagedGitLabWithClientCertificate(t *testing.T) {
+	t.Parallel()
+
+	const token = "glpat-s3cr3t"
+
+	sourcePath := createTestGitRepo(t)
+	gitHandler := testGitHTTPHandler(t, filepath.Dir(sourcePath), "soba", token)
+
+	// a stand-in for a self-managed instance requiring client certificates
+	var ts *httptest.Server
+
+	ts = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/user":
+			_, _ = w.Write([]byte(`{"id": 1, "username": "soba"}`))
+		case "/api/v4/projects":
+			_, _ = w.Write([]byte(`[{"path": "source", "path_with_namespace": "soba/source",
+  "http_url_to_repo": "` + ts.URL + `/source", "owner": {"name": "soba"}}]`))
+		default:
+			gitHandler.ServeHTTP(w, r)
+		}
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert, MinVersion: tls.VersionTLS12}
+	ts.StartTLS()
+
+	defer ts.Close()
+
+	certFile, keyFile := writeTestClientCertificate(t)
+	backupDir := t.TempDir()
+
+	newHost := func(c *TLSConfig) *GitLabHost {
+		gl, err := NewGitLabHost(NewGitLabHostInput{
+			APIURL:    ts.URL + "/api/v4",
+			BackupDir: backupDir,
+			Token:     token,
+			TLS:       c,
+		})
+		require.NoError(t, err)
+
+		return gl
+	}
+
+	// the instance's certificate isn't trusted
+	_, listErr := newHost(&TLSConfig{ClientCertFile: certFile, ClientKeyFile: keyFile}).ListRepositories(context.Background())
+	require.Error(t, listErr)
+
+	gl := newHost(&TLSConfig{ClientCertFile: certFile, ClientKeyFile: keyFile, InsecureSkipVerify: true})
+	require.Equal(t, "127.0.0.1", gl.Domain)
+
+	result := gl.Backup()
+	require.NoError(t, result.Error)
+	require.Len(t, result.BackupResults, 1)
+	require.Equal(t, StatusCreated, result.BackupResults[0].Status)
+	require.DirExists(t, filepath.Join(backupDir, "127.0.0.1", "soba", "source"))
+
+	// TLS config can't be applied to a custom client
+	_, err := NewGitLabHost(NewGitLabHostInput{HTTPClient: getHTTPClient(), TLS: &TLSConfig{}})
+	require.Error(t, err)
+}
+
+func TestGitLabListRepositoriesInGroups(t *testing.T) {
+	t.Parallel()
+
+	project := func(path string) string {
+		return `{"path": "` + filepath.Base(path) + `", "path_with_namespace": "` + path + `", "http_url_to_repo": "https://gitlab.com/` + path + `.git"}`
+	}
+
+	var ts *httptest.Server
+
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "30", r.URL.Query().Get("min_access_level"))
+
+		switch r.URL.EscapedPath() {
+		case "/groups":
+			// member groups are paged
+			if r.URL.Query().Get("page") == "" {
+				w.Header().Set("Link", `<`+ts.URL+`/groups?min_access_level=30&page=2>; rel="next"`)
+				_, _ = w.Write([]byte(`[{"id": 1, "full_path": "soba"}]`))
+
+				return
+			}
+
+			_, _ = w.Write([]byte(`[{"id": 2, "full_path": "soba/sub"}]`))
+		case "/groups/soba/projects":
+			require.Equal(t, "true", r.URL.Query().Get("include_subgroups"))
+			_, _ = w.Write([]byte(`[` + project("soba/repo-one") + `,` + project("soba/sub/repo-two") + `]`))
+		case "/groups/soba%2Fsub/projects":
+			require.Equal(t, "true", r.URL.Query().Get("include_subgroups"))
+			_, _ = w.Write([]byte(`[` + project("soba/sub/repo-two") + `]`))
+		case "/groups/42/projects":
+			_, _ = w.Write([]byte(`[` + project("other/repo-three") + `]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	listRepos := func(groups ...string) ([]string, error) {
+		gl, err := NewGitLabHost(NewGitLabHostInput{
+			APIURL:                ts.URL,
+			Token:                 "test-token",
+			ProjectMinAccessLevel: 30,
+			Groups:                groups,
+		})
+		require.NoError(t, err)
+
+		repos, listErr := gl.ListRepositories(context.Background())
+		if listErr != nil {
+			return nil, listErr
+		}
+
+		var paths []string
+		for _, repo := range repos {
+			paths = append(paths, repo.PathWithNameSpace)
+		}
+
+		return paths, nil
+	}
+
+	// subgroups' projects are included, but only once
+	paths, err := listRepos("soba/sub", "soba")
+	require.NoError(t, err)
+	require.Equal(t, []string{"soba/sub/repo-two", "soba/repo-one"}, paths)
+
+	// the wildcard selects the member groups, alongside any others
+	paths, err = listRepos("*", "42")
+	require.NoError(t, err)
+	require.Equal(t, []string{"other/repo-three", "soba/repo-one", "soba/sub/repo-two"}, paths)
+
+	_, err = listRepos("missing")
+	require.ErrorContains(t, err, "failed to get projects for group missing")
+}
@@ -3,6 +3,7 @@ package githosts
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -118,6 +119,10 @@ func getResponseBody(resp *http.Response) ([]byte, error) {
 
 func maskSecrets(content string, secret []string) string {
 	for _, s := range secret {
+		if s == "" {
+			continue
+		}
+
 		content = strings.ReplaceAll(content, s, strings.Repeat("*", len(s)))
 	}
 
@@ -136,22 +141,34 @@ type httpRequestInput struct {
 	timeout           time.Duration
 }
 
-func httpRequest(in httpRequestInput) ([]byte, http.Header, int, error) {
+func httpRequest(ctx context.Context, in httpRequestInput) ([]byte, http.Header, int, error) {
 	if in.method == "" {
 		return nil, nil, 0, errors.New("HTTP method not specified")
 	}
 
-	req, err := retryablehttp.NewRequest(in.method, in.url, in.reqBody)
+	req, err := retryablehttp.NewRequestWithContext(ctx, in.method, in.url, in.reqBody)
 	if err != nil {
 		return nil, nil, 0, fmt.Errorf("failed to request %s: %w", maskSecrets(in.url, in.secrets), err)
 	}
 
 	req.Header = in.headers
 
+	if in.basicAuthUser != "" {
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+
+		req.SetBasicAuth(in.basicAuthUser, in.basicAuthPassword)
+	}
+
 	var resp *http.Response
 
 	resp, err = in.client.Do(req)
 	if err != nil {
+		if masked := maskSecrets(err.Error(), in.secrets); masked != err.Error() {
+			return nil, nil, 0, errors.New("request failed: " + masked)
+		}
+
 		return nil, nil, 0, fmt.Errorf("request failed: %w", err)
 	}
 
@@ -0,0 +1,407 @@
+package githosts
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+	"gitlab.com/tozd/go/errors"
+)
+
+// git's error when there are no new objects to include in a bundle
+const emptyBundleStringCheck = "empty bundle"
+
+// incrementalBase is the existing bundle an incremental bundle builds upon.
+type incrementalBase struct {
+	bundlePath string
+	refs       gitRefs
+}
+
+// getIncrementalBase returns the latest bundle in backupPath to build an incremental
+// bundle upon, or nil if a full bundle should be written instead. A new chain is
+// started once the existing one reaches maxChainLength bundles so older chains can
+// be pruned.
+func getIncrementalBase(ctx context.Context, store Storage, backupPath string, maxChainLength int) *incrementalBase {
+	if !dirHasBundles(ctx, store, backupPath) {
+		return nil
+	}
+
+	latestBundlePath, err := getLatestBundlePath(ctx, store, backupPath)
+	if err != nil {
+		return nil
+	}
+
+	refs, err := readBundleRefs(ctx, store, latestBundlePath)
+	if err != nil {
+		logger.Printf("writing full bundle as failed to get refs of %s: %s", latestBundlePath, err)
+
+		return nil
+	}
+
+	chain, chainErr := bundleChain(ctx, store, latestBundlePath)
+	if chainErr != nil {
+		logger.Printf("writing full bundle as failed to get chain of %s: %s", latestBundlePath, chainErr)
+
+		return nil
+	}
+
+	if maxChainLength > 0 && len(chain) >= maxChainLength {
+		return nil
+	}
+
+	return &incrementalBase{
+		bundlePath: latestBundlePath,
+		refs:       refs,
+	}
+}
+
+// prerequisites returns the commits referenced by the base bundle that exist in the clone.
+// Commits no longer in the clone, e.g. due to a force push, cannot be excluded from the bundle.
+func (b *incrementalBase) prerequisites(ctx context.Context, workingPath string) ([]string, errors.E) {
+	if isEncryptedBundle(b.bundlePath) {
+		return b.digestedPrerequisites(ctx, workingPath)
+	}
+
+	seen := map[string]bool{}
+
+	var shas []string
+
+	for _, sha := range b.refs {
+		if !seen[sha] {
+			seen[sha] = true
+
+			shas = append(shas, sha)
+		}
+	}
+
+	sort.Strings(shas)
+
+	checkCmd := exec.CommandContext(ctx, "git", "cat-file", "--batch-check")
+	checkCmd.Dir = workingPath
+	checkCmd.Stdin = strings.NewReader(strings.Join(shas, "\n") + "\n")
+
+	out, err := checkCmd.Output()
+	if err != nil {
+		return nil, errors.Errorf("failed to check prerequisites exist: %s", err)
+	}
+
+	var present []string
+
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasSuffix(line, " missing") {
+			continue
+		}
+
+		present = append(present, fields[0])
+	}
+
+	return present, nil
+}
+
+// digestedPrerequisites returns the objects referenced by an encrypted base bundle, whose
+// manifest only has the digests of its refs, by finding the clone's objects with those digests.
+func (b *incrementalBase) digestedPrerequisites(ctx context.Context, workingPath string) ([]string, errors.E) {
+	wanted := map[string]bool{}
+
+	for _, d := range b.refs {
+		wanted[d] = true
+	}
+
+	seen := map[string]bool{}
+
+	var present []string
+
+	// the objects refs point to, such as annotated tags, and every commit they reach
+	for _, args := range [][]string{{"for-each-ref", "--format=%(objectname)"}, {"rev-list", "--all"}} {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = workingPath
+
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, errors.Errorf("failed to list objects to find prerequisites: %s", err)
+		}
+
+		for _, sha := range strings.Fields(string(out)) {
+			if !seen[sha] && wanted[digest(sha)] {
+				seen[sha] = true
+
+				present = append(present, sha)
+			}
+		}
+	}
+
+	sort.Strings(present)
+
+	return present, nil
+}
+
+// bundleChain returns the bundles required to restore the given bundle, starting
+// with the full bundle and ending with the bundle itself.
+func bundleChain(ctx context.Context, store Storage, bundlePath string) ([]string, errors.E) {
+	dir := path.Dir(bundlePath)
+
+	visited := map[string]bool{}
+
+	chain := []string{bundlePath}
+
+	for current := bundlePath; ; {
+		visited[path.Base(current)] = true
+
+		manifest, found, err := readBundleManifest(ctx, store, current)
+		if err != nil {
+			return nil, err
+		}
+
+		if !found || manifest.Parent == "" {
+			break
+		}
+
+		if visited[manifest.Parent] {
+			return nil, errors.Errorf("bundle chain of %s contains a cycle", bundlePath)
+		}
+
+		parent := path.Join(dir, manifest.Parent)
+		if _, statErr := store.Stat(ctx, parent); statErr != nil {
+			return nil, errors.Errorf("bundle %s required by %s is missing", manifest.Parent, path.Base(current))
+		}
+
+		chain = append([]string{parent}, chain...)
+		current = parent
+	}
+
+	return chain, nil
+}
+
+// ReconstructRepository rebuilds a bare repository in targetDir from a bundle. If the
+// bundle is incremental, the full bundle and each incremental bundle it builds upon
+// are applied in turn, so the repository matches the state captured by the bundle.
+// The target directory must not exist or be empty. Encrypted bundles are decrypted
+// using the given age identities.
+func ReconstructRepository(ctx context.Context, bundlePath, targetDir string, identities ...string) errors.E {
+	return reconstructFromStorage(ctx, NewLocalStorage(filepath.Dir(bundlePath)), filepath.Base(bundlePath), targetDir, identities)
+}
+
+// reconstructFromStorage parses the identities needed by the bundle's chain before rebuilding the repository.
+func reconstructFromStorage(ctx context.Context, store Storage, bundlePath, targetDir string, identities []string) errors.E {
+	chain, err := bundleChain(ctx, store, bundlePath)
+	if err != nil {
+		return err
+	}
+
+	ids, err := parseChainIdentities(chain, identities)
+	if err != nil {
+		return err
+	}
+
+	return reconstructRepository(ctx, store, bundlePath, targetDir, ids)
+}
+
+// reconstructRepository rebuilds a bare repository in targetDir from the bundle with the given key.
+func reconstructRepository(ctx context.Context, store Storage, bundlePath, targetDir string, identities []age.Identity) errors.E {
+	chain, err := bundleChain(ctx, store, bundlePath)
+	if err != nil {
+		return err
+	}
+
+	if entries, readErr := os.ReadDir(targetDir); readErr == nil && len(entries) > 0 {
+		return errors.Errorf("target directory is not empty: %s", targetDir)
+	}
+
+	if out, initErr := exec.CommandContext(ctx, "git", "init", "--bare", "--quiet", targetDir).CombinedOutput(); initErr != nil {
+		return errors.Errorf("failed to initialise repository: %s: %s", targetDir, strings.TrimSpace(string(out)))
+	}
+
+	for _, b := range chain {
+		if err = applyBundle(ctx, store, b, targetDir, identities); err != nil {
+			return err
+		}
+	}
+
+	// incremental bundles only contain the refs that changed, so the refs are set to
+	// those of the clone the last bundle was created from
+	manifest, found, err := readBundleManifest(ctx, store, bundlePath)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return nil
+	}
+
+	if manifest, err = manifest.open(identities); err != nil {
+		return err
+	}
+
+	if manifest.Refs == nil {
+		return nil
+	}
+
+	return reconcileRefs(ctx, targetDir, manifest.Refs)
+}
+
+// localRefs returns the refs of the repository, in the same form as those of remotes.
+func localRefs(ctx context.Context, repoPath string) (gitRefs, errors.E) {
+	cmd := exec.CommandContext(ctx, "git", "for-each-ref", "--format=%(objectname) %(refname)")
+	cmd.Dir = repoPath
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Errorf("failed to list refs of %s: %s", repoPath, err)
+	}
+
+	refs, err := generateMapFromRefsCmdOutput(out)
+	if err != nil {
+		return nil, errors.Errorf("failed to list refs of %s: %s", repoPath, err)
+	}
+
+	return refs, nil
+}
+
+// reconcileRefs points the repository's refs at those given, deleting any others.
+func reconcileRefs(ctx context.Context, repoPath string, refs gitRefs) errors.E {
+	current, err := localRefs(ctx, repoPath)
+	if err != nil {
+		return err
+	}
+
+	var updates strings.Builder
+
+	for ref, sha := range refs {
+		if current[ref] != sha {
+			updates.WriteString("update " + ref + " " + sha + "\n")
+		}
+	}
+
+	for ref := range current {
+		if _, ok := refs[ref]; !ok {
+			updates.WriteString("delete " + ref + "\n")
+		}
+	}
+
+	if updates.Len() == 0 {
+		return nil
+	}
+
+	updateCmd := exec.CommandContext(ctx, "git", "update-ref", "--stdin")
+	updateCmd.Dir = repoPath
+	updateCmd.Stdin = strings.NewReader(updates.String())
+
+	if out, updateErr := updateCmd.CombinedOutput(); updateErr != nil {
+		return errors.Errorf("failed to update refs of %s: %s", repoPath, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// parseChainIdentities parses the identities needed to decrypt any encrypted bundles in the chain,
+// so missing identities are reported before anything is written.
+func parseChainIdentities(chain, identities []string) ([]age.Identity, errors.E) {
+	for _, b := range chain {
+		if !isEncryptedBundle(b) {
+			continue
+		}
+
+		if len(identities) == 0 {
+			return nil, errors.Errorf("no identities provided to decrypt bundle %s", b)
+		}
+
+		return parseIdentities(identities)
+	}
+
+	return nil, nil
+}
+
+// applyBundle fetches the refs of the bundle into the repository, setting HEAD to
+// match the bundle's if it has one. Refs missing from the bundle are kept, as
+// incremental bundles leave out those that are unchanged.
+func applyBundle(ctx context.Context, store Storage, bundlePath, repoPath string, identities []age.Identity) errors.E {
+	location := objectLocation(store, bundlePath)
+
+	logger.Printf("applying bundle: %s", location)
+
+	plainPath, cleanup, err := localBundle(ctx, store, bundlePath, repoPath, identities)
+	if err != nil {
+		return err
+	}
+
+	defer cleanup()
+
+	// check the bundle is valid and its prerequisites were applied
+	verifyCmd := exec.CommandContext(ctx, "git", "bundle", "verify", "--quiet", plainPath)
+	verifyCmd.Dir = repoPath
+
+	if out, verifyErr := verifyCmd.CombinedOutput(); verifyErr != nil {
+		return errors.Errorf("failed to verify bundle: %s: %s", location, strings.TrimSpace(string(out)))
+	}
+
+	fetchCmd := exec.CommandContext(ctx, "git", "fetch", "--quiet", plainPath, "+refs/*:refs/*")
+	fetchCmd.Dir = repoPath
+
+	if out, fetchErr := fetchCmd.CombinedOutput(); fetchErr != nil {
+		if ctx.Err() != nil {
+			return errors.Wrapf(ctx.Err(), "reconstruction cancelled whilst applying %s", location)
+		}
+
+		return errors.Errorf("failed to apply bundle: %s: %s", location, strings.TrimSpace(string(out)))
+	}
+
+	return setHeadFromBundle(ctx, repoPath, plainPath)
+}
+
+// setHeadFromBundle points the repository's HEAD at the branch the bundle's HEAD refers to,
+// or at the commit itself if no branch refers to it.
+func setHeadFromBundle(ctx context.Context, repoPath, bundlePath string) errors.E {
+	out, err := exec.CommandContext(ctx, "git", "bundle", "list-heads", bundlePath, "HEAD").Output()
+	if err != nil {
+		return errors.Errorf("failed to get HEAD of bundle: %s: %s", bundlePath, err)
+	}
+
+	headSHA, _, found := cutBySpaceAndTrimOutput(string(out))
+	if !found {
+		// bundles of empty HEADs have nothing to point at
+		return nil
+	}
+
+	refs, refsErr := getBundleRefs(bundlePath)
+	if refsErr != nil {
+		return errors.Errorf("failed to get refs of bundle: %s: %s", bundlePath, refsErr)
+	}
+
+	var branches []string
+
+	for ref, sha := range refs {
+		if sha == headSHA && strings.HasPrefix(ref, "refs/heads/") {
+			branches = append(branches, ref)
+		}
+	}
+
+	// detach HEAD if no branch matches
+	headArgs := []string{"update-ref", "--no-deref", "HEAD", headSHA}
+
+	if len(branches) > 0 {
+		sort.Strings(branches)
+
+		headArgs = []string{"symbolic-ref", "HEAD", branches[0]}
+	}
+
+	symRefCmd := exec.CommandContext(ctx, "git", headArgs...)
+	symRefCmd.Dir = repoPath
+
+	var symRefOut bytes.Buffer
+
+	symRefCmd.Stdout = &symRefOut
+	symRefCmd.Stderr = &symRefOut
+
+	if err = symRefCmd.Run(); err != nil {
+		return errors.Errorf("failed to set HEAD: %s", strings.TrimSpace(symRefOut.String()))
+	}
+
+	return nil
+}
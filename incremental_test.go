@@ -0,0 +1,197 @@
+package githosts
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func addTestCommit(t *testing.T, repoDir, message string) {
+	t.Helper()
+
+	out, err := exec.Command("git", "-C", repoDir, "-c", "user.name=soba", "-c", "user.email=soba@example.com",
+		"commit", "--quiet", "--allow-empty", "-m", message).CombinedOutput()
+	require.NoError(t, err, string(out))
+}
+
+func gitOutput(t *testing.T, repoDir string, args ...string) string {
+	t.Helper()
+
+	out, err := exec.Command("git", append([]string{"-C", repoDir}, args...)...).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	return strings.TrimSpace(string(out))
+}
+
+func TestIncrementalBundlesCanBeReconstructed(t *testing.T) {
+	t.Parallel()
+
+	sourcePath := createTestGitRepo(t)
+
+	in := processBackupInput{
+		repo:             testRepository(sourcePath),
+		backupDir:        t.TempDir(),
+		diffRemoteMethod: cloneMethod,
+		incremental:      true,
+	}
+
+	full, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusCreated, full.status)
+
+	// bundle names have a timestamp with a resolution of one second
+	time.Sleep(time.Second)
+
+	addTestCommit(t, sourcePath, "second")
+
+	incremental, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusCreated, incremental.status)
+	require.NotEqual(t, full.bundlePath, incremental.bundlePath)
+
+	manifest, found, err := readBundleManifest(context.Background(), localFiles, incremental.bundlePath)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, filepath.Base(full.bundlePath), manifest.Parent)
+	require.Equal(t, []string{gitOutput(t, sourcePath, "rev-parse", "HEAD~1")}, manifest.Prerequisites)
+
+	chain, err := bundleChain(context.Background(), localFiles, incremental.bundlePath)
+	require.NoError(t, err)
+	require.Equal(t, []string{full.bundlePath, incremental.bundlePath}, chain)
+
+	targetDir := filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, ReconstructRepository(context.Background(), incremental.bundlePath, targetDir))
+	require.Equal(t, gitOutput(t, sourcePath, "rev-parse", "HEAD"), gitOutput(t, targetDir, "rev-parse", "HEAD"))
+	require.Equal(t, "2", gitOutput(t, targetDir, "rev-list", "--count", "HEAD"))
+
+	// nothing changed, so no further bundle is written
+	unchanged, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusUnchanged, unchanged.status)
+	require.Equal(t, incremental.bundlePath, unchanged.bundlePath)
+}
+
+func TestIncrementalBundlesKeepUnchangedBranches(t *testing.T) {
+	t.Parallel()
+
+	sourcePath := createTestGitRepo(t)
+	gitOutput(t, sourcePath, "branch", "keep")
+	gitOutput(t, sourcePath, "branch", "gone")
+	gitOutput(t, sourcePath, "tag", "v1")
+
+	in := processBackupInput{
+		repo:             testRepository(sourcePath),
+		backupDir:        t.TempDir(),
+		diffRemoteMethod: cloneMethod,
+		incremental:      true,
+	}
+
+	full, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusCreated, full.status)
+
+	// bundle names have a timestamp with a resolution of one second
+	time.Sleep(time.Second)
+
+	// only master changes, and a branch is deleted
+	addTestCommit(t, sourcePath, "second")
+	gitOutput(t, sourcePath, "branch", "-D", "gone")
+
+	incremental, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusCreated, incremental.status)
+
+	sourceRefs, refsErr := localRefs(context.Background(), sourcePath)
+	require.NoError(t, refsErr)
+	require.Len(t, sourceRefs, 3)
+
+	// the manifest lists every ref, not only those in the bundle
+	manifest, found, err := readBundleManifest(context.Background(), localFiles, incremental.bundlePath)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, filepath.Base(full.bundlePath), manifest.Parent)
+	require.Equal(t, sourceRefs, manifest.Refs)
+
+	targetDir := filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, ReconstructRepository(context.Background(), incremental.bundlePath, targetDir))
+
+	restoredRefs, refsErr := localRefs(context.Background(), targetDir)
+	require.NoError(t, refsErr)
+	require.Equal(t, sourceRefs, restoredRefs)
+	require.Equal(t, gitOutput(t, sourcePath, "rev-parse", "HEAD"), gitOutput(t, targetDir, "rev-parse", "HEAD"))
+
+	// the next bundle builds upon every ref
+	time.Sleep(time.Second)
+
+	addTestCommit(t, sourcePath, "third")
+
+	next, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusCreated, next.status)
+
+	manifest, _, err = readBundleManifest(context.Background(), localFiles, next.bundlePath)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Base(incremental.bundlePath), manifest.Parent)
+
+	targetDir = filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, ReconstructRepository(context.Background(), next.bundlePath, targetDir))
+	require.Equal(t, gitOutput(t, sourcePath, "rev-parse", "keep"), gitOutput(t, targetDir, "rev-parse", "keep"))
+	require.Equal(t, gitOutput(t, sourcePath, "rev-parse", "HEAD"), gitOutput(t, targetDir, "rev-parse", "HEAD"))
+}
+
+func TestReconstructRepositoryRequiresEmptyTarget(t *testing.T) {
+	t.Parallel()
+
+	targetDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(targetDir, "file"), nil, 0o600))
+
+	bundlePath := filepath.Join(t.TempDir(), "repo0.20200401111111.bundle")
+	require.NoError(t, os.WriteFile(bundlePath, nil, 0o600))
+
+	require.Error(t, ReconstructRepository(context.Background(), bundlePath, targetDir))
+}
+
+func TestBundleChainWithMissingParent(t *testing.T) {
+	t.Parallel()
+
+	bundlePath := filepath.Join(t.TempDir(), "repo0.20200401111111.bundle")
+	require.NoError(t, os.WriteFile(bundlePath, nil, 0o600))
+	require.NoError(t, writeBundleManifest(context.Background(), localFiles, bundlePath, bundleManifest{Parent: "repo0.20200301111111.bundle"}))
+
+	_, err := bundleChain(context.Background(), localFiles, bundlePath)
+	require.ErrorContains(t, err, "is missing")
+}
+
+func TestPruneBackupsKeepsIncrementalChain(t *testing.T) {
+	t.Parallel()
+
+	backupPath := t.TempDir()
+
+	names := []string{
+		"repo0.20200101111111.bundle",
+		"repo0.20200201111111.bundle",
+		"repo0.20200301111111.bundle",
+		"repo0.20200401111111.bundle",
+	}
+
+	for _, name := range names {
+		require.NoError(t, os.WriteFile(filepath.Join(backupPath, name), nil, 0o600))
+	}
+
+	// the newest bundle builds upon the second
+	require.NoError(t, writeBundleManifest(context.Background(), localFiles, filepath.Join(backupPath, names[3]), bundleManifest{Parent: names[1]}))
+
+	require.NoError(t, pruneBackups(context.Background(), NewLocalStorage(backupPath), "", 1))
+
+	require.NoFileExists(t, filepath.Join(backupPath, names[0]))
+	require.FileExists(t, filepath.Join(backupPath, names[1]))
+	require.NoFileExists(t, filepath.Join(backupPath, names[2]))
+	require.FileExists(t, filepath.Join(backupPath, names[3]))
+	require.FileExists(t, manifestPath(filepath.Join(backupPath, names[3])))
+}
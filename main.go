@@ -13,11 +13,19 @@ const (
 	defaultHttpRequestTimeout    = 30 * time.Second
 	defaultHttpClientTimeout     = 10 * time.Second
 	timeStampFormat              = "20060102150405"
+	azureDevOpsAPIURL            = "https://dev.azure.com"
+	azureDevOpsVSSPSURL          = "https://app.vssps.visualstudio.com"
 	bitbucketAPIURL              = "https://api.bitbucket.org/2.0"
 	githubAPIURL                 = "https://api.github.com/graphql"
 	gitlabAPIURL                 = "https://gitlab.com/api/v4"
 	gitlabProjectsPerPageDefault = 20
 	contentTypeApplicationJSON   = "application/json; charset=utf-8"
+	// default number of repositories backed up concurrently by each provider
+	azureDevOpsDefaultConcurrency = 10
+	bitbucketDefaultConcurrency   = 5
+	giteaDefaultConcurrency       = 5
+	githubDefaultConcurrency      = 10
+	gitlabDefaultConcurrency      = 5
 )
 
 var logger *log.Logger
@@ -0,0 +1,295 @@
+package githosts
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"gitlab.com/tozd/go/errors"
+)
+
+const bundleManifestExtension = ".manifest.json"
+
+// bundleManifest is written alongside a bundle to describe it, so bundles
+// can be compared without hashing them or listing their heads.
+// Manifests of encrypted bundles are sealed, leaving only the size, creation time,
+// parent and digests of the refs readable, so they can still be compared and built
+// upon without decrypting them.
+type bundleManifest struct {
+	// SHA256 and Size describe the bundle before any encryption.
+	SHA256  string    `json:"sha256,omitempty"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	// Provider is the name of the provider the repository was backed up from.
+	Provider string `json:"provider,omitempty"`
+	// CloneURL is the URL the repository was cloned from, without credentials.
+	CloneURL   string  `json:"clone_url,omitempty"`
+	Refs       gitRefs `json:"refs,omitempty"`
+	GitVersion string  `json:"git_version,omitempty"`
+	// Parent is the file name of the bundle an incremental bundle builds upon.
+	Parent string `json:"parent,omitempty"`
+	// Prerequisites are the commits an incremental bundle requires to already exist.
+	Prerequisites []string `json:"prerequisites,omitempty"`
+	// RefDigests are the refs of a sealed manifest, as given by digestRefs.
+	RefDigests gitRefs `json:"ref_digests,omitempty"`
+	// Sealed is the full manifest encrypted to the recipients of the bundle.
+	Sealed []byte `json:"sealed,omitempty"`
+}
+
+// digest returns the hex encoded SHA-256 of s.
+func digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// digestRefs returns the refs with each name and object replaced by its digest, so the
+// refs of encrypted bundles can be compared without revealing them.
+func digestRefs(refs gitRefs) gitRefs {
+	digests := make(gitRefs, len(refs))
+
+	for ref, sha := range refs {
+		digests[digest(ref)] = digest(sha)
+	}
+
+	return digests
+}
+
+// seal returns the manifest to write alongside a bundle encrypted to the recipients.
+func (m bundleManifest) seal(recipients []age.Recipient) (bundleManifest, errors.E) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return bundleManifest{}, errors.Wrap(err, "failed to marshal bundle manifest")
+	}
+
+	var sealed bytes.Buffer
+
+	w, err := age.Encrypt(&sealed, recipients...)
+	if err != nil {
+		return bundleManifest{}, errors.Wrap(err, "failed to encrypt bundle manifest")
+	}
+
+	if _, err = w.Write(b); err == nil {
+		err = w.Close()
+	}
+
+	if err != nil {
+		return bundleManifest{}, errors.Wrap(err, "failed to encrypt bundle manifest")
+	}
+
+	return bundleManifest{
+		Size:       m.Size,
+		Created:    m.Created,
+		Parent:     m.Parent,
+		RefDigests: digestRefs(m.Refs),
+		Sealed:     sealed.Bytes(),
+	}, nil
+}
+
+// open returns the full manifest, decrypting it with the identities if it's sealed.
+func (m bundleManifest) open(identities []age.Identity) (bundleManifest, errors.E) {
+	if len(m.Sealed) == 0 {
+		return m, nil
+	}
+
+	if len(identities) == 0 {
+		return bundleManifest{}, errors.New("no identities provided to decrypt bundle manifest")
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(m.Sealed), identities...)
+	if err != nil {
+		return bundleManifest{}, errors.Wrap(err, "failed to decrypt bundle manifest")
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return bundleManifest{}, errors.Wrap(err, "failed to decrypt bundle manifest")
+	}
+
+	var full bundleManifest
+
+	if err = json.Unmarshal(b, &full); err != nil {
+		return bundleManifest{}, errors.Wrap(err, "failed to unmarshal bundle manifest")
+	}
+
+	return full, nil
+}
+
+var (
+	gitVersionOnce sync.Once
+	gitVersionStr  string
+)
+
+// getGitVersion returns the version of git in use, e.g. 2.39.5.
+func getGitVersion(ctx context.Context) string {
+	gitVersionOnce.Do(func() {
+		out, err := exec.CommandContext(ctx, "git", "version").Output()
+		if err != nil {
+			logger.Printf("failed to get git version: %s", err)
+
+			return
+		}
+
+		gitVersionStr = strings.TrimPrefix(strings.TrimSpace(string(out)), "git version ")
+	})
+
+	return gitVersionStr
+}
+
+// credentialFreeURL returns the URL with any user information removed.
+func credentialFreeURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+
+	u.User = nil
+
+	return u.String()
+}
+
+// newBundleManifest describes a newly created bundle with the given content.
+func newBundleManifest(ctx context.Context, content bundleContent, repo repository, provider string) bundleManifest {
+	cloneURL := repo.HTTPSUrl
+	if cloneURL == "" {
+		cloneURL = repo.SSHUrl
+	}
+
+	return bundleManifest{
+		SHA256:     hex.EncodeToString(content.sha256),
+		Size:       content.size,
+		Created:    time.Now(),
+		Provider:   provider,
+		CloneURL:   credentialFreeURL(cloneURL),
+		Refs:       content.refs,
+		GitVersion: getGitVersion(ctx),
+	}
+}
+
+func manifestPath(bundlePath string) string {
+	return bundlePath + bundleManifestExtension
+}
+
+func writeBundleManifest(ctx context.Context, store Storage, bundlePath string, manifest bundleManifest) errors.E {
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal bundle manifest")
+	}
+
+	if putErr := store.Put(ctx, manifestPath(bundlePath), bytes.NewReader(b)); putErr != nil {
+		return errors.Wrapf(putErr, "failed to write bundle manifest for %s", bundlePath)
+	}
+
+	return nil
+}
+
+// readBundleManifest returns the bundle's manifest and whether one exists.
+func readBundleManifest(ctx context.Context, store Storage, bundlePath string) (bundleManifest, bool, errors.E) {
+	var manifest bundleManifest
+
+	r, getErr := store.Get(ctx, manifestPath(bundlePath))
+	if errors.Is(getErr, ErrObjectNotFound) {
+		return manifest, false, nil
+	}
+
+	if getErr != nil {
+		return manifest, false, errors.Wrapf(getErr, "failed to read bundle manifest for %s", bundlePath)
+	}
+
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return manifest, false, errors.Wrapf(err, "failed to read bundle manifest for %s", bundlePath)
+	}
+
+	if err = json.Unmarshal(b, &manifest); err != nil {
+		return manifest, false, errors.Wrapf(err, "failed to unmarshal bundle manifest for %s", bundlePath)
+	}
+
+	return manifest, true, nil
+}
+
+// removeBundle deletes a bundle along with its manifest.
+func removeBundle(ctx context.Context, store Storage, bundlePath string) errors.E {
+	if err := store.Delete(ctx, bundlePath); err != nil {
+		return errors.Wrapf(err, "failed to remove bundle %s", bundlePath)
+	}
+
+	if err := store.Delete(ctx, manifestPath(bundlePath)); err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return errors.Wrapf(err, "failed to remove bundle manifest for %s", bundlePath)
+	}
+
+	return nil
+}
+
+// readBundleRefs returns the bundle's refs from its manifest, falling back to listing its heads.
+// Only the digests of the refs of encrypted bundles are returned, as given by digestRefs.
+func readBundleRefs(ctx context.Context, store Storage, bundlePath string) (gitRefs, error) {
+	manifest, found, err := readBundleManifest(ctx, store, bundlePath)
+	if err != nil {
+		logger.Print(err)
+	}
+
+	if found && manifest.Refs != nil {
+		return manifest.Refs, nil
+	}
+
+	if isEncryptedBundle(bundlePath) {
+		if found && manifest.RefDigests != nil {
+			return manifest.RefDigests, nil
+		}
+
+		return nil, errors.Errorf("no manifest to read refs of encrypted bundle %s", bundlePath)
+	}
+
+	localPath, cleanup, localErr := localBundle(ctx, store, bundlePath, "", nil)
+	if localErr != nil {
+		return nil, localErr
+	}
+
+	defer cleanup()
+
+	return getBundleRefs(localPath)
+}
+
+// bundleRefsMatch reports whether the refs are those read from the bundle by readBundleRefs.
+func bundleRefsMatch(bundlePath string, bundleRefs, refs gitRefs) bool {
+	if isEncryptedBundle(bundlePath) {
+		refs = digestRefs(refs)
+	}
+
+	return reflect.DeepEqual(bundleRefs, refs)
+}
+
+// bundlesIdentical compares the checksums recorded in the bundles' manifests, or the
+// digests of the refs for sealed manifests, falling back to hashing the bundles if
+// either doesn't have one. An encrypted bundle is never identical to an unencrypted one.
+func bundlesIdentical(ctx context.Context, store Storage, path1, path2 string) bool {
+	if isEncryptedBundle(path1) != isEncryptedBundle(path2) {
+		return false
+	}
+
+	manifest1, found1, err1 := readBundleManifest(ctx, store, path1)
+	manifest2, found2, err2 := readBundleManifest(ctx, store, path2)
+
+	if err1 == nil && err2 == nil && found1 && found2 && manifest1.SHA256 != "" && manifest2.SHA256 != "" {
+		return manifest1.SHA256 == manifest2.SHA256 && manifest1.Size == manifest2.Size
+	}
+
+	if err1 == nil && err2 == nil && found1 && found2 && manifest1.RefDigests != nil && manifest2.RefDigests != nil {
+		return reflect.DeepEqual(manifest1.RefDigests, manifest2.RefDigests)
+	}
+
+	return filesIdentical(ctx, store, path1, path2)
+}
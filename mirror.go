@@ -0,0 +1,142 @@
+package githosts
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// updateMirror brings the mirror clone in workingPath up to date with the remote, returning
+// whether an existing mirror was reused. If the mirror cache is enabled, an existing mirror
+// is fetched into, falling back to a fresh clone if it can't be used.
+func updateMirror(ctx context.Context, in processBackupInput, cloneURL, workingPath string) (bool, errors.E) {
+	repo := in.repo
+
+	if in.mirrorCache && isMirror(ctx, workingPath) {
+		logger.Printf("fetching: %s to: %s", repo.HTTPSUrl, workingPath)
+
+		err := fetchMirror(ctx, in, cloneURL, workingPath)
+		if err == nil {
+			return true, nil
+		}
+
+		// a cancelled fetch leaves the mirror usable for the next backup
+		if ctx.Err() != nil {
+			return false, errors.Wrapf(ctx.Err(), "backup cancelled whilst fetching %s", repo.PathWithNameSpace)
+		}
+
+		logger.Printf("cloning %s afresh as fetching into cached mirror failed: %s", repo.PathWithNameSpace, err)
+	}
+
+	// remove a corrupt or partial mirror
+	if err := os.RemoveAll(workingPath); err != nil {
+		return false, errors.Errorf("failed to remove working directory: %s: %s", workingPath, err)
+	}
+
+	return false, cloneMirror(ctx, in, cloneURL, workingPath)
+}
+
+// cloneMirror makes a mirror clone of the repository in workingPath.
+func cloneMirror(ctx context.Context, in processBackupInput, cloneURL, workingPath string) errors.E {
+	repo := in.repo
+
+	logger.Printf("cloning: %s to: %s", repo.HTTPSUrl, workingPath)
+
+	cloneCmd := exec.CommandContext(ctx, "git", "clone", "-v", "--mirror", cloneURL, workingPath)
+	cloneCmd.Dir = in.backupDir
+	cloneCmd.Env = in.gitEnv()
+
+	cloneOut, cloneErr := cloneCmd.CombinedOutput()
+	if cloneErr != nil && ctx.Err() != nil {
+		removeWorkingDir(workingPath)
+
+		return errors.Wrapf(ctx.Err(), "backup cancelled whilst cloning %s", repo.PathWithNameSpace)
+	}
+
+	if cloneErr != nil {
+		fmt.Printf("cloning failed for repository: %s - %s\n", repo.Name, cloneErr)
+	}
+
+	cloneOutLines := strings.Split(maskSecrets(string(cloneOut), in.secrets()), "\n")
+
+	if cloneErr != nil {
+		if os.Getenv(envVarGitHostsLog) == "debug" {
+			fmt.Printf("debug: cloning failed for repository: %s - %s\n", repo.Name, strings.Join(cloneOutLines, ", "))
+
+			return errors.Errorf("cloning failed: %s: %s", strings.Join(cloneOutLines, ", "), cloneErr)
+		}
+
+		return errors.Errorf("cloning failed for repository: %s - %s", repo.Name, cloneErr)
+	}
+
+	return nil
+}
+
+// isMirror reports whether workingPath holds a usable bare repository.
+func isMirror(ctx context.Context, workingPath string) bool {
+	if _, err := os.Stat(workingPath); err != nil {
+		return false
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "rev-parse", "--is-bare-repository")
+	cmd.Dir = workingPath
+	// don't find a repository in a parent directory
+	cmd.Env = append(os.Environ(), "GIT_CEILING_DIRECTORIES="+filepath.Dir(workingPath))
+
+	out, err := cmd.Output()
+	if err != nil {
+		logger.Printf("cached mirror is not a repository: %s: %s", workingPath, err)
+
+		return false
+	}
+
+	return strings.TrimSpace(string(out)) == "true"
+}
+
+// fetchMirror fetches every ref from the remote into the mirror in workingPath, removing refs
+// deleted from the remote and updating HEAD if the remote's default branch has changed.
+// The URL is passed explicitly rather than using the one the mirror was cloned from, in case it has changed.
+func fetchMirror(ctx context.Context, in processBackupInput, cloneURL, workingPath string) errors.E {
+	env := in.gitEnv()
+
+	fetchCmd := exec.CommandContext(ctx, "git", "fetch", "--prune", "--quiet", cloneURL, "+refs/*:refs/*")
+	fetchCmd.Dir = workingPath
+	fetchCmd.Env = env
+
+	if out, err := fetchCmd.CombinedOutput(); err != nil {
+		return errors.Errorf("fetch failed: %s: %s", strings.TrimSpace(maskSecrets(string(out), in.secrets())), err)
+	}
+
+	headCmd := exec.CommandContext(ctx, "git", "ls-remote", "--symref", cloneURL, "HEAD")
+	headCmd.Dir = workingPath
+	headCmd.Env = env
+
+	out, err := headCmd.Output()
+	if err != nil {
+		return errors.Errorf("failed to get remote HEAD: %s", err)
+	}
+
+	// ref: refs/heads/main	HEAD
+	for _, line := range strings.Split(string(out), "\n") {
+		ref, found := strings.CutPrefix(line, "ref: ")
+		if !found {
+			continue
+		}
+
+		ref, _, _ = strings.Cut(ref, "\t")
+
+		headCmd = exec.CommandContext(ctx, "git", "symbolic-ref", "HEAD", ref)
+		headCmd.Dir = workingPath
+
+		if headOut, headErr := headCmd.CombinedOutput(); headErr != nil {
+			return errors.Errorf("failed to set HEAD: %s: %s", strings.TrimSpace(string(headOut)), headErr)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package githosts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessBackupWithMirrorCache(t *testing.T) {
+	t.Parallel()
+
+	sourcePath := createTestGitRepo(t)
+	gitOutput(t, sourcePath, "branch", "feature")
+
+	in := processBackupInput{
+		repo:             testRepository(sourcePath),
+		backupDir:        t.TempDir(),
+		diffRemoteMethod: cloneMethod,
+		mirrorCache:      true,
+	}
+
+	workingPath := filepath.Join(in.backupDir, workingDIRName, in.repo.Domain, in.repo.PathWithNameSpace)
+
+	first, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusCreated, first.status)
+	require.Equal(t, 2, first.refCount)
+
+	// a file that would be lost if the mirror was cloned afresh
+	marker := filepath.Join(workingPath, "cached")
+	require.NoError(t, os.WriteFile(marker, nil, 0o600))
+
+	time.Sleep(time.Second)
+
+	addTestCommit(t, sourcePath, "second")
+	gitOutput(t, sourcePath, "branch", "-D", "feature")
+	gitOutput(t, sourcePath, "branch", "-m", "renamed")
+
+	second, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusCreated, second.status)
+	require.FileExists(t, marker)
+
+	// deleted refs are pruned and HEAD follows the remote
+	require.Equal(t, 1, second.refCount)
+	require.Equal(t, "refs/heads/renamed", gitOutput(t, workingPath, "symbolic-ref", "HEAD"))
+	require.Equal(t, gitOutput(t, sourcePath, "rev-parse", "HEAD"), gitOutput(t, workingPath, "rev-parse", "HEAD"))
+
+	targetDir := filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, ReconstructRepository(context.Background(), second.bundlePath, targetDir))
+	require.Equal(t, gitOutput(t, sourcePath, "rev-parse", "HEAD"), gitOutput(t, targetDir, "rev-parse", "HEAD"))
+}
+
+func TestProcessBackupWithCorruptMirrorCache(t *testing.T) {
+	t.Parallel()
+
+	sourcePath := createTestGitRepo(t)
+
+	in := processBackupInput{
+		repo:             testRepository(sourcePath),
+		backupDir:        t.TempDir(),
+		diffRemoteMethod: cloneMethod,
+		mirrorCache:      true,
+	}
+
+	workingPath := filepath.Join(in.backupDir, workingDIRName, in.repo.Domain, in.repo.PathWithNameSpace)
+
+	require.NoError(t, os.MkdirAll(workingPath, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(workingPath, "HEAD"), []byte("corrupt"), 0o600))
+
+	out, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusCreated, out.status)
+	require.Equal(t, gitOutput(t, sourcePath, "rev-parse", "HEAD"), gitOutput(t, workingPath, "rev-parse", "HEAD"))
+
+	// a mirror whose remote can't be fetched from is cloned afresh
+	in.repo.HTTPSUrl = filepath.Join(t.TempDir(), "missing")
+
+	_, err = processBackup(context.Background(), in)
+	require.ErrorContains(t, err, "cloning failed")
+	require.NoDirExists(t, workingPath)
+}
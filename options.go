@@ -0,0 +1,75 @@
+package githosts
+
+import "gitlab.com/tozd/go/errors"
+
+// BackupOptions are the backup settings shared by every provider, embedded in each
+// provider's host, its input and ProviderConfig.
+type BackupOptions struct {
+	// Filter selects the repositories to back up.
+	Filter RepositoryFilter
+	// Concurrency is the number of repositories to back up at once, defaulting to 10
+	// for GitHub and Azure DevOps and 5 for other providers.
+	Concurrency int
+	// CloneLimiter optionally limits concurrent clones across hosts sharing it.
+	CloneLimiter *CloneLimiter
+	// Observer optionally receives progress events during backups.
+	Observer Observer
+	// IncrementalBundles writes bundles containing only the changes since the previous
+	// bundle, starting a new full bundle once a chain reaches BackupsToRetain bundles.
+	IncrementalBundles bool
+	// MirrorCache keeps each mirror clone in BackupDir/.working between backups and fetches
+	// changes into it, rather than cloning every repository afresh.
+	MirrorCache bool
+	// SSH clones repositories over SSH, rather than HTTPS with the host's credentials, if set.
+	SSH *SSHConfig
+	// EncryptionRecipients are age recipients, such as age1... public keys, that bundles
+	// are encrypted to, along with the refs, checksums and clone URLs in their manifests.
+	// Bundles are written unencrypted if none are provided.
+	EncryptionRecipients []string
+	// Storage optionally receives bundles in place of BackupDir, such as an S3Storage.
+	// BackupDir is still used for working clones.
+	Storage Storage
+	// RetentionPolicy prunes bundles by age, e.g. keeping 7 daily, 4 weekly and 12 monthly bundles,
+	// in place of BackupsToRetain.
+	RetentionPolicy RetentionPolicy
+}
+
+// validate checks the options are usable before a host is created with the number
+// of bundles to retain.
+func (o BackupOptions) validate(backupsToRetain int) error {
+	if err := o.Filter.Validate(); err != nil {
+		return err
+	}
+
+	// retention keeps the bundles that kept incremental bundles build upon, so without a
+	// limit on the length of each chain nothing could ever be pruned
+	if o.IncrementalBundles && !o.RetentionPolicy.IsZero() && backupsToRetain < 1 {
+		return errors.New("BackupsToRetain must be set to limit the length of incremental bundle chains when using a retention policy")
+	}
+
+	if err := validateRecipients(o.EncryptionRecipients); err != nil {
+		return err
+	}
+
+	if err := o.RetentionPolicy.Validate(); err != nil {
+		return err
+	}
+
+	return o.SSH.Validate()
+}
+
+// backupInput completes the input for backing up a host's repositories, which holds
+// the host's own settings, with the options.
+func (o BackupOptions) backupInput(in processBackupInput) processBackupInput {
+	in.filter = o.Filter
+	in.cloneLimiter = o.CloneLimiter
+	in.observer = o.Observer
+	in.incremental = o.IncrementalBundles
+	in.mirrorCache = o.MirrorCache
+	in.ssh = o.SSH
+	in.encryptionRecipients = o.EncryptionRecipients
+	in.storage = o.Storage
+	in.retention = o.RetentionPolicy
+
+	return in
+}
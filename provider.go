@@ -0,0 +1,401 @@
+package githosts
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	// names of the built-in providers available to NewProvider
+	ProviderAzureDevOps = "azuredevops"
+	ProviderBitbucket   = "bitbucket"
+	ProviderCodeberg    = "codeberg"
+	ProviderGitea       = "gitea"
+	ProviderGitHub      = "github"
+	ProviderGitLab      = "gitlab"
+
+	// OptionSkipUserRepos is a GitHub option to skip the authenticated user's repositories.
+	OptionSkipUserRepos = "skip_user_repos"
+	// OptionLimitUserOwned is a GitHub option to only include repositories owned by the authenticated user.
+	OptionLimitUserOwned = "limit_user_owned"
+	// OptionProjectMinAccessLevel is a GitLab option to set the minimum access level of projects to back up.
+	OptionProjectMinAccessLevel = "project_min_access_level"
+	// OptionOrgConcurrency is an Azure DevOps option to set the number of organizations to list at once.
+	OptionOrgConcurrency = "org_concurrency"
+	// OptionServer is an Azure DevOps option to set that APIURL is an Azure DevOps Server,
+	// whose collections are backed up in place of organizations.
+	OptionServer = "server"
+	// OptionAdminCrawl is a Gitea option to back up every user's repositories using a site admin token.
+	OptionAdminCrawl = "admin_crawl"
+	// OptionAuthType is a Bitbucket option to set how to authenticate, e.g. app_password.
+	OptionAuthType = "auth_type"
+)
+
+// Provider is implemented by each of the supported git hosts.
+// Third parties can implement it to add their own hosts and make them
+// available by name with RegisterProvider.
+type Provider interface {
+	// Name returns the name of the provider, e.g. GitHub.
+	Name() string
+	// GetAPIURL returns the URL of the provider's API.
+	GetAPIURL() string
+	// ListRepositories returns the repositories available to back up.
+	ListRepositories(ctx context.Context) ([]Repository, errors.E)
+	// Backup backs up all repositories.
+	Backup() ProviderBackupResult
+	// BackupWithContext backs up all repositories, stopping when the context is cancelled.
+	BackupWithContext(ctx context.Context) ProviderBackupResult
+}
+
+// ProviderConfig is the generic configuration used to create a provider by name.
+// Credentials and options that do not apply to a provider are ignored, whereas the
+// provider specific Domain, TLS, Projects and Users settings return an error.
+type ProviderConfig struct {
+	Caller           string
+	HTTPClient       *retryablehttp.Client
+	APIURL           string
+	DiffRemoteMethod string
+	BackupDir        string
+	BackupsToRetain  int
+	LogLevel         int
+	// Token is the API token, or personal access token for Azure DevOps.
+	Token string
+	// User is the Bitbucket user or Azure DevOps username.
+	User string
+	// Key and Secret are the Bitbucket OAuth consumer credentials. Secret is instead the
+	// app password or API token when authenticating with either.
+	Key    string
+	Secret string
+	// Orgs are the organizations, GitLab groups or Bitbucket workspaces, to back up, with "*" selecting all.
+	Orgs []string
+	// Users are the Gitea users whose repositories are also backed up.
+	Users []string
+	// Projects selects the Azure DevOps or Bitbucket projects to back up repositories from.
+	Projects RepositoryFilter
+	BackupOptions
+	// Domain optionally sets the domain repositories are stored under, in place of the
+	// provider's default, for Azure DevOps, GitHub and GitLab.
+	Domain string
+	// TLS configures connections to self-hosted GitHub and GitLab instances. It can't be
+	// used with HTTPClient.
+	TLS *TLSConfig
+	// Options holds provider specific settings, such as OptionSkipUserRepos.
+	Options map[string]string
+}
+
+// names of the provider specific settings of ProviderConfig
+const (
+	settingDomain   = "Domain"
+	settingProjects = "Projects"
+	settingTLS      = "TLS"
+	settingUsers    = "Users"
+)
+
+// checkSupported returns an error if a provider specific setting is set that the provider
+// doesn't support, rather than ignoring it.
+func (c ProviderConfig) checkSupported(provider string, supported ...string) error {
+	set := map[string]bool{
+		settingDomain:   c.Domain != "",
+		settingProjects: !c.Projects.isZero(),
+		settingTLS:      c.TLS != nil,
+		settingUsers:    len(c.Users) > 0,
+	}
+
+	for _, name := range []string{settingDomain, settingProjects, settingTLS, settingUsers} {
+		if set[name] && !slices.Contains(supported, name) {
+			return fmt.Errorf("%s provider doesn't support the %s setting", provider, name)
+		}
+	}
+
+	return nil
+}
+
+func (c ProviderConfig) boolOption(name string) (bool, error) {
+	v, ok := c.Options[name]
+	if !ok || v == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for option %s: %s", name, v)
+	}
+
+	return b, nil
+}
+
+func (c ProviderConfig) intOption(name string) (int, error) {
+	v, ok := c.Options[name]
+	if !ok || v == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for option %s: %s", name, v)
+	}
+
+	return i, nil
+}
+
+// ProviderFactory creates a provider from a generic configuration.
+type ProviderFactory func(config ProviderConfig) (Provider, error)
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]ProviderFactory{
+		ProviderAzureDevOps: newAzureDevOpsProvider,
+		ProviderBitbucket:   newBitbucketProvider,
+		ProviderCodeberg:    newCodebergProvider,
+		ProviderGitea:       newGiteaProvider,
+		ProviderGitHub:      newGitHubProvider,
+		ProviderGitLab:      newGitLabProvider,
+	}
+)
+
+// RegisterProvider makes a provider available by name to NewProvider.
+// Names are case-insensitive and cannot be registered more than once.
+func RegisterProvider(name string, factory ProviderFactory) error {
+	key := strings.ToLower(strings.TrimSpace(name))
+
+	switch {
+	case key == "":
+		return errors.New("provider name not specified")
+	case factory == nil:
+		return errors.Errorf("provider factory for %s not specified", name)
+	}
+
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if _, exists := providers[key]; exists {
+		return errors.Errorf("provider %s already registered", name)
+	}
+
+	providers[key] = factory
+
+	return nil
+}
+
+// NewProvider creates a registered provider by name.
+func NewProvider(name string, config ProviderConfig) (Provider, error) {
+	providersMu.RLock()
+	factory, ok := providers[strings.ToLower(strings.TrimSpace(name))]
+	providersMu.RUnlock()
+
+	if !ok {
+		return nil, errors.Errorf("unknown provider: %s", name)
+	}
+
+	return factory(config)
+}
+
+// RegisteredProviders returns the sorted names of all registered providers.
+func RegisteredProviders() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func newAzureDevOpsProvider(config ProviderConfig) (Provider, error) {
+	if err := config.checkSupported(ProviderAzureDevOps, settingDomain, settingProjects); err != nil {
+		return nil, err
+	}
+
+	orgConcurrency, err := config.intOption(OptionOrgConcurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := config.boolOption(OptionServer)
+	if err != nil {
+		return nil, err
+	}
+
+	return asProvider(NewAzureDevOpsHost(NewAzureDevOpsHostInput{
+		HTTPClient:       config.HTTPClient,
+		Caller:           config.Caller,
+		BackupDir:        config.BackupDir,
+		DiffRemoteMethod: config.DiffRemoteMethod,
+		UserName:         config.User,
+		PAT:              config.Token,
+		Orgs:             config.Orgs,
+		BackupsToRetain:  config.BackupsToRetain,
+		LogLevel:         config.LogLevel,
+		BackupOptions:    config.BackupOptions,
+		OrgConcurrency:   orgConcurrency,
+		APIURL:           config.APIURL,
+		Server:           server,
+		Domain:           config.Domain,
+		Projects:         config.Projects,
+	}))
+}
+
+func newBitbucketProvider(config ProviderConfig) (Provider, error) {
+	if err := config.checkSupported(ProviderBitbucket, settingProjects); err != nil {
+		return nil, err
+	}
+
+	return asProvider(NewBitBucketHost(NewBitBucketHostInput{
+		Caller:           config.Caller,
+		HTTPClient:       config.HTTPClient,
+		APIURL:           config.APIURL,
+		DiffRemoteMethod: config.DiffRemoteMethod,
+		BackupDir:        config.BackupDir,
+		AuthType:         config.Options[OptionAuthType],
+		User:             config.User,
+		Key:              config.Key,
+		Secret:           config.Secret,
+		BackupsToRetain:  config.BackupsToRetain,
+		LogLevel:         config.LogLevel,
+		BackupOptions:    config.BackupOptions,
+		Workspaces:       config.Orgs,
+		Projects:         config.Projects,
+	}))
+}
+
+func newGiteaProvider(config ProviderConfig) (Provider, error) {
+	if err := config.checkSupported(ProviderGitea, settingUsers); err != nil {
+		return nil, err
+	}
+
+	adminCrawl, err := config.boolOption(OptionAdminCrawl)
+	if err != nil {
+		return nil, err
+	}
+
+	return asProvider(NewGiteaHost(NewGiteaHostInput{
+		Caller:           config.Caller,
+		HTTPClient:       config.HTTPClient,
+		APIURL:           config.APIURL,
+		DiffRemoteMethod: config.DiffRemoteMethod,
+		BackupDir:        config.BackupDir,
+		Token:            config.Token,
+		Orgs:             config.Orgs,
+		BackupsToRetain:  config.BackupsToRetain,
+		LogLevel:         config.LogLevel,
+		BackupOptions:    config.BackupOptions,
+		AdminCrawl:       adminCrawl,
+		Users:            config.Users,
+	}))
+}
+
+// newCodebergProvider creates a Gitea provider for Codeberg, unless another API URL is set.
+func newCodebergProvider(config ProviderConfig) (Provider, error) {
+	if config.APIURL == "" {
+		config.APIURL = CodebergAPIURL
+	}
+
+	return newGiteaProvider(config)
+}
+
+func newGitHubProvider(config ProviderConfig) (Provider, error) {
+	if err := config.checkSupported(ProviderGitHub, settingDomain, settingTLS); err != nil {
+		return nil, err
+	}
+
+	skipUserRepos, err := config.boolOption(OptionSkipUserRepos)
+	if err != nil {
+		return nil, err
+	}
+
+	limitUserOwned, err := config.boolOption(OptionLimitUserOwned)
+	if err != nil {
+		return nil, err
+	}
+
+	return asProvider(NewGitHubHost(NewGitHubHostInput{
+		HTTPClient:       config.HTTPClient,
+		Caller:           config.Caller,
+		APIURL:           config.APIURL,
+		DiffRemoteMethod: config.DiffRemoteMethod,
+		BackupDir:        config.BackupDir,
+		Token:            config.Token,
+		LimitUserOwned:   limitUserOwned,
+		SkipUserRepos:    skipUserRepos,
+		Orgs:             config.Orgs,
+		BackupsToRetain:  config.BackupsToRetain,
+		LogLevel:         config.LogLevel,
+		BackupOptions:    config.BackupOptions,
+		Domain:           config.Domain,
+		TLS:              config.TLS,
+	}))
+}
+
+func newGitLabProvider(config ProviderConfig) (Provider, error) {
+	if err := config.checkSupported(ProviderGitLab, settingDomain, settingTLS); err != nil {
+		return nil, err
+	}
+
+	minAccessLevel, err := config.intOption(OptionProjectMinAccessLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	return asProvider(NewGitLabHost(NewGitLabHostInput{
+		Caller:                config.Caller,
+		HTTPClient:            config.HTTPClient,
+		APIURL:                config.APIURL,
+		DiffRemoteMethod:      config.DiffRemoteMethod,
+		BackupDir:             config.BackupDir,
+		Token:                 config.Token,
+		ProjectMinAccessLevel: minAccessLevel,
+		BackupsToRetain:       config.BackupsToRetain,
+		LogLevel:              config.LogLevel,
+		BackupOptions:         config.BackupOptions,
+		Domain:                config.Domain,
+		TLS:                   config.TLS,
+		Groups:                config.Orgs,
+	}))
+}
+
+// asProvider avoids returning a non-nil Provider wrapping a nil host when creation fails.
+func asProvider[T Provider](p T, err error) (Provider, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// listRepositories returns the exported form of the repositories described by a provider.
+// Repositories skipped by the filter are omitted.
+func listRepositories(ctx context.Context, p gitProvider, filter RepositoryFilter, observer Observer) ([]Repository, errors.E) {
+	repoDesc, err := describeProviderRepos(ctx, p, observer)
+	if err != nil {
+		return nil, err
+	}
+
+	// the listing is incomplete
+	if repoDesc.Err != nil {
+		return nil, repoDesc.Err
+	}
+
+	kept, _, err := filterRepos(repoDesc.Repos, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	repos := make([]Repository, 0, len(kept))
+	for _, repo := range kept {
+		repos = append(repos, repo.export())
+	}
+
+	return repos, nil
+}
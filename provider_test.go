@@ -0,0 +1,219 @@
+package githosts
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+)
+
+type testProvider struct {
+	apiURL string
+}
+
+func (p testProvider) Name() string {
+	return "Test"
+}
+
+func (p testProvider) GetAPIURL() string {
+	return p.apiURL
+}
+
+func (p testProvider) ListRepositories(_ context.Context) ([]Repository, errors.E) {
+	return []Repository{{Name: "repo0", PathWithNameSpace: "go-soba/repo0", Domain: "example.com"}}, nil
+}
+
+func (p testProvider) Backup() ProviderBackupResult {
+	return p.BackupWithContext(context.Background())
+}
+
+func (p testProvider) BackupWithContext(_ context.Context) ProviderBackupResult {
+	return ProviderBackupResult{}
+}
+
+func TestRegisteredProvidersIncludesBuiltIns(t *testing.T) {
+	t.Parallel()
+
+	names := RegisteredProviders()
+	for _, name := range []string{ProviderAzureDevOps, ProviderBitbucket, ProviderCodeberg, ProviderGitea, ProviderGitHub, ProviderGitLab} {
+		require.Contains(t, names, name)
+	}
+}
+
+func TestNewProviderByName(t *testing.T) {
+	t.Parallel()
+
+	p, err := NewProvider("GitHub", ProviderConfig{
+		Token: "abc",
+		Options: map[string]string{
+			OptionSkipUserRepos:  "true",
+			OptionLimitUserOwned: "false",
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, gitHubProviderName, p.Name())
+	require.Equal(t, githubAPIURL, p.GetAPIURL())
+
+	gh, ok := p.(*GitHubHost)
+	require.True(t, ok)
+	require.True(t, gh.SkipUserRepos)
+	require.False(t, gh.LimitUserOwned)
+
+	p, err = NewProvider(ProviderGitLab, ProviderConfig{
+		Options: map[string]string{OptionProjectMinAccessLevel: "30"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, gitLabProviderName, p.Name())
+	require.Equal(t, 30, p.(*GitLabHost).ProjectMinAccessLevel)
+}
+
+func TestNewProviderWithInvalidOption(t *testing.T) {
+	t.Parallel()
+
+	p, err := NewProvider(ProviderGitHub, ProviderConfig{
+		Options: map[string]string{OptionSkipUserRepos: "sometimes"},
+	})
+	require.Error(t, err)
+	require.Nil(t, p)
+	require.Contains(t, err.Error(), OptionSkipUserRepos)
+}
+
+func TestNewProviderReturnsNilOnError(t *testing.T) {
+	t.Parallel()
+
+	// Gitea requires an API URL
+	p, err := NewProvider(ProviderGitea, ProviderConfig{})
+	require.Error(t, err)
+	require.Nil(t, p)
+}
+
+func TestNewProviderWithUnknownName(t *testing.T) {
+	t.Parallel()
+
+	p, err := NewProvider("unknown", ProviderConfig{})
+	require.Error(t, err)
+	require.Nil(t, p)
+	require.Contains(t, err.Error(), "unknown provider")
+}
+
+func TestRegisterProvider(t *testing.T) {
+	t.Parallel()
+
+	t.Cleanup(func() {
+		providersMu.Lock()
+		defer providersMu.Unlock()
+
+		delete(providers, "test-register")
+	})
+
+	require.NoError(t, RegisterProvider("Test-Register", func(config ProviderConfig) (Provider, error) {
+		return testProvider{apiURL: config.APIURL}, nil
+	}))
+
+	require.Contains(t, RegisteredProviders(), "test-register")
+
+	p, err := NewProvider("test-register", ProviderConfig{APIURL: "https://example.com/api"})
+	require.NoError(t, err)
+	require.Equal(t, "Test", p.Name())
+	require.Equal(t, "https://example.com/api", p.GetAPIURL())
+
+	repos, err := p.ListRepositories(context.Background())
+	require.NoError(t, err)
+	require.Len(t, repos, 1)
+
+	// names are unique regardless of case
+	require.Error(t, RegisterProvider("TEST-REGISTER", func(_ ProviderConfig) (Provider, error) {
+		return testProvider{}, nil
+	}))
+	require.Error(t, RegisterProvider(ProviderGitHub, func(_ ProviderConfig) (Provider, error) {
+		return testProvider{}, nil
+	}))
+	require.Error(t, RegisterProvider(" ", func(_ ProviderConfig) (Provider, error) {
+		return testProvider{}, nil
+	}))
+	require.Error(t, RegisterProvider("no-factory", nil))
+}
+
+func TestNewCodebergProvider(t *testing.T) {
+	t.Parallel()
+
+	p, err := NewProvider(ProviderCodeberg, ProviderConfig{
+		BackupDir: t.TempDir(),
+		Token:     "test-token",
+	})
+	require.NoError(t, err)
+	require.Equal(t, CodebergAPIURL, p.(*GiteaHost).APIURL)
+}
+
+func TestNewProviderPassesProjects(t *testing.T) {
+	t.Parallel()
+
+	projects := RepositoryFilter{Include: []string{"my-org/*"}}
+
+	p, err := NewProvider(ProviderAzureDevOps, ProviderConfig{
+		BackupDir: t.TempDir(),
+		User:      "soba",
+		Token:     "test-token",
+		Orgs:      []string{"my-org"},
+		Projects:  projects,
+	})
+	require.NoError(t, err)
+	require.Equal(t, projects, p.(*AzureDevOpsHost).Projects)
+
+	p, err = NewProvider(ProviderBitbucket, ProviderConfig{Projects: projects})
+	require.NoError(t, err)
+	require.Equal(t, projects, p.(*BitbucketHost).Projects)
+}
+
+func TestNewProviderAzureDevOpsServer(t *testing.T) {
+	t.Parallel()
+
+	config := ProviderConfig{
+		APIURL:    "https://devops.example.com/tfs",
+		BackupDir: t.TempDir(),
+		User:      "soba",
+		Token:     "test-token",
+		Orgs:      []string{"DefaultCollection"},
+	}
+
+	// a URL other than dev.azure.com isn't taken to be a server
+	p, err := NewProvider(ProviderAzureDevOps, config)
+	require.NoError(t, err)
+	require.False(t, p.(*AzureDevOpsHost).Server)
+
+	config.Options = map[string]string{OptionServer: "true"}
+
+	p, err = NewProvider(ProviderAzureDevOps, config)
+	require.NoError(t, err)
+	require.True(t, p.(*AzureDevOpsHost).Server)
+}
+
+func TestNewProviderPassesDomain(t *testing.T) {
+	t.Parallel()
+
+	p, err := NewProvider(ProviderGitHub, ProviderConfig{Domain: "github.example.com"})
+	require.NoError(t, err)
+	require.Equal(t, "github.example.com", p.(*GitHubHost).Domain)
+}
+
+func TestNewProviderRejectsUnsupportedSettings(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name    string
+		config  ProviderConfig
+		setting string
+	}{
+		{name: ProviderAzureDevOps, config: ProviderConfig{TLS: &TLSConfig{}}, setting: "TLS"},
+		{name: ProviderBitbucket, config: ProviderConfig{Domain: "bitbucket.example.com"}, setting: "Domain"},
+		{name: ProviderCodeberg, config: ProviderConfig{Projects: RepositoryFilter{Include: []string{"*"}}}, setting: "Projects"},
+		{name: ProviderGitea, config: ProviderConfig{APIURL: "https://gitea.example.com/api/v1", TLS: &TLSConfig{}}, setting: "TLS"},
+		{name: ProviderGitHub, config: ProviderConfig{Users: []string{"soba"}}, setting: "Users"},
+		{name: ProviderGitLab, config: ProviderConfig{Users: []string{"soba"}}, setting: "Users"},
+	} {
+		p, err := NewProvider(tc.name, tc.config)
+		require.ErrorContains(t, err, "doesn't support the "+tc.setting+" setting", tc.name)
+		require.Nil(t, p)
+	}
+}
@@ -0,0 +1,145 @@
+package githosts
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// RestoreInput identifies the repository to restore and where to restore it to.
+type RestoreInput struct {
+	BackupDir         string
+	Domain            string
+	PathWithNameSpace string
+	// Storage optionally holds the bundles in place of BackupDir, such as an S3Storage.
+	Storage Storage
+	// Before restores the latest bundle created at or before this time.
+	// The latest bundle is restored if not set.
+	Before time.Time
+	// DestDir is where the repository is restored to. It must not exist or be empty.
+	DestDir string
+	// Bare restores a bare mirror rather than a working checkout.
+	Bare bool
+	// DecryptionIdentities are the age identities, such as AGE-SECRET-KEY-1... keys,
+	// used to decrypt encrypted bundles.
+	DecryptionIdentities []string
+}
+
+// RestoreResult describes the bundle a repository was restored from.
+type RestoreResult struct {
+	BundlePath string
+	Created    time.Time
+}
+
+// Restore rebuilds a repository from its backups. The chosen bundle, and any bundles it
+// builds upon, are verified as they are applied, with a failed verification returning
+// an error rather than a partial restore.
+func Restore(ctx context.Context, in RestoreInput) (RestoreResult, errors.E) {
+	switch {
+	case in.BackupDir == "" && in.Storage == nil:
+		return RestoreResult{}, errors.New("backup directory not specified")
+	case in.Domain == "":
+		return RestoreResult{}, errors.New("domain not specified")
+	case in.PathWithNameSpace == "":
+		return RestoreResult{}, errors.New("repository path not specified")
+	case in.DestDir == "":
+		return RestoreResult{}, errors.New("destination directory not specified")
+	}
+
+	if entries, err := os.ReadDir(in.DestDir); err == nil && len(entries) > 0 {
+		return RestoreResult{}, errors.Errorf("destination directory is not empty: %s", in.DestDir)
+	}
+
+	store := in.Storage
+	if store == nil {
+		store = NewLocalStorage(in.BackupDir)
+	}
+
+	backupPath := path.Join(in.Domain, in.PathWithNameSpace)
+
+	bundle, err := selectBundle(ctx, store, backupPath, in.Before)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+
+	bundlePath := path.Join(backupPath, bundle.name)
+
+	logger.Printf("restoring %s from %s", in.PathWithNameSpace, objectLocation(store, bundlePath))
+
+	result := RestoreResult{
+		BundlePath: objectLocation(store, bundlePath),
+		Created:    localBundleTime(bundle.created),
+	}
+
+	if in.Bare {
+		if err = reconstructFromStorage(ctx, store, bundlePath, in.DestDir, in.DecryptionIdentities); err != nil {
+			return RestoreResult{}, err
+		}
+
+		return result, nil
+	}
+
+	if err = reconstructFromStorage(ctx, store, bundlePath, filepath.Join(in.DestDir, ".git"), in.DecryptionIdentities); err != nil {
+		return RestoreResult{}, err
+	}
+
+	if err = checkoutRestoredRepository(ctx, in.DestDir); err != nil {
+		return RestoreResult{}, err
+	}
+
+	return result, nil
+}
+
+// selectBundle returns the latest bundle in backupPath, or the latest created at or before the given time.
+func selectBundle(ctx context.Context, store Storage, backupPath string, before time.Time) (bundleFile, errors.E) {
+	bfs, err := getBundleFiles(ctx, store, backupPath)
+	if err != nil {
+		return bundleFile{}, errors.Wrapf(err, "failed to get bundles in %s", backupPath)
+	}
+
+	if len(bfs) == 0 {
+		return bundleFile{}, errors.Errorf("no bundles found in %s", backupPath)
+	}
+
+	if before.IsZero() {
+		return bfs[len(bfs)-1], nil
+	}
+
+	// compare using the same format and parsing as bundle names
+	cutoff, err := timeStampToTime(before.Local().Format(timeStampFormat))
+	if err != nil {
+		return bundleFile{}, errors.Wrap(err, "invalid restore time")
+	}
+
+	for x := len(bfs) - 1; x >= 0; x-- {
+		if !bfs[x].created.After(cutoff) {
+			return bfs[x], nil
+		}
+	}
+
+	return bundleFile{}, errors.Errorf("no bundles found in %s created before %s", backupPath, before.Format(time.RFC3339))
+}
+
+// checkoutRestoredRepository converts the bare repository in destDir/.git into a working checkout.
+func checkoutRestoredRepository(ctx context.Context, destDir string) errors.E {
+	for _, args := range [][]string{
+		{"config", "core.bare", "false"},
+		{"reset", "--quiet", "--hard"},
+	} {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = destDir
+
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return errors.Errorf("failed to check out restored repository: git %s: %s",
+				strings.Join(args, " "), strings.TrimSpace(string(out)))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package githosts
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// createTestBundles creates a bundle for each of the given timestamps, adding a commit before each.
+func createTestBundles(t *testing.T, backupPath string, timestamps ...string) []string {
+	t.Helper()
+
+	sourcePath := createTestGitRepo(t)
+
+	var commits []string
+
+	require.NoError(t, os.MkdirAll(backupPath, 0o755))
+
+	for _, ts := range timestamps {
+		require.NoError(t, os.WriteFile(filepath.Join(sourcePath, "file"), []byte(ts), 0o600))
+		gitOutput(t, sourcePath, "add", "file")
+		addTestCommit(t, sourcePath, ts)
+
+		commits = append(commits, gitOutput(t, sourcePath, "rev-parse", "HEAD"))
+
+		out, err := exec.Command("git", "-C", sourcePath, "bundle", "create",
+			filepath.Join(backupPath, "repo0."+ts+bundleExtension), "--all").CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	return commits
+}
+
+func TestRestoreLatestBundleAsMirror(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+	commits := createTestBundles(t, filepath.Join(backupDir, "example.com", "go-soba", "repo0"),
+		"20200101000000", "20200201000000")
+
+	destDir := filepath.Join(t.TempDir(), "restored")
+
+	res, err := Restore(context.Background(), RestoreInput{
+		BackupDir:         backupDir,
+		Domain:            "example.com",
+		PathWithNameSpace: "go-soba/repo0",
+		DestDir:           destDir,
+		Bare:              true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "repo0.20200201000000.bundle", filepath.Base(res.BundlePath))
+	require.Equal(t, time.Date(2020, 2, 1, 0, 0, 0, 0, time.Local), res.Created)
+
+	require.Equal(t, "true", gitOutput(t, destDir, "rev-parse", "--is-bare-repository"))
+	require.Equal(t, commits[1], gitOutput(t, destDir, "rev-parse", "HEAD"))
+}
+
+func TestRestoreBundleBeforeTimestampAsCheckout(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+	commits := createTestBundles(t, filepath.Join(backupDir, "example.com", "go-soba", "repo0"),
+		"20200101000000", "20200201000000")
+
+	destDir := filepath.Join(t.TempDir(), "restored")
+
+	res, err := Restore(context.Background(), RestoreInput{
+		BackupDir:         backupDir,
+		Domain:            "example.com",
+		PathWithNameSpace: "go-soba/repo0",
+		Before:            time.Date(2020, 1, 15, 0, 0, 0, 0, time.Local),
+		DestDir:           destDir,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "repo0.20200101000000.bundle", filepath.Base(res.BundlePath))
+
+	require.Equal(t, "false", gitOutput(t, destDir, "rev-parse", "--is-bare-repository"))
+	require.Equal(t, commits[0], gitOutput(t, destDir, "rev-parse", "HEAD"))
+	require.Empty(t, gitOutput(t, destDir, "status", "--porcelain"))
+
+	content, readErr := os.ReadFile(filepath.Join(destDir, "file"))
+	require.NoError(t, readErr)
+	require.Equal(t, "20200101000000", string(content))
+}
+
+func TestRestoreIncrementalBackupKeepsUnchangedBranches(t *testing.T) {
+	t.Parallel()
+
+	sourcePath := createTestGitRepo(t)
+	gitOutput(t, sourcePath, "branch", "keep")
+
+	in := processBackupInput{
+		repo:             testRepository(sourcePath),
+		backupDir:        t.TempDir(),
+		diffRemoteMethod: cloneMethod,
+		incremental:      true,
+	}
+
+	_, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+
+	// bundle names have a timestamp with a resolution of one second
+	time.Sleep(time.Second)
+
+	addTestCommit(t, sourcePath, "second")
+
+	incremental, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusCreated, incremental.status)
+
+	destDir := filepath.Join(t.TempDir(), "restored")
+
+	res, err := Restore(context.Background(), RestoreInput{
+		BackupDir:         in.backupDir,
+		Domain:            "example.com",
+		PathWithNameSpace: "go-soba/repo0",
+		DestDir:           destDir,
+	})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Base(incremental.bundlePath), filepath.Base(res.BundlePath))
+
+	// keep isn't in the incremental bundle as it's unchanged
+	require.Equal(t, gitOutput(t, sourcePath, "rev-parse", "keep"), gitOutput(t, destDir, "rev-parse", "keep"))
+	require.Equal(t, gitOutput(t, sourcePath, "rev-parse", "HEAD"), gitOutput(t, destDir, "rev-parse", "HEAD"))
+	require.Empty(t, gitOutput(t, destDir, "status", "--porcelain"))
+}
+
+func TestRestoreErrors(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+	backupPath := filepath.Join(backupDir, "example.com", "go-soba", "repo0")
+	createTestBundles(t, backupPath, "20200101000000")
+
+	in := RestoreInput{
+		BackupDir:         backupDir,
+		Domain:            "example.com",
+		PathWithNameSpace: "go-soba/repo0",
+		DestDir:           filepath.Join(t.TempDir(), "restored"),
+	}
+
+	// no bundles before the requested time
+	before := in
+	before.Before = time.Date(2019, 1, 1, 0, 0, 0, 0, time.Local)
+	_, err := Restore(context.Background(), before)
+	require.ErrorContains(t, err, "no bundles found")
+
+	// destination is not empty
+	notEmpty := in
+	notEmpty.DestDir = t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(notEmpty.DestDir, "file"), nil, 0o600))
+	_, err = Restore(context.Background(), notEmpty)
+	require.ErrorContains(t, err, "not empty")
+
+	// corrupt bundles fail verification
+	require.NoError(t, os.WriteFile(filepath.Join(backupPath, "repo0.20200201000000.bundle"), []byte("corrupt"), 0o600))
+	_, err = Restore(context.Background(), in)
+	require.ErrorContains(t, err, "failed to verify bundle")
+}
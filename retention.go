@@ -0,0 +1,314 @@
+package githosts
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// reasons reported in RetentionDecision
+const (
+	RetainNewest   = "newest"
+	RetainLast     = "last"
+	RetainDaily    = "daily"
+	RetainWeekly   = "weekly"
+	RetainMonthly  = "monthly"
+	RetainYearly   = "yearly"
+	RetainMaxAge   = "max age"
+	RetainRequired = "required by incremental bundle"
+)
+
+// RetentionPolicy selects the bundles of a repository to keep, using the time in each bundle's name.
+// A bundle is kept if any of the rules selects it, and the newest bundle is always kept.
+// Older bundles that kept incremental bundles build upon are also kept, so with incremental
+// bundles BackupsToRetain must still be set to limit the length of each chain.
+type RetentionPolicy struct {
+	// Last keeps the newest bundles.
+	Last int
+	// Daily, Weekly, Monthly and Yearly keep the newest bundle of each of the most recent days,
+	// ISO weeks, months and years that have bundles, e.g. Daily 7, Weekly 4 and Monthly 12.
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+	// MaxAge keeps bundles created within the duration, e.g. 90 days.
+	MaxAge time.Duration
+	// DryRun reports the bundles that would be pruned without removing them.
+	DryRun bool
+}
+
+// IsZero reports whether the policy has no rules, in which case nothing is pruned.
+func (p RetentionPolicy) IsZero() bool {
+	return p.Last == 0 && p.Daily == 0 && p.Weekly == 0 && p.Monthly == 0 && p.Yearly == 0 && p.MaxAge == 0
+}
+
+// Validate checks the policy's rules are not negative.
+func (p RetentionPolicy) Validate() errors.E {
+	for name, v := range map[string]int{
+		"last":    p.Last,
+		"daily":   p.Daily,
+		"weekly":  p.Weekly,
+		"monthly": p.Monthly,
+		"yearly":  p.Yearly,
+	} {
+		if v < 0 {
+			return errors.Errorf("invalid retention policy: %s must not be negative", name)
+		}
+	}
+
+	if p.MaxAge < 0 {
+		return errors.New("invalid retention policy: max age must not be negative")
+	}
+
+	return nil
+}
+
+// retentionPolicy returns the policy to prune with, falling back to keeping the
+// newest backupsToKeep bundles if no policy is set.
+func (in processBackupInput) retentionPolicy() RetentionPolicy {
+	if !in.retention.IsZero() {
+		return in.retention
+	}
+
+	return RetentionPolicy{Last: in.backupsToKeep}
+}
+
+// RetentionDecision is whether a bundle is kept by a retention policy, and why.
+type RetentionDecision struct {
+	Path    string    `json:"path"`
+	Created time.Time `json:"created"`
+	Keep    bool      `json:"keep"`
+	// Reasons lists the rules that keep the bundle.
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// selectRetained returns the reasons each bundle is kept, keyed by name, with bundles
+// that aren't kept by any rule absent. The bundles must be sorted oldest first.
+func selectRetained(bfs bundleFiles, policy RetentionPolicy, now time.Time) map[string][]string {
+	kept := map[string][]string{}
+
+	if len(bfs) == 0 {
+		return kept
+	}
+
+	keep := func(f bundleFile, reason string) {
+		kept[f.name] = append(kept[f.name], reason)
+	}
+
+	keep(bfs[len(bfs)-1], RetainNewest)
+
+	// newest first
+	newest := make(bundleFiles, len(bfs))
+	for x := range bfs {
+		newest[x] = bfs[len(bfs)-1-x]
+	}
+
+	for x := 0; x < policy.Last && x < len(newest); x++ {
+		keep(newest[x], RetainLast)
+	}
+
+	// keep the newest bundle in each of the most recent periods
+	for _, period := range []struct {
+		reason string
+		count  int
+		key    func(t time.Time) string
+	}{
+		{RetainDaily, policy.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{RetainWeekly, policy.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{RetainMonthly, policy.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{RetainYearly, policy.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	} {
+		seen := map[string]bool{}
+
+		for _, f := range newest {
+			if len(seen) == period.count {
+				break
+			}
+
+			key := period.key(f.created)
+			if seen[key] {
+				continue
+			}
+
+			seen[key] = true
+
+			keep(f, period.reason)
+		}
+	}
+
+	if policy.MaxAge > 0 {
+		// compare using the same format and parsing as bundle names
+		cutoff, err := timeStampToTime(now.Add(-policy.MaxAge).Local().Format(timeStampFormat))
+		if err != nil {
+			logger.Printf("failed to get retention cutoff: %s", err)
+
+			return kept
+		}
+
+		for _, f := range newest {
+			if f.created.Before(cutoff) {
+				break
+			}
+
+			keep(f, RetainMaxAge)
+		}
+	}
+
+	return kept
+}
+
+// applyRetention removes the bundles in backupPath that the policy doesn't keep, other than
+// older bundles that kept incremental bundles build upon, and returns the decision for each bundle.
+// Nothing is removed if the policy is a dry run.
+func applyRetention(ctx context.Context, store Storage, backupPath string, policy RetentionPolicy, now time.Time) ([]RetentionDecision, errors.E) {
+	bfs, err := getBundleFiles(ctx, store, backupPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "backup path read failed")
+	}
+
+	kept := selectRetained(bfs, policy, now)
+
+	required := map[string]bool{}
+
+	for name := range kept {
+		chain, chainErr := bundleChain(ctx, store, path.Join(backupPath, name))
+		if chainErr != nil {
+			return nil, errors.Wrap(chainErr, "failed to get bundle chain")
+		}
+
+		for _, b := range chain {
+			if path.Base(b) != name {
+				required[path.Base(b)] = true
+			}
+		}
+	}
+
+	decisions := make([]RetentionDecision, 0, len(bfs))
+
+	for _, f := range bfs {
+		key := path.Join(backupPath, f.name)
+
+		decision := RetentionDecision{
+			Path:    objectLocation(store, key),
+			Created: localBundleTime(f.created),
+			Reasons: kept[f.name],
+		}
+
+		if required[f.name] {
+			decision.Reasons = append(decision.Reasons, RetainRequired)
+		}
+
+		decision.Keep = len(decision.Reasons) > 0
+
+		switch {
+		case decision.Keep:
+		case policy.DryRun:
+			logger.Printf("dry run: would prune %s", decision.Path)
+		default:
+			logger.Printf("pruning %s", decision.Path)
+
+			if removeErr := removeBundle(ctx, store, key); removeErr != nil {
+				return decisions, removeErr
+			}
+		}
+
+		decisions = append(decisions, decision)
+	}
+
+	return decisions, nil
+}
+
+// localBundleTime returns the time a bundle was created, from the local time in its name.
+func localBundleTime(created time.Time) time.Time {
+	return time.Date(created.Year(), created.Month(), created.Day(),
+		created.Hour(), created.Minute(), created.Second(), 0, time.Local)
+}
+
+// ApplyRetentionInput describes the backups to apply a retention policy to.
+type ApplyRetentionInput struct {
+	BackupDir string
+	// Storage optionally holds the bundles in place of BackupDir, such as an S3Storage.
+	Storage Storage
+	Policy  RetentionPolicy
+}
+
+// RetentionReport lists the decision for every bundle a retention policy was applied to.
+type RetentionReport struct {
+	Bundles []RetentionDecision `json:"bundles"`
+	Kept    int                 `json:"kept"`
+	Pruned  int                 `json:"pruned"`
+}
+
+// ApplyRetention applies the retention policy to the bundles of every repository in the backups.
+// With a dry run policy, the report lists the bundles that would be pruned without removing them.
+func ApplyRetention(ctx context.Context, in ApplyRetentionInput) (RetentionReport, errors.E) {
+	if in.BackupDir == "" && in.Storage == nil {
+		return RetentionReport{}, errors.New("backup directory not specified")
+	}
+
+	if err := in.Policy.Validate(); err != nil {
+		return RetentionReport{}, err
+	}
+
+	if in.Policy.IsZero() {
+		return RetentionReport{}, errors.New("retention policy has no rules")
+	}
+
+	store := in.Storage
+	if store == nil {
+		store = NewLocalStorage(in.BackupDir)
+	}
+
+	objects, err := store.List(ctx, "")
+	if err != nil {
+		return RetentionReport{}, err
+	}
+
+	// the directories holding bundles
+	dirs := map[string]bool{}
+
+	for _, o := range objects {
+		if isBundleName(path.Base(o.Key)) {
+			dirs[path.Dir(o.Key)] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+
+	sort.Strings(sorted)
+
+	var report RetentionReport
+
+	now := time.Now()
+
+	for _, dir := range sorted {
+		decisions, applyErr := applyRetention(ctx, store, dir, in.Policy, now)
+
+		for _, d := range decisions {
+			report.Bundles = append(report.Bundles, d)
+
+			if d.Keep {
+				report.Kept++
+			} else {
+				report.Pruned++
+			}
+		}
+
+		if applyErr != nil {
+			return report, errors.Wrapf(applyErr, "failed to apply retention policy to %s", objectLocation(store, dir))
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,214 @@
+package githosts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testBundleFiles returns bundles created at the given hours of every day between from and to, oldest first.
+func testBundleFiles(from, to time.Time, hours ...int) bundleFiles {
+	var bfs bundleFiles
+
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		for _, hour := range hours {
+			created := time.Date(day.Year(), day.Month(), day.Day(), hour, 0, 0, 0, time.UTC)
+
+			bfs = append(bfs, bundleFile{
+				name:    "repo0." + created.Format(timeStampFormat) + bundleExtension,
+				created: created,
+			})
+		}
+	}
+
+	return bfs
+}
+
+func bundleName(year int, month time.Month, day, hour int) string {
+	return "repo0." + time.Date(year, month, day, hour, 0, 0, 0, time.UTC).Format(timeStampFormat) + bundleExtension
+}
+
+func TestSelectRetainedGrandfatherFatherSon(t *testing.T) {
+	t.Parallel()
+
+	bfs := testBundleFiles(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC), 1, 13)
+
+	kept := selectRetained(bfs, RetentionPolicy{Daily: 7, Weekly: 4, Monthly: 12}, time.Now())
+
+	// 7 days, 3 more weeks and 11 more months
+	require.Len(t, kept, 21)
+
+	require.Equal(t, []string{RetainNewest, RetainDaily, RetainWeekly, RetainMonthly}, kept[bundleName(2024, 3, 31, 13)])
+	require.Equal(t, []string{RetainDaily}, kept[bundleName(2024, 3, 25, 13)])
+	require.NotContains(t, kept, bundleName(2024, 3, 25, 1), "only the newest bundle of each day is kept")
+	require.Equal(t, []string{RetainWeekly}, kept[bundleName(2024, 3, 10, 13)])
+	require.NotContains(t, kept, bundleName(2024, 3, 3, 13))
+	require.Equal(t, []string{RetainMonthly}, kept[bundleName(2024, 2, 29, 13)])
+	require.Equal(t, []string{RetainMonthly}, kept[bundleName(2023, 4, 30, 13)])
+	require.NotContains(t, kept, bundleName(2023, 3, 31, 13))
+
+	kept = selectRetained(bfs, RetentionPolicy{Yearly: 5}, time.Now())
+	require.Len(t, kept, 2)
+	require.Contains(t, kept, bundleName(2023, 12, 31, 13))
+}
+
+func TestSelectRetainedMaxAge(t *testing.T) {
+	t.Parallel()
+
+	bfs := testBundleFiles(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC), 12)
+
+	// bundle names are in local time
+	now := time.Date(2024, 6, 30, 13, 0, 0, 0, time.Local)
+
+	kept := selectRetained(bfs, RetentionPolicy{MaxAge: 90 * 24 * time.Hour}, now)
+	require.Len(t, kept, 90)
+	require.Contains(t, kept, bundleName(2024, 4, 2, 12))
+	require.NotContains(t, kept, bundleName(2024, 4, 1, 12))
+
+	// the newest bundle is kept, however old
+	kept = selectRetained(bfs, RetentionPolicy{MaxAge: 90 * 24 * time.Hour}, now.AddDate(1, 0, 0))
+	require.Len(t, kept, 1)
+	require.Equal(t, []string{RetainNewest}, kept[bundleName(2024, 6, 30, 12)])
+
+	require.Empty(t, selectRetained(nil, RetentionPolicy{MaxAge: time.Hour}, now))
+}
+
+func writeTestBundles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+
+	for _, name := range names {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(name), 0o600))
+	}
+}
+
+func TestApplyRetentionKeepsRequiredBundles(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	full := bundleName(2024, 1, 1, 12)
+	other := bundleName(2024, 1, 2, 12)
+	incremental := bundleName(2024, 1, 3, 12)
+
+	writeTestBundles(t, dir, full, other, incremental)
+	require.NoError(t, writeBundleManifest(ctx, localFiles, filepath.Join(dir, incremental), bundleManifest{Parent: full}))
+
+	decisions, err := applyRetention(ctx, localFiles, dir, RetentionPolicy{Last: 1}, time.Now())
+	require.NoError(t, err)
+	require.Len(t, decisions, 3)
+	require.Equal(t, []string{RetainRequired}, decisions[0].Reasons)
+	require.False(t, decisions[1].Keep)
+	require.Equal(t, filepath.Join(dir, other), decisions[1].Path)
+	require.Equal(t, []string{RetainNewest, RetainLast}, decisions[2].Reasons)
+
+	require.FileExists(t, filepath.Join(dir, full))
+	require.NoFileExists(t, filepath.Join(dir, other))
+}
+
+func TestApplyRetention(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	backupDir := t.TempDir()
+
+	repo0 := filepath.Join(backupDir, "example.com", "go-soba", "repo0")
+	repo1 := filepath.Join(backupDir, "example.com", "go-soba", "repo1")
+
+	writeTestBundles(t, repo0, bundleName(2024, 1, 1, 12), bundleName(2024, 1, 2, 12), bundleName(2024, 1, 2, 13))
+	writeTestBundles(t, repo1, bundleName(2024, 1, 1, 12))
+	// working clones are not pruned
+	writeTestBundles(t, filepath.Join(backupDir, workingDIRName), bundleName(2024, 1, 1, 12))
+
+	_, err := ApplyRetention(ctx, ApplyRetentionInput{BackupDir: backupDir})
+	require.ErrorContains(t, err, "retention policy has no rules")
+
+	_, err = ApplyRetention(ctx, ApplyRetentionInput{BackupDir: backupDir, Policy: RetentionPolicy{Daily: -1}})
+	require.ErrorContains(t, err, "daily must not be negative")
+
+	in := ApplyRetentionInput{
+		BackupDir: backupDir,
+		Policy:    RetentionPolicy{Daily: 7, DryRun: true},
+	}
+
+	report, err := ApplyRetention(ctx, in)
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Kept)
+	require.Equal(t, 1, report.Pruned)
+	require.Len(t, report.Bundles, 4)
+	require.Equal(t, filepath.Join(repo0, bundleName(2024, 1, 2, 12)), report.Bundles[1].Path)
+	require.False(t, report.Bundles[1].Keep)
+	require.Equal(t, time.Date(2024, 1, 2, 12, 0, 0, 0, time.Local), report.Bundles[1].Created)
+
+	// nothing is removed by a dry run
+	require.FileExists(t, report.Bundles[1].Path)
+
+	in.Policy.DryRun = false
+
+	report, err = ApplyRetention(ctx, in)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Pruned)
+	require.NoFileExists(t, report.Bundles[1].Path)
+
+	bfs, bfErr := getBundleFiles(ctx, localFiles, repo0)
+	require.NoError(t, bfErr)
+	require.Len(t, bfs, 2)
+	require.FileExists(t, filepath.Join(backupDir, workingDIRName, bundleName(2024, 1, 1, 12)))
+}
+
+func TestProcessBackupRetentionDryRun(t *testing.T) {
+	t.Parallel()
+
+	sourcePath := createTestGitRepo(t)
+
+	in := processBackupInput{
+		repo:             testRepository(sourcePath),
+		backupDir:        t.TempDir(),
+		backupsToKeep:    1,
+		diffRemoteMethod: cloneMethod,
+		retention:        RetentionPolicy{Last: 1, DryRun: true},
+	}
+
+	first, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Empty(t, first.pruned)
+
+	time.Sleep(time.Second)
+
+	addTestCommit(t, sourcePath, "second")
+
+	second, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, []string{first.bundlePath}, second.pruned)
+	require.FileExists(t, first.bundlePath)
+
+	bfs, bfErr := getBundleFiles(context.Background(), localFiles, filepath.Dir(first.bundlePath))
+	require.NoError(t, bfErr)
+	require.Len(t, bfs, 2)
+}
+
+func TestNewGitHubHostWithInvalidRetentionPolicy(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewGitHubHost(NewGitHubHostInput{
+		BackupDir:     t.TempDir(),
+		BackupOptions: BackupOptions{RetentionPolicy: RetentionPolicy{MaxAge: -time.Hour}},
+	})
+	require.ErrorContains(t, err, "max age must not be negative")
+
+	// incremental bundle chains must be limited for the policy to prune them
+	options := BackupOptions{IncrementalBundles: true, RetentionPolicy: RetentionPolicy{Daily: 7}}
+
+	_, err = NewGitHubHost(NewGitHubHostInput{BackupDir: t.TempDir(), BackupOptions: options})
+	require.ErrorContains(t, err, "BackupsToRetain must be set")
+
+	_, err = NewGitHubHost(NewGitHubHostInput{BackupDir: t.TempDir(), BackupsToRetain: 7, BackupOptions: options})
+	require.NoError(t, err)
+}
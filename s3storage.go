@@ -0,0 +1,246 @@
+package githosts
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+	// objects larger than the part size are uploaded in parts, as single uploads are limited to 5 GiB
+	s3DefaultPartSize = 64 << 20
+	s3MinPartSize     = 5 << 20
+	// timeouts of the default transport, which don't limit the time taken to transfer objects
+	s3DialTimeout           = 30 * time.Second
+	s3TLSHandshakeTimeout   = 10 * time.Second
+	s3ResponseHeaderTimeout = 60 * time.Second
+)
+
+// NewS3StorageInput describes an S3 compatible bucket, such as AWS S3 or MinIO.
+type NewS3StorageInput struct {
+	// Endpoint is the URL of the service, e.g. https://s3.eu-west-2.amazonaws.com or http://localhost:9000.
+	Endpoint string
+	// Region defaults to us-east-1.
+	Region string
+	Bucket string
+	// Prefix is prepended to the keys of all objects, allowing a bucket to be shared.
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is required when using temporary credentials.
+	SessionToken string
+	// PartSize is the size of the parts objects larger than it are uploaded in,
+	// defaulting to 64 MiB. S3 requires parts of at least 5 MiB.
+	PartSize int64
+	// Transport defaults to one that gives up on connections and responses that stall.
+	Transport http.RoundTripper
+}
+
+// S3Storage stores objects in an S3 compatible bucket using path style requests.
+type S3Storage struct {
+	Bucket string
+	Prefix string
+	// PartSize is the size of the parts objects larger than it are uploaded in.
+	PartSize int64
+	client   *minio.Client
+}
+
+func NewS3Storage(input NewS3StorageInput) (*S3Storage, errors.E) {
+	switch {
+	case input.Endpoint == "":
+		return nil, errors.New("endpoint not specified")
+	case input.Bucket == "":
+		return nil, errors.New("bucket not specified")
+	case input.AccessKeyID == "" || input.SecretAccessKey == "":
+		return nil, errors.New("access key id and secret access key must be specified")
+	case input.PartSize != 0 && input.PartSize < s3MinPartSize:
+		return nil, errors.Errorf("part size must be at least %d bytes", s3MinPartSize)
+	}
+
+	endpoint, err := url.Parse(input.Endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid endpoint: %s", input.Endpoint)
+	}
+
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, errors.Errorf("invalid endpoint scheme: %s", input.Endpoint)
+	}
+
+	if strings.Trim(endpoint.Path, "/") != "" {
+		return nil, errors.Errorf("endpoint must not have a path: %s", input.Endpoint)
+	}
+
+	region := input.Region
+	if region == "" {
+		region = s3DefaultRegion
+	}
+
+	partSize := input.PartSize
+	if partSize == 0 {
+		partSize = s3DefaultPartSize
+	}
+
+	transport := input.Transport
+	if transport == nil {
+		transport = s3Transport()
+	}
+
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(input.AccessKeyID, input.SecretAccessKey, input.SessionToken),
+		Secure:       endpoint.Scheme == "https",
+		Region:       region,
+		Transport:    transport,
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create S3 client")
+	}
+
+	return &S3Storage{
+		Bucket:   input.Bucket,
+		Prefix:   strings.Trim(input.Prefix, "/"),
+		PartSize: partSize,
+		client:   client,
+	}, nil
+}
+
+// s3Transport returns a transport that times out connecting and waiting for responses,
+// without limiting the time taken to transfer large objects, which is instead bounded
+// by the context.
+func s3Transport() *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: s3DialTimeout}).DialContext,
+		TLSHandshakeTimeout:   s3TLSHandshakeTimeout,
+		ResponseHeaderTimeout: s3ResponseHeaderTimeout,
+		MaxIdleConns:          maxIdleConns,
+		IdleConnTimeout:       idleConnTimeout,
+	}
+}
+
+// Location returns the S3 URI of the object.
+func (s *S3Storage) Location(key string) string {
+	return "s3://" + s.Bucket + "/" + s.objectName(key)
+}
+
+func (s *S3Storage) objectName(key string) string {
+	if s.Prefix == "" {
+		return key
+	}
+
+	return s.Prefix + "/" + key
+}
+
+// s3Error wraps the error returned for the object, as ErrObjectNotFound if it doesn't exist.
+func (s *S3Storage) s3Error(err error, action, key string) errors.E {
+	if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+		err = errors.Prefix(err, ErrObjectNotFound)
+	}
+
+	return errors.Wrapf(err, "failed to %s %s", action, s.Location(key))
+}
+
+// Put streams the object to the bucket, holding no more than a part in memory at a time.
+// Objects larger than the part size are uploaded in parts.
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader) errors.E {
+	var first bytes.Buffer
+
+	n, err := io.CopyN(&first, r, s.PartSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return errors.Wrapf(err, "failed to read %s", key)
+	}
+
+	opts := minio.PutObjectOptions{PartSize: uint64(s.PartSize)}
+
+	// objects no larger than a part are uploaded at once
+	if n < s.PartSize {
+		_, err = s.client.PutObject(ctx, s.Bucket, s.objectName(key), &first, n, opts)
+	} else {
+		_, err = s.client.PutObject(ctx, s.Bucket, s.objectName(key), io.MultiReader(&first, r), -1, opts)
+	}
+
+	if err != nil {
+		return s.s3Error(err, "put", key)
+	}
+
+	return nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, errors.E) {
+	obj, err := s.client.GetObject(ctx, s.Bucket, s.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s.s3Error(err, "get", key)
+	}
+
+	// the object is only requested once it's read or stat'd, so errors are found before returning it
+	if _, err = obj.Stat(); err != nil {
+		obj.Close()
+
+		return nil, s.s3Error(err, "get", key)
+	}
+
+	return obj, nil
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]StorageObject, errors.E) {
+	var objects []StorageObject
+
+	for info := range s.client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{
+		Prefix:    s.objectName(prefix),
+		Recursive: true,
+	}) {
+		if info.Err != nil {
+			return nil, errors.Wrapf(info.Err, "failed to list %s", s.Location(prefix))
+		}
+
+		key := info.Key
+		if s.Prefix != "" {
+			key = strings.TrimPrefix(key, s.Prefix+"/")
+		}
+
+		objects = append(objects, StorageObject{
+			Key:      key,
+			Size:     info.Size,
+			Modified: info.LastModified,
+		})
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	return objects, nil
+}
+
+// Delete removes the object. S3 doesn't report whether the object existed.
+func (s *S3Storage) Delete(ctx context.Context, key string) errors.E {
+	if err := s.client.RemoveObject(ctx, s.Bucket, s.objectName(key), minio.RemoveObjectOptions{}); err != nil {
+		return s.s3Error(err, "delete", key)
+	}
+
+	return nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (StorageObject, errors.E) {
+	info, err := s.client.StatObject(ctx, s.Bucket, s.objectName(key), minio.StatObjectOptions{})
+	if err != nil {
+		return StorageObject{}, s.s3Error(err, "stat", key)
+	}
+
+	return StorageObject{
+		Key:      key,
+		Size:     info.Size,
+		Modified: info.LastModified,
+	}, nil
+}
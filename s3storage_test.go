@@ -0,0 +1,387 @@
+package githosts
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is a minimal stand-in for an S3 compatible service such as MinIO.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	// pageSize limits the number of keys returned by each list request.
+	pageSize int
+	// uploads holds the parts of multipart uploads in progress, by upload id.
+	uploads map[string]map[int][]byte
+	// completedParts is the number of parts of each object uploaded in parts.
+	completedParts map[string]int
+	// failPart fails uploads of the part with this number, if set.
+	failPart int
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+	t.Helper()
+
+	f := &fakeS3{
+		bucket:         bucket,
+		objects:        map[string][]byte{},
+		pageSize:       2,
+		uploads:        map[string]map[int][]byte{},
+		completedParts: map[string]int{},
+	}
+
+	// minio-go signs payloads in chunks over plain HTTP, which the fake doesn't decode
+	server := httptest.NewTLSServer(f)
+	t.Cleanup(server.Close)
+
+	return f, server
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+
+		return
+	}
+
+	bucketPath := "/" + f.bucket
+
+	if strings.TrimSuffix(r.URL.Path, "/") == bucketPath && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+		f.list(w, r)
+
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, bucketPath+"/") {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, bucketPath+"/")
+
+	if r.URL.Query().Has("uploads") || r.URL.Query().Has("uploadId") {
+		f.multipart(w, r, key)
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		body, ok := readVerifiedBody(w, r)
+		if !ok {
+			return
+		}
+
+		f.objects[key] = body
+	case http.MethodGet, http.MethodHead:
+		body, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(body)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// readVerifiedBody reads the request's body, checking it matches any signed hash.
+func readVerifiedBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, _ := io.ReadAll(r.Body)
+
+	hash := sha256.Sum256(body)
+	if signed := r.Header.Get("X-Amz-Content-Sha256"); signed != "UNSIGNED-PAYLOAD" && signed != hex.EncodeToString(hash[:]) {
+		http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+
+		return nil, false
+	}
+
+	return body, true
+}
+
+func (f *fakeS3) multipart(w http.ResponseWriter, r *http.Request, key string) {
+	body, ok := readVerifiedBody(w, r)
+	if !ok {
+		return
+	}
+
+	uploadID := r.URL.Query().Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Query().Has("uploads"):
+		uploadID = strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[uploadID] = map[int][]byte{}
+
+		_, _ = w.Write([]byte("<InitiateMultipartUploadResult><UploadId>" + uploadID + "</UploadId></InitiateMultipartUploadResult>"))
+	case f.uploads[uploadID] == nil:
+		http.Error(w, "NoSuchUpload", http.StatusNotFound)
+	case r.Method == http.MethodPut:
+		partNumber, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if partNumber == f.failPart {
+			http.Error(w, "InvalidRequest", http.StatusBadRequest)
+
+			return
+		}
+
+		f.uploads[uploadID][partNumber] = body
+
+		w.Header().Set("ETag", `"etag-`+strconv.Itoa(partNumber)+`"`)
+	case r.Method == http.MethodPost:
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			http.Error(w, "MalformedXML", http.StatusBadRequest)
+
+			return
+		}
+
+		var content []byte
+
+		for x, part := range complete.Parts {
+			if part.PartNumber != x+1 || strings.Trim(part.ETag, `"`) != "etag-"+strconv.Itoa(part.PartNumber) {
+				http.Error(w, "InvalidPart", http.StatusBadRequest)
+
+				return
+			}
+
+			content = append(content, f.uploads[uploadID][part.PartNumber]...)
+		}
+
+		f.objects[key] = content
+		f.completedParts[key] = len(complete.Parts)
+		delete(f.uploads, uploadID)
+
+		_, _ = w.Write([]byte("<CompleteMultipartUploadResult><Bucket>" + f.bucket + "</Bucket><Key>" + key +
+			"</Key></CompleteMultipartUploadResult>"))
+	case r.Method == http.MethodDelete:
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+
+	for k := range f.objects {
+		if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	end := min(start+f.pageSize, len(keys))
+
+	type content struct {
+		Key          string
+		Size         int
+		LastModified time.Time
+	}
+
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{
+		IsTruncated: end < len(keys),
+	}
+
+	if result.IsTruncated {
+		result.NextContinuationToken = strconv.Itoa(end)
+	}
+
+	for _, k := range keys[start:end] {
+		result.Contents = append(result.Contents, content{Key: k, Size: len(f.objects[k]), LastModified: time.Now().UTC()})
+	}
+
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func newTestS3Storage(t *testing.T, prefix string) (*fakeS3, *S3Storage) {
+	t.Helper()
+
+	fake, server := newFakeS3(t, "backups")
+
+	store, err := NewS3Storage(NewS3StorageInput{
+		Endpoint:        server.URL,
+		Bucket:          "backups",
+		Prefix:          prefix,
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		Transport:       server.Client().Transport,
+	})
+	require.NoError(t, err)
+
+	return fake, store
+}
+
+func TestS3Storage(t *testing.T) {
+	t.Parallel()
+
+	fake, store := newTestS3Storage(t, "githosts")
+
+	testStorage(t, store)
+
+	require.Contains(t, fake.objects, "githosts/example.com/go-soba/repo1/a.bundle")
+	require.Equal(t, "s3://backups/githosts/example.com/go-soba/repo1/a.bundle", store.Location("example.com/go-soba/repo1/a.bundle"))
+}
+
+func TestS3StorageMultipartUpload(t *testing.T) {
+	t.Parallel()
+
+	fake, store := newTestS3Storage(t, "githosts")
+	store.PartSize = s3MinPartSize
+
+	content := strings.Repeat("0123456789", s3MinPartSize/4)
+
+	// the content is streamed, so its size isn't known before it's uploaded
+	require.NoError(t, store.Put(context.Background(), "example.com/go-soba/repo0/a.bundle", io.MultiReader(strings.NewReader(content))))
+	require.Equal(t, content, string(fake.objects["githosts/example.com/go-soba/repo0/a.bundle"]))
+	require.Equal(t, 3, fake.completedParts["githosts/example.com/go-soba/repo0/a.bundle"])
+
+	// objects smaller than a part are uploaded at once
+	require.NoError(t, store.Put(context.Background(), "example.com/go-soba/repo0/b.bundle", strings.NewReader(content[:1024])))
+	require.Equal(t, content[:1024], string(fake.objects["githosts/example.com/go-soba/repo0/b.bundle"]))
+	require.NotContains(t, fake.completedParts, "githosts/example.com/go-soba/repo0/b.bundle")
+
+	// failed uploads are aborted
+	fake.failPart = 2
+
+	err := store.Put(context.Background(), "example.com/go-soba/repo0/c.bundle", strings.NewReader(content))
+	require.ErrorContains(t, err, "failed to put")
+	require.NotContains(t, fake.objects, "githosts/example.com/go-soba/repo0/c.bundle")
+	require.Empty(t, fake.uploads)
+}
+
+func TestNewS3StorageValidation(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewS3Storage(NewS3StorageInput{Bucket: "backups", AccessKeyID: "access", SecretAccessKey: "secret"})
+	require.ErrorContains(t, err, "endpoint not specified")
+
+	_, err = NewS3Storage(NewS3StorageInput{Endpoint: "ftp://example.com", Bucket: "backups", AccessKeyID: "access", SecretAccessKey: "secret"})
+	require.ErrorContains(t, err, "invalid endpoint scheme")
+
+	_, err = NewS3Storage(NewS3StorageInput{Endpoint: "http://localhost:9000", AccessKeyID: "access", SecretAccessKey: "secret"})
+	require.ErrorContains(t, err, "bucket not specified")
+
+	_, err = NewS3Storage(NewS3StorageInput{Endpoint: "http://localhost:9000", Bucket: "backups", AccessKeyID: "access", SecretAccessKey: "secret", PartSize: 1024})
+	require.ErrorContains(t, err, "part size")
+
+	_, err = NewS3Storage(NewS3StorageInput{Endpoint: "http://localhost:9000/s3", Bucket: "backups", AccessKeyID: "access", SecretAccessKey: "secret"})
+	require.ErrorContains(t, err, "endpoint must not have a path")
+
+	store, err := NewS3Storage(NewS3StorageInput{Endpoint: "http://localhost:9000", Bucket: "backups", AccessKeyID: "access", SecretAccessKey: "secret"})
+	require.NoError(t, err)
+	require.EqualValues(t, s3DefaultPartSize, store.PartSize)
+}
+
+func TestProcessBackupToS3Storage(t *testing.T) {
+	t.Parallel()
+
+	fake, store := newTestS3Storage(t, "")
+
+	sourcePath := createTestGitRepo(t)
+	backupDir := t.TempDir()
+
+	in := processBackupInput{
+		repo:             testRepository(sourcePath),
+		backupDir:        backupDir,
+		backupsToKeep:    2,
+		diffRemoteMethod: cloneMethod,
+		storage:          store,
+	}
+
+	first, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusCreated, first.status)
+	require.Regexp(t, `^s3://backups/example\.com/go-soba/repo0/repo0\.\d{14}\.bundle$`, first.bundlePath)
+	require.Positive(t, first.bundleSize)
+	require.Equal(t, 1, first.refCount)
+
+	// only working clones are written locally
+	require.NoDirExists(t, filepath.Join(backupDir, "example.com"))
+
+	// identical bundles are removed from the storage
+	time.Sleep(time.Second)
+
+	unchanged, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusUnchanged, unchanged.status)
+	require.Equal(t, first.bundlePath, unchanged.bundlePath)
+
+	// refs are compared with the stored manifest
+	refsIn := in
+	refsIn.diffRemoteMethod = refsMethod
+
+	unchanged, err = processBackup(context.Background(), refsIn)
+	require.NoError(t, err)
+	require.Equal(t, StatusUnchanged, unchanged.status)
+	require.Equal(t, "refs match existing bundle", unchanged.reason)
+
+	// older bundles are pruned from the storage
+	for _, message := range []string{"second", "third"} {
+		time.Sleep(time.Second)
+
+		addTestCommit(t, sourcePath, message)
+
+		out, backupErr := processBackup(context.Background(), in)
+		require.NoError(t, backupErr)
+		require.Equal(t, StatusCreated, out.status)
+	}
+
+	bfs, bfErr := getBundleFiles(context.Background(), store, "example.com/go-soba/repo0")
+	require.NoError(t, bfErr)
+	require.Len(t, bfs, 2)
+	require.Len(t, fake.objects, 4, "expected two bundles and their manifests")
+
+	restoreIn := RestoreInput{
+		Storage:           store,
+		Domain:            "example.com",
+		PathWithNameSpace: "go-soba/repo0",
+		DestDir:           filepath.Join(t.TempDir(), "restored"),
+		Bare:              true,
+	}
+
+	res, err := Restore(context.Background(), restoreIn)
+	require.NoError(t, err)
+	require.Equal(t, "s3://backups/example.com/go-soba/repo0/"+bfs[1].name, res.BundlePath)
+	require.Equal(t, gitOutput(t, sourcePath, "rev-parse", "HEAD"), gitOutput(t, restoreIn.DestDir, "rev-parse", "HEAD"))
+}
@@ -0,0 +1,110 @@
+package githosts
+
+import (
+	"os"
+	"slices"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// values for SSHConfig StrictHostKeyChecking
+const (
+	StrictHostKeyCheckingYes       = "yes"
+	StrictHostKeyCheckingAcceptNew = "accept-new"
+	StrictHostKeyCheckingNo        = "no"
+)
+
+// SSHConfig clones repositories over SSH using their SSH URLs, rather than HTTPS URLs
+// containing tokens. Provider APIs are still accessed using the host's token.
+type SSHConfig struct {
+	// PrivateKeyPath is the private key to authenticate with. Only this key is offered if set.
+	PrivateKeyPath string
+	// AgentSocket is the ssh-agent socket to authenticate with, in place of SSH_AUTH_SOCK.
+	AgentSocket string
+	// KnownHostsFile holds the keys of trusted hosts, in place of ~/.ssh/known_hosts.
+	KnownHostsFile string
+	// StrictHostKeyChecking is one of the StrictHostKeyChecking constants, defaulting to
+	// StrictHostKeyCheckingYes so that hosts must already be in the known hosts file.
+	StrictHostKeyChecking string
+	// Command is the ssh client to run, defaulting to ssh.
+	Command string
+}
+
+// Validate checks the files and sockets referred to exist.
+func (c *SSHConfig) Validate() errors.E {
+	if c == nil {
+		return nil
+	}
+
+	for name, p := range map[string]string{
+		"private key":      c.PrivateKeyPath,
+		"agent socket":     c.AgentSocket,
+		"known hosts file": c.KnownHostsFile,
+	} {
+		if p == "" {
+			continue
+		}
+
+		if _, err := os.Stat(p); err != nil {
+			return errors.Errorf("invalid SSH config: %s not found: %s", name, p)
+		}
+	}
+
+	if c.StrictHostKeyChecking != "" && !slices.Contains([]string{
+		StrictHostKeyCheckingYes,
+		StrictHostKeyCheckingAcceptNew,
+		StrictHostKeyCheckingNo,
+	}, c.StrictHostKeyChecking) {
+		return errors.Errorf("invalid SSH config: unexpected strict host key checking value: %s", c.StrictHostKeyChecking)
+	}
+
+	return nil
+}
+
+// command returns the value of GIT_SSH_COMMAND, which git runs using the shell.
+func (c *SSHConfig) command() string {
+	sshCommand := c.Command
+	if sshCommand == "" {
+		sshCommand = "ssh"
+	}
+
+	args := []string{shellQuote(sshCommand), "-o", "BatchMode=yes"}
+
+	if c.PrivateKeyPath != "" {
+		args = append(args, "-i", shellQuote(c.PrivateKeyPath), "-o", "IdentitiesOnly=yes")
+	}
+
+	if c.KnownHostsFile != "" {
+		args = append(args, "-o", shellQuote("UserKnownHostsFile="+c.KnownHostsFile))
+	}
+
+	strict := c.StrictHostKeyChecking
+	if strict == "" {
+		strict = StrictHostKeyCheckingYes
+	}
+
+	return strings.Join(append(args, "-o", "StrictHostKeyChecking="+strict), " ")
+}
+
+// gitEnv returns the environment variables for git commands that contact the remote,
+// or nil if SSH isn't configured.
+func (c *SSHConfig) gitEnv() []string {
+	if c == nil {
+		return nil
+	}
+
+	// the options are for OpenSSH, so git needn't probe the client to find out
+	env := []string{"GIT_SSH_COMMAND=" + c.command(), "GIT_SSH_VARIANT=ssh"}
+
+	if c.AgentSocket != "" {
+		env = append(env, "SSH_AUTH_SOCK="+c.AgentSocket)
+	}
+
+	return env
+}
+
+// shellQuote quotes s for use as a single word in a POSIX shell command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
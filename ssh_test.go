@@ -0,0 +1,143 @@
+package githosts
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSSHCommand returns an ssh client stand-in that runs the git command it's given locally,
+// along with the file it records its arguments and agent socket to.
+func newTestSSHCommand(t *testing.T) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	command := filepath.Join(dir, "fake ssh")
+	argsFile := filepath.Join(dir, "args")
+
+	script := `#!/bin/sh
+echo "$SSH_AUTH_SOCK $*" >> '` + argsFile + `'
+for last; do :; done
+# git-upload-pack '/path/to/repo'
+eval "git ${last#git-}"
+`
+	require.NoError(t, os.WriteFile(command, []byte(script), 0o700))
+
+	return command, argsFile
+}
+
+func TestProcessBackupOverSSH(t *testing.T) {
+	t.Parallel()
+
+	command, argsFile := newTestSSHCommand(t)
+
+	configDir := t.TempDir()
+	keyPath := filepath.Join(configDir, "id_ed25519")
+	knownHostsPath := filepath.Join(configDir, "known_hosts")
+	socketPath := filepath.Join(configDir, "agent.sock")
+
+	for _, p := range []string{keyPath, knownHostsPath, socketPath} {
+		require.NoError(t, os.WriteFile(p, nil, 0o600))
+	}
+
+	sourcePath := createTestGitRepo(t)
+
+	repo := testRepository(sourcePath)
+	repo.SSHUrl = "git@example.com:" + sourcePath
+	// the HTTPS URL must not be used
+	repo.HTTPSUrl = "https://invalid.example.com/go-soba/repo0.git"
+
+	ssh := &SSHConfig{
+		PrivateKeyPath:        keyPath,
+		AgentSocket:           socketPath,
+		KnownHostsFile:        knownHostsPath,
+		StrictHostKeyChecking: StrictHostKeyCheckingAcceptNew,
+		Command:               command,
+	}
+	require.NoError(t, ssh.Validate())
+
+	in := processBackupInput{
+		repo:             repo,
+		backupDir:        t.TempDir(),
+		diffRemoteMethod: refsMethod,
+		mirrorCache:      true,
+		ssh:              ssh,
+	}
+
+	out, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusCreated, out.status)
+
+	// the refs are listed over SSH
+	out, err = processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusUnchanged, out.status)
+	require.Equal(t, "refs match existing bundle", out.reason)
+
+	// the mirror is fetched into over SSH
+	addTestCommit(t, sourcePath, "second")
+
+	in.diffRemoteMethod = cloneMethod
+
+	out, err = processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusCreated, out.status)
+
+	args, readErr := os.ReadFile(argsFile)
+	require.NoError(t, readErr)
+
+	calls := strings.Split(strings.TrimSpace(string(args)), "\n")
+	require.Len(t, calls, 4, "expected ls-remote, clone, fetch and ls-remote of HEAD")
+
+	for _, call := range calls {
+		require.Equal(t, socketPath+" -o BatchMode=yes -i "+keyPath+" -o IdentitiesOnly=yes -o UserKnownHostsFile="+knownHostsPath+
+			" -o StrictHostKeyChecking=accept-new -o SendEnv=GIT_PROTOCOL git@example.com git-upload-pack '"+sourcePath+"'", call)
+	}
+
+	// repositories without an SSH URL fail
+	in.repo.SSHUrl = ""
+
+	_, err = processBackup(context.Background(), in)
+	require.ErrorContains(t, err, "no SSH URL for repository")
+}
+
+func TestSSHConfigCommand(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "'ssh' -o BatchMode=yes -o StrictHostKeyChecking=yes", (&SSHConfig{}).command())
+
+	c := &SSHConfig{
+		PrivateKeyPath:        "/keys/soba's key",
+		StrictHostKeyChecking: StrictHostKeyCheckingNo,
+	}
+
+	// the command is run by the shell
+	out, err := exec.Command("sh", "-c", "printf '%s\\n' "+strings.TrimPrefix(c.command(), "'ssh'")).Output()
+	require.NoError(t, err)
+	require.Equal(t, "-o\nBatchMode=yes\n-i\n/keys/soba's key\n-o\nIdentitiesOnly=yes\n-o\nStrictHostKeyChecking=no\n", string(out))
+
+	require.Nil(t, (*SSHConfig)(nil).gitEnv())
+}
+
+func TestSSHConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, (*SSHConfig)(nil).Validate())
+
+	err := (&SSHConfig{PrivateKeyPath: filepath.Join(t.TempDir(), "missing")}).Validate()
+	require.ErrorContains(t, err, "private key not found")
+
+	err = (&SSHConfig{StrictHostKeyChecking: "maybe"}).Validate()
+	require.ErrorContains(t, err, "unexpected strict host key checking value: maybe")
+
+	_, hostErr := NewGitHubHost(NewGitHubHostInput{
+		BackupDir:     t.TempDir(),
+		BackupOptions: BackupOptions{SSH: &SSHConfig{KnownHostsFile: filepath.Join(t.TempDir(), "missing")}},
+	})
+	require.ErrorContains(t, hostErr, "known hosts file not found")
+}
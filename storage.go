@@ -0,0 +1,294 @@
+package githosts
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// ErrObjectNotFound is returned by a Storage when the requested object does not exist.
+var ErrObjectNotFound = errors.Base("object not found")
+
+// StorageObject describes an object held in a Storage.
+type StorageObject struct {
+	// Key is the slash separated path of the object, e.g. github.com/owner/repo/repo.20240101000000.bundle.
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// Storage holds bundles and their manifests. Keys are slash separated paths relative
+// to the root of the storage, with bundles stored under <domain>/<path with namespace>/.
+type Storage interface {
+	// Put writes the object, replacing any existing object with the same key.
+	// The object must not be visible to other operations until completely written.
+	Put(ctx context.Context, key string, r io.Reader) errors.E
+	// Get returns the content of the object, which must be closed by the caller.
+	Get(ctx context.Context, key string) (io.ReadCloser, errors.E)
+	// List returns the objects whose keys begin with the prefix, sorted by key.
+	List(ctx context.Context, prefix string) ([]StorageObject, errors.E)
+	// Delete removes the object.
+	Delete(ctx context.Context, key string) errors.E
+	// Stat describes the object.
+	Stat(ctx context.Context, key string) (StorageObject, errors.E)
+}
+
+// locator is implemented by storages that can describe where an object is stored,
+// such as a file path or URL, for reporting in results.
+type locator interface {
+	Location(key string) string
+}
+
+// objectLocation returns where the object is stored, or its key if the storage can't describe it.
+func objectLocation(store Storage, key string) string {
+	if l, ok := store.(locator); ok {
+		return l.Location(key)
+	}
+
+	return key
+}
+
+// LocalStorage stores objects as files beneath a directory.
+type LocalStorage struct {
+	Dir string
+}
+
+// NewLocalStorage returns a Storage that stores objects as files beneath dir.
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{Dir: dir}
+}
+
+// Location returns the path of the file the object is stored in.
+func (s *LocalStorage) Location(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
+
+// Put writes the object to a temporary file before renaming it into place.
+func (s *LocalStorage) Put(ctx context.Context, key string, r io.Reader) errors.E {
+	p := s.Location(key)
+
+	if err := createDirIfAbsent(filepath.Dir(p)); err != nil {
+		return errors.Wrapf(err, "failed to create directory for %s", p)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temporary file for %s", p)
+	}
+
+	_, err = io.Copy(tmp, contextReader{ctx: ctx, r: r})
+
+	if closeErr := tmp.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+
+	if err != nil {
+		if rmErr := os.Remove(tmp.Name()); rmErr != nil && !os.IsNotExist(rmErr) {
+			logger.Printf("failed to remove temporary file: %s: %s", tmp.Name(), rmErr)
+		}
+
+		return errors.Wrapf(err, "failed to write %s", p)
+	}
+
+	return nil
+}
+
+// Get opens the file the object is stored in.
+func (s *LocalStorage) Get(_ context.Context, key string) (io.ReadCloser, errors.E) {
+	f, err := os.Open(s.Location(key))
+	if os.IsNotExist(err) {
+		return nil, errors.Prefix(err, ErrObjectNotFound)
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s", s.Location(key))
+	}
+
+	return f, nil
+}
+
+// List walks the directories beneath the prefix for files, skipping any that cannot be read.
+func (s *LocalStorage) List(ctx context.Context, prefix string) ([]StorageObject, errors.E) {
+	// only walk the deepest directory the prefix names
+	dir := prefix
+	if !strings.HasSuffix(prefix, "/") {
+		dir = path.Dir(prefix)
+	}
+
+	root := s.Location(dir)
+
+	var objects []StorageObject
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+
+			logger.Printf("failed to read %s: %s", p, err)
+
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if d.IsDir() {
+			// working clones are not stored objects
+			if d.Name() == workingDIRName && p != root {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		rel, relErr := filepath.Rel(root, p)
+		if relErr != nil {
+			return relErr
+		}
+
+		key := filepath.ToSlash(rel)
+		if dir != "." {
+			key = path.Join(dir, key)
+		}
+
+		if !strings.HasPrefix(key, prefix) || strings.HasSuffix(key, ".tmp") {
+			return nil
+		}
+
+		// links are described rather than followed, so broken links are still listed
+		info, infoErr := d.Info()
+		if infoErr != nil {
+			logger.Printf("failed to read %s: %s", p, infoErr)
+
+			return nil
+		}
+
+		objects = append(objects, StorageObject{
+			Key:      key,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list %s", root)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	return objects, nil
+}
+
+// Delete removes the file the object is stored in.
+func (s *LocalStorage) Delete(_ context.Context, key string) errors.E {
+	err := os.Remove(s.Location(key))
+	if os.IsNotExist(err) {
+		return errors.Prefix(err, ErrObjectNotFound)
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "failed to remove %s", s.Location(key))
+	}
+
+	return nil
+}
+
+// Stat describes the file the object is stored in.
+func (s *LocalStorage) Stat(_ context.Context, key string) (StorageObject, errors.E) {
+	info, err := os.Stat(s.Location(key))
+	if os.IsNotExist(err) {
+		return StorageObject{}, errors.Prefix(err, ErrObjectNotFound)
+	}
+
+	if err != nil {
+		return StorageObject{}, errors.Wrapf(err, "failed to stat %s", s.Location(key))
+	}
+
+	if info.IsDir() {
+		return StorageObject{}, errors.Errorf("%s is a directory", s.Location(key))
+	}
+
+	return StorageObject{
+		Key:      key,
+		Size:     info.Size(),
+		Modified: info.ModTime(),
+	}, nil
+}
+
+// contextReader stops reading once the context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return c.r.Read(p)
+}
+
+// listDir returns the objects directly within the directory, excluding those in subdirectories.
+func listDir(ctx context.Context, store Storage, dir string) ([]StorageObject, errors.E) {
+	prefix := ""
+	if dir != "" {
+		prefix = strings.TrimSuffix(dir, "/") + "/"
+	}
+
+	objects, err := store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var direct []StorageObject
+
+	for _, o := range objects {
+		if !strings.Contains(strings.TrimPrefix(o.Key, prefix), "/") {
+			direct = append(direct, o)
+		}
+	}
+
+	return direct, nil
+}
+
+// moveObject copies the object to a new key before deleting the original.
+func moveObject(ctx context.Context, store Storage, from, to string) errors.E {
+	if l, ok := store.(*LocalStorage); ok {
+		if err := os.Rename(l.Location(from), l.Location(to)); err != nil {
+			return errors.Wrapf(err, "failed to rename %s", l.Location(from))
+		}
+
+		return nil
+	}
+
+	r, err := store.Get(ctx, from)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	if err = store.Put(ctx, to, r); err != nil {
+		return err
+	}
+
+	return store.Delete(ctx, from)
+}
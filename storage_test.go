@@ -0,0 +1,103 @@
+package githosts
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+)
+
+// testStorage exercises the operations of a Storage.
+func testStorage(t *testing.T, store Storage) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	require.NoError(t, store.Put(ctx, "example.com/go-soba/repo0/a.bundle", strings.NewReader("one")))
+	require.NoError(t, store.Put(ctx, "example.com/go-soba/repo0/b.bundle", strings.NewReader("two")))
+	require.NoError(t, store.Put(ctx, "example.com/go-soba/repo1/a.bundle", strings.NewReader("three")))
+
+	// existing objects are replaced
+	require.NoError(t, store.Put(ctx, "example.com/go-soba/repo0/b.bundle", strings.NewReader("four")))
+
+	r, err := store.Get(ctx, "example.com/go-soba/repo0/b.bundle")
+	require.NoError(t, err)
+
+	content, readErr := io.ReadAll(r)
+	require.NoError(t, readErr)
+	require.NoError(t, r.Close())
+	require.Equal(t, "four", string(content))
+
+	obj, err := store.Stat(ctx, "example.com/go-soba/repo0/b.bundle")
+	require.NoError(t, err)
+	require.Equal(t, "example.com/go-soba/repo0/b.bundle", obj.Key)
+	require.Equal(t, int64(4), obj.Size)
+
+	objects, err := store.List(ctx, "example.com/go-soba/repo0/")
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	require.Equal(t, "example.com/go-soba/repo0/a.bundle", objects[0].Key)
+	require.Equal(t, "example.com/go-soba/repo0/b.bundle", objects[1].Key)
+
+	objects, err = store.List(ctx, "example.com/go-soba/repo")
+	require.NoError(t, err)
+	require.Len(t, objects, 3)
+
+	objects, err = listDir(ctx, store, "example.com/go-soba")
+	require.NoError(t, err)
+	require.Empty(t, objects)
+
+	objects, err = store.List(ctx, "missing/")
+	require.NoError(t, err)
+	require.Empty(t, objects)
+
+	require.NoError(t, store.Delete(ctx, "example.com/go-soba/repo0/a.bundle"))
+
+	_, err = store.Get(ctx, "example.com/go-soba/repo0/a.bundle")
+	require.True(t, errors.Is(err, ErrObjectNotFound), err)
+
+	_, err = store.Stat(ctx, "example.com/go-soba/repo0/a.bundle")
+	require.True(t, errors.Is(err, ErrObjectNotFound), err)
+}
+
+func TestLocalStorage(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	store := NewLocalStorage(dir)
+
+	testStorage(t, store)
+
+	require.Equal(t, filepath.Join(dir, "example.com", "go-soba", "repo1", "a.bundle"),
+		store.Location("example.com/go-soba/repo1/a.bundle"))
+	require.FileExists(t, store.Location("example.com/go-soba/repo1/a.bundle"))
+
+	err := store.Delete(context.Background(), "example.com/go-soba/repo1/missing.bundle")
+	require.True(t, errors.Is(err, ErrObjectNotFound), err)
+}
+
+func TestLocalStoragePutIsAtomic(t *testing.T) {
+	t.Parallel()
+
+	store := NewLocalStorage(t.TempDir())
+
+	failing := io.MultiReader(strings.NewReader("partial"), errReader{})
+
+	require.Error(t, store.Put(context.Background(), "repo/a.bundle", failing))
+
+	// neither the object or a temporary file remain
+	entries, err := os.ReadDir(store.Location("repo"))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("read failed")
+}
@@ -0,0 +1,125 @@
+package githosts
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"gitlab.com/tozd/go/errors"
+)
+
+// TLSConfig configures connections to a self-hosted instance, for both its API and git.
+type TLSConfig struct {
+	// CAFile is a PEM bundle of certificate authorities, for instances with certificates
+	// issued by a private authority. API requests trust these in addition to the system's
+	// authorities, whereas git trusts only these.
+	CAFile string
+	// ClientCertFile and ClientKeyFile are a PEM certificate and key presented to instances
+	// requiring client certificates. Both must be set to use either.
+	ClientCertFile string
+	ClientKeyFile  string
+	// InsecureSkipVerify disables verification of the instance's certificate, for test
+	// and lab instances only.
+	InsecureSkipVerify bool
+}
+
+// Validate checks the certificate authorities and client certificate can be loaded.
+func (c *TLSConfig) Validate() errors.E {
+	if c == nil {
+		return nil
+	}
+
+	_, err := c.tlsClientConfig()
+
+	return err
+}
+
+// tlsClientConfig returns the configuration for API requests, or nil for the default.
+func (c *TLSConfig) tlsClientConfig() (*tls.Config, errors.E) {
+	if c == nil {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.InsecureSkipVerify, //nolint:gosec
+	}
+
+	if (c.ClientCertFile == "") != (c.ClientKeyFile == "") {
+		return nil, errors.New("invalid TLS config: client certificate and key must be set together")
+	}
+
+	if c.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+		if err != nil {
+			return nil, errors.Errorf("invalid TLS config: failed to load client certificate: %s", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.CAFile == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, errors.Errorf("invalid TLS config: failed to read CA file: %s", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("invalid TLS config: no certificates found in CA file: %s", c.CAFile)
+	}
+
+	config.RootCAs = pool
+
+	return config, nil
+}
+
+// httpClient returns the default client for API requests, using the configuration if set.
+func (c *TLSConfig) httpClient() (*retryablehttp.Client, errors.E) {
+	client := getHTTPClient()
+
+	if c == nil {
+		return client, nil
+	}
+
+	config, err := c.tlsClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client.HTTPClient.Transport.(*http.Transport).TLSClientConfig = config
+
+	return client, nil
+}
+
+// gitEnv returns the environment variables configuring git's TLS connections.
+func (c *TLSConfig) gitEnv() []string {
+	if c == nil {
+		return nil
+	}
+
+	var env []string
+
+	if c.CAFile != "" {
+		env = append(env, "GIT_SSL_CAINFO="+c.CAFile)
+	}
+
+	if c.ClientCertFile != "" {
+		env = append(env, "GIT_SSL_CERT="+c.ClientCertFile, "GIT_SSL_KEY="+c.ClientKeyFile)
+	}
+
+	if c.InsecureSkipVerify {
+		env = append(env, "GIT_SSL_NO_VERIFY=true")
+	}
+
+	return env
+}
@@ -0,0 +1,136 @@
+package githosts
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCAFile writes the TLS test server's certificate as a CA file.
+func writeTestCAFile(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}), 0o600))
+
+	return caFile
+}
+
+// writeTestClientCertificate writes a self-signed client certificate and its key.
+func writeTestClientCertificate(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "soba"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	var c *TLSConfig
+
+	require.NoError(t, c.Validate())
+	require.Nil(t, c.gitEnv())
+	require.Nil(t, (&TLSConfig{}).gitEnv())
+
+	require.ErrorContains(t, (&TLSConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}).Validate(), "failed to read CA file")
+
+	invalid := filepath.Join(t.TempDir(), "invalid.pem")
+	require.NoError(t, os.WriteFile(invalid, []byte("invalid"), 0o600))
+	require.ErrorContains(t, (&TLSConfig{CAFile: invalid}).Validate(), "no certificates found in CA file")
+
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+
+	c = &TLSConfig{CAFile: writeTestCAFile(t, server)}
+	require.NoError(t, c.Validate())
+	require.Equal(t, []string{"GIT_SSL_CAINFO=" + c.CAFile}, c.gitEnv())
+
+	// requests to the server are only trusted with the CA
+	resp, err := getHTTPClient().Get(server.URL)
+	require.Error(t, err)
+	require.Nil(t, resp)
+
+	client, err := c.httpClient()
+	require.NoError(t, err)
+
+	resp, err = client.Get(server.URL)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+}
+
+func TestTLSConfigClientCertificate(t *testing.T) {
+	t.Parallel()
+
+	certFile, keyFile := writeTestClientCertificate(t)
+
+	require.ErrorContains(t, (&TLSConfig{ClientCertFile: certFile}).Validate(), "client certificate and key must be set together")
+	require.ErrorContains(t, (&TLSConfig{ClientCertFile: certFile, ClientKeyFile: certFile}).Validate(), "failed to load client certificate")
+
+	c := &TLSConfig{ClientCertFile: certFile, ClientKeyFile: keyFile, InsecureSkipVerify: true}
+	require.NoError(t, c.Validate())
+	require.Equal(t, []string{
+		"GIT_SSL_CERT=" + certFile,
+		"GIT_SSL_KEY=" + keyFile,
+		"GIT_SSL_NO_VERIFY=true",
+	}, c.gitEnv())
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert, MinVersion: tls.VersionTLS12}
+	server.StartTLS()
+
+	defer server.Close()
+
+	client, clientErr := c.httpClient()
+	require.NoError(t, clientErr)
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, "soba", string(body))
+}
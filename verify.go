@@ -0,0 +1,353 @@
+package githosts
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"filippo.io/age"
+	"gitlab.com/tozd/go/errors"
+)
+
+// statuses reported in BundleVerification
+const (
+	BundleHealthy    = "healthy"
+	BundleCorrupt    = "corrupt"
+	BundleUnreadable = "unreadable"
+)
+
+// VerifyInput describes the backups to verify.
+type VerifyInput struct {
+	BackupDir string
+	// Storage optionally holds the bundles in place of BackupDir, such as an S3Storage.
+	Storage Storage
+	// Fsck restores each bundle to a temporary repository and runs a full git fsck,
+	// rather than only checking the bundle's checksum, structure and prerequisites.
+	Fsck bool
+	// DecryptionIdentities are the age identities used to decrypt encrypted bundles.
+	// Encrypted bundles are reported as unreadable if none are provided.
+	DecryptionIdentities []string
+}
+
+// BundleVerification is the outcome of verifying a single bundle.
+type BundleVerification struct {
+	Path   string   `json:"path"`
+	Status string   `json:"status"`
+	Error  errors.E `json:"error,omitempty"`
+}
+
+// VerifyReport lists the outcome of verifying every bundle in a backup directory.
+type VerifyReport struct {
+	Bundles    []BundleVerification `json:"bundles"`
+	Healthy    int                  `json:"healthy"`
+	Corrupt    int                  `json:"corrupt"`
+	Unreadable int                  `json:"unreadable"`
+}
+
+// Verify checks every bundle in the backup directory can be read and restored.
+// Bundles are never modified, so corrupt bundles are reported rather than renamed.
+func Verify(ctx context.Context, in VerifyInput) (VerifyReport, errors.E) {
+	if in.BackupDir == "" && in.Storage == nil {
+		return VerifyReport{}, errors.New("backup directory not specified")
+	}
+
+	var report VerifyReport
+
+	var identities []age.Identity
+
+	if len(in.DecryptionIdentities) > 0 {
+		var err errors.E
+
+		if identities, err = parseIdentities(in.DecryptionIdentities); err != nil {
+			return report, err
+		}
+	}
+
+	if in.Storage != nil {
+		objects, err := in.Storage.List(ctx, "")
+		if err != nil {
+			return report, err
+		}
+
+		for _, o := range objects {
+			if ctx.Err() != nil {
+				return report, errors.Wrap(ctx.Err(), "verification cancelled")
+			}
+
+			if isBundleName(path.Base(o.Key)) {
+				report.add(verifyBundle(ctx, in.Storage, o.Key, in.Fsck, identities))
+			}
+		}
+
+		return report, nil
+	}
+
+	store := NewLocalStorage(in.BackupDir)
+
+	// walk the directory, rather than listing the storage, to report paths that can't be read
+	walkErr := filepath.WalkDir(in.BackupDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// report bundles that cannot be listed rather than giving up on the whole directory
+			if p != in.BackupDir {
+				logger.Printf("failed to read %s: %s", p, err)
+
+				report.add(BundleVerification{
+					Path:   p,
+					Status: BundleUnreadable,
+					Error:  errors.Wrap(err, "failed to read path"),
+				})
+
+				return nil
+			}
+
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if d.IsDir() {
+			if d.Name() == workingDIRName {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !isBundleName(d.Name()) {
+			return nil
+		}
+
+		rel, relErr := filepath.Rel(in.BackupDir, p)
+		if relErr != nil {
+			return relErr
+		}
+
+		report.add(verifyBundle(ctx, store, filepath.ToSlash(rel), in.Fsck, identities))
+
+		return nil
+	})
+	if walkErr != nil {
+		if ctx.Err() != nil {
+			return report, errors.Wrap(ctx.Err(), "verification cancelled")
+		}
+
+		return report, errors.Wrapf(walkErr, "failed to walk backup directory %s", in.BackupDir)
+	}
+
+	return report, nil
+}
+
+func (r *VerifyReport) add(v BundleVerification) {
+	switch v.Status {
+	case BundleHealthy:
+		r.Healthy++
+	case BundleCorrupt:
+		r.Corrupt++
+	case BundleUnreadable:
+		r.Unreadable++
+	}
+
+	r.Bundles = append(r.Bundles, v)
+}
+
+func verifyBundle(ctx context.Context, store Storage, key string, fsck bool, identities []age.Identity) BundleVerification {
+	result := BundleVerification{Path: objectLocation(store, key)}
+
+	if err := checkReadable(ctx, store, key); err != nil {
+		result.Status = BundleUnreadable
+		result.Error = err
+
+		return result
+	}
+
+	if isEncryptedBundle(key) && len(identities) == 0 {
+		result.Status = BundleUnreadable
+		result.Error = errors.New("no identities provided to decrypt bundle")
+
+		return result
+	}
+
+	tmpDir, tmpErr := os.MkdirTemp("", "githosts-verify-")
+	if tmpErr != nil {
+		result.Status = BundleUnreadable
+		result.Error = errors.Wrap(tmpErr, "failed to create temporary directory")
+
+		return result
+	}
+
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			logger.Printf("failed to remove temporary directory: %s: %s", tmpDir, err)
+		}
+	}()
+
+	if err := verifyBundleInRepo(ctx, store, key, filepath.Join(tmpDir, "repo"), fsck, identities); err != nil {
+		result.Status = BundleCorrupt
+		result.Error = err
+
+		return result
+	}
+
+	result.Status = BundleHealthy
+
+	return result
+}
+
+// verifyBundleInRepo verifies the bundle using a temporary repository at repoPath.
+func verifyBundleInRepo(ctx context.Context, store Storage, key, repoPath string, fsck bool, identities []age.Identity) errors.E {
+	bundlePath := objectLocation(store, key)
+
+	manifest, found, err := readBundleManifest(ctx, store, key)
+	if err != nil {
+		return err
+	}
+
+	if manifest, err = manifest.open(identities); err != nil {
+		return err
+	}
+
+	// git only checks the header and prerequisites of a bundle, so damage to its pack is found by its checksum
+	if found && manifest.SHA256 != "" {
+		if err = checkChecksum(ctx, store, key, manifest, identities); err != nil {
+			return err
+		}
+	}
+
+	// incremental bundles can only be verified once the bundles they build upon are applied
+	if !fsck && manifest.Parent == "" {
+		if out, initErr := exec.CommandContext(ctx, "git", "init", "--bare", "--quiet", repoPath).CombinedOutput(); initErr != nil {
+			return errors.Errorf("failed to initialise repository: %s: %s", repoPath, strings.TrimSpace(string(out)))
+		}
+
+		plainPath, cleanup, decryptErr := localBundle(ctx, store, key, repoPath, identities)
+		if decryptErr != nil {
+			return decryptErr
+		}
+
+		defer cleanup()
+
+		verifyCmd := exec.CommandContext(ctx, "git", "bundle", "verify", "--quiet", plainPath)
+		verifyCmd.Dir = repoPath
+
+		if out, verifyErr := verifyCmd.CombinedOutput(); verifyErr != nil {
+			return errors.Errorf("failed to verify bundle: %s: %s", bundlePath, strings.TrimSpace(string(out)))
+		}
+
+		return nil
+	}
+
+	if err = reconstructRepository(ctx, store, key, repoPath, identities); err != nil {
+		return err
+	}
+
+	// the reconstructed repository must have every ref of the clone the bundle was created from
+	if found && manifest.Refs != nil {
+		refs, refsErr := localRefs(ctx, repoPath)
+		if refsErr != nil {
+			return refsErr
+		}
+
+		if diff := diffRefs(manifest.Refs, refs); diff != "" {
+			return errors.Errorf("reconstructed refs don't match manifest: %s: %s", bundlePath, diff)
+		}
+	}
+
+	if !fsck {
+		return nil
+	}
+
+	fsckCmd := exec.CommandContext(ctx, "git", "fsck", "--full", "--no-progress")
+	fsckCmd.Dir = repoPath
+
+	if out, fsckErr := fsckCmd.CombinedOutput(); fsckErr != nil {
+		return errors.Errorf("fsck failed: %s: %s", bundlePath, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// diffRefs describes the refs that are missing from, or differ in, the actual refs.
+func diffRefs(expected, actual gitRefs) string {
+	var diffs []string
+
+	for ref, sha := range expected {
+		switch actualSHA, ok := actual[ref]; {
+		case !ok:
+			diffs = append(diffs, ref+" missing")
+		case actualSHA != sha:
+			diffs = append(diffs, ref+" is "+actualSHA+" not "+sha)
+		}
+	}
+
+	for ref := range actual {
+		if _, ok := expected[ref]; !ok {
+			diffs = append(diffs, ref+" unexpected")
+		}
+	}
+
+	sort.Strings(diffs)
+
+	return strings.Join(diffs, ", ")
+}
+
+// checkChecksum confirms the bundle, once decrypted, has the checksum and size recorded in its manifest.
+func checkChecksum(ctx context.Context, store Storage, key string, manifest bundleManifest, identities []age.Identity) errors.E {
+	bundlePath := objectLocation(store, key)
+
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		return errors.Wrap(err, "failed to open bundle")
+	}
+
+	defer r.Close()
+
+	var src io.Reader = r
+
+	if isEncryptedBundle(key) {
+		var decryptErr error
+
+		if src, decryptErr = age.Decrypt(r, identities...); decryptErr != nil {
+			return errors.Errorf("failed to decrypt bundle: %s: %s", bundlePath, decryptErr)
+		}
+	}
+
+	hash := sha256.New()
+
+	size, copyErr := io.Copy(hash, src)
+	if copyErr != nil {
+		return errors.Errorf("failed to read bundle: %s: %s", bundlePath, copyErr)
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != manifest.SHA256 || size != manifest.Size {
+		return errors.Errorf("bundle doesn't match its manifest: %s: sha256 %s and size %d, expected %s and %d",
+			bundlePath, sum, size, manifest.SHA256, manifest.Size)
+	}
+
+	return nil
+}
+
+// checkReadable confirms the whole object can be read.
+func checkReadable(ctx context.Context, store Storage, key string) errors.E {
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		return errors.Wrap(err, "failed to open bundle")
+	}
+
+	defer r.Close()
+
+	if _, copyErr := io.Copy(io.Discard, r); copyErr != nil {
+		return errors.Wrap(copyErr, "failed to read bundle")
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package githosts
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+	backupPath := filepath.Join(backupDir, "example.com", "go-soba", "repo0")
+	commits := createTestBundles(t, backupPath, "20200101000000")
+
+	// an incremental bundle building upon the first
+	sourcePath := filepath.Join(t.TempDir(), "source")
+	out, err := exec.Command("git", "clone", "--quiet", "--mirror",
+		filepath.Join(backupPath, "repo0.20200101000000.bundle"), sourcePath).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	workPath := filepath.Join(t.TempDir(), "work")
+	out, err = exec.Command("git", "clone", "--quiet", sourcePath, workPath).CombinedOutput()
+	require.NoError(t, err, string(out))
+	addTestCommit(t, workPath, "second")
+
+	incrementalPath := filepath.Join(backupPath, "repo0.20200201000000.bundle")
+	out, err = exec.Command("git", "-C", workPath, "bundle", "create", incrementalPath,
+		"--all", "--not", commits[0]).CombinedOutput()
+	require.NoError(t, err, string(out))
+	require.NoError(t, writeBundleManifest(context.Background(), localFiles, incrementalPath, bundleManifest{
+		Parent:        "repo0.20200101000000.bundle",
+		Prerequisites: commits,
+	}))
+
+	corruptPath := filepath.Join(backupPath, "repo0.20200301000000.bundle")
+	require.NoError(t, os.WriteFile(corruptPath, []byte("corrupt"), 0o600))
+
+	// links to missing files cannot be read
+	unreadablePath := filepath.Join(backupDir, "example.com", "go-soba", "repo1", "repo1.20200101000000.bundle")
+	require.NoError(t, os.MkdirAll(filepath.Dir(unreadablePath), 0o755))
+	require.NoError(t, os.Symlink(filepath.Join(backupDir, "missing"), unreadablePath))
+
+	// working clones are not checked
+	require.NoError(t, os.MkdirAll(filepath.Join(backupDir, workingDIRName), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(backupDir, workingDIRName, "x.bundle"), nil, 0o600))
+
+	for _, fsck := range []bool{false, true} {
+		report, verifyErr := Verify(context.Background(), VerifyInput{
+			BackupDir: backupDir,
+			Fsck:      fsck,
+		})
+		require.NoError(t, verifyErr)
+		require.Len(t, report.Bundles, 4)
+		require.Equal(t, 2, report.Healthy)
+		require.Equal(t, 1, report.Corrupt)
+		require.Equal(t, 1, report.Unreadable)
+
+		statuses := map[string]string{}
+		for _, b := range report.Bundles {
+			statuses[b.Path] = b.Status
+		}
+
+		require.Equal(t, BundleHealthy, statuses[filepath.Join(backupPath, "repo0.20200101000000.bundle")])
+		require.Equal(t, BundleHealthy, statuses[incrementalPath])
+		require.Equal(t, BundleCorrupt, statuses[corruptPath])
+		require.Equal(t, BundleUnreadable, statuses[unreadablePath])
+	}
+
+	// verification doesn't rename corrupt bundles
+	require.FileExists(t, corruptPath)
+}
+
+func TestVerifyWithoutBackupDir(t *testing.T) {
+	t.Parallel()
+
+	_, err := Verify(context.Background(), VerifyInput{})
+	require.Error(t, err)
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+	backupPath := filepath.Join(backupDir, "example.com", "go-soba", "repo0")
+	createTestBundles(t, backupPath, "20200101000000")
+
+	bundlePath := filepath.Join(backupPath, "repo0.20200101000000.bundle")
+	content, err := os.ReadFile(bundlePath)
+	require.NoError(t, err)
+
+	sum := sha256.Sum256(content)
+	require.NoError(t, writeBundleManifest(context.Background(), localFiles, bundlePath, bundleManifest{
+		SHA256: hex.EncodeToString(sum[:]),
+		Size:   int64(len(content)),
+	}))
+
+	report, verifyErr := Verify(context.Background(), VerifyInput{BackupDir: backupDir})
+	require.NoError(t, verifyErr)
+	require.Equal(t, 1, report.Healthy)
+
+	// damage to the pack isn't found by git bundle verify
+	pack := bytes.Index(content, []byte("PACK"))
+	require.Positive(t, pack)
+
+	content[pack+(len(content)-pack)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(bundlePath, content, 0o600))
+
+	repoPath := t.TempDir()
+	out, err := exec.Command("git", "init", "--bare", "--quiet", repoPath).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	out, err = exec.Command("git", "-C", repoPath, "bundle", "verify", "--quiet", bundlePath).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	report, verifyErr = Verify(context.Background(), VerifyInput{BackupDir: backupDir})
+	require.NoError(t, verifyErr)
+	require.Equal(t, 0, report.Healthy)
+	require.Equal(t, 1, report.Corrupt)
+	require.Equal(t, BundleCorrupt, report.Bundles[0].Status)
+	require.ErrorContains(t, report.Bundles[0].Error, "doesn't match its manifest")
+}
+
+func TestVerifyStorage(t *testing.T) {
+	t.Parallel()
+
+	_, store := newTestS3Storage(t, "githosts")
+
+	sourcePath := createTestGitRepo(t)
+	gitOutput(t, sourcePath, "branch", "keep")
+
+	in := processBackupInput{
+		repo:             testRepository(sourcePath),
+		backupDir:        t.TempDir(),
+		diffRemoteMethod: cloneMethod,
+		incremental:      true,
+		storage:          store,
+	}
+
+	_, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+
+	// bundle names have a timestamp with a resolution of one second
+	time.Sleep(time.Second)
+
+	addTestCommit(t, sourcePath, "second")
+
+	incremental, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Equal(t, StatusCreated, incremental.status)
+
+	report, verifyErr := Verify(context.Background(), VerifyInput{Storage: store, Fsck: true})
+	require.NoError(t, verifyErr)
+	require.Len(t, report.Bundles, 2)
+	require.Equal(t, 2, report.Healthy)
+	require.Equal(t, incremental.bundlePath, report.Bundles[1].Path)
+
+	key := path.Join("example.com", "go-soba", "repo0", path.Base(incremental.bundlePath))
+
+	// a reconstruction missing a ref recorded in the manifest is corrupt, such as one
+	// pointing at a commit that was never bundled
+	addTestCommit(t, sourcePath, "unbundled")
+
+	manifest, _, err := readBundleManifest(context.Background(), store, key)
+	require.NoError(t, err)
+
+	manifest.Refs["refs/heads/lost"] = gitOutput(t, sourcePath, "rev-parse", "HEAD")
+	require.NoError(t, writeBundleManifest(context.Background(), store, key, manifest))
+
+	report, verifyErr = Verify(context.Background(), VerifyInput{Storage: store, Fsck: true})
+	require.NoError(t, verifyErr)
+	require.Equal(t, 1, report.Healthy)
+	require.Equal(t, 1, report.Corrupt)
+}